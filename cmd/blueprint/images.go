@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+const (
+	statusCurrent = "current"
+	statusStale   = "stale"
+	// the blueprint is not known, e.g it was defined inline in a test, so whether it is stale can't be checked
+	statusUnknown = "unknown"
+)
+
+func newBuilder() (*docker.Builder, error) {
+	cfg := config.NewConfigFromEnvVars(*flagPkg, "")
+	builder, err := docker.NewBuilder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create builder: %s", err)
+	}
+	return builder, nil
+}
+
+// imageStatuses returns the status of each image, by comparing its hash to the hash of the known blueprint.
+func imageStatuses(builder *docker.Builder, images []docker.BlueprintImage) []string {
+	hashes := make(map[string]string)
+	statuses := make([]string, len(images))
+	for i, img := range images {
+		bp, ok := b.KnownBlueprints[img.Blueprint]
+		if !ok {
+			statuses[i] = statusUnknown
+			continue
+		}
+		hash, ok := hashes[img.Blueprint]
+		if !ok {
+			var err error
+			hash, err = builder.BlueprintHash(*bp)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to hash blueprint %s: %s\n", img.Blueprint, err)
+			}
+			hashes[img.Blueprint] = hash
+		}
+		if hash == "" {
+			statuses[i] = statusUnknown
+		} else if img.Hash == hash {
+			statuses[i] = statusCurrent
+		} else {
+			statuses[i] = statusStale
+		}
+	}
+	return statuses
+}
+
+// images lists blueprint images and whether they are stale.
+func images() bool {
+	builder, err := newBuilder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	imgs, err := builder.BlueprintImages(*flagAll)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	statuses := imageStatuses(builder, imgs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PKG\tBLUEPRINT\tPARENT\tHS\tSTATUS\tCREATED\tSIZE\tID")
+	for i, img := range imgs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%.1fMB\t%s\n",
+			img.Pkg, img.Blueprint, img.Parent, img.HSName, statuses[i], img.Created.Format("2006-01-02 15:04:05"),
+			float64(img.Size)/1e6, shortID(img.ID),
+		)
+	}
+	w.Flush()
+	return true
+}
+
+// prune removes stale images, or all images if -all is set.
+func prune() bool {
+	builder, err := newBuilder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	imgs, err := builder.BlueprintImages(*flagAll)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	statuses := imageStatuses(builder, imgs)
+	removed := make(map[string]bool)
+	ok := true
+	for i, img := range imgs {
+		if statuses[i] != statusStale && !*flagAll {
+			continue
+		}
+		key := img.Pkg + "/" + img.Blueprint
+		if removed[key] {
+			continue
+		}
+		removed[key] = true
+		if err = builder.RemoveBlueprintImages(img.Pkg, img.Blueprint, *flagAll); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			ok = false
+			continue
+		}
+		fmt.Printf("Removed images of blueprint %s in %s\n", img.Blueprint, img.Pkg)
+	}
+	return ok
+}
+
+// export saves the images of a blueprint to a tar file.
+func export(nameOrPath, outPath string) bool {
+	bp, err := resolve(nameOrPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	builder, err := newBuilder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	f, err := os.Create(outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", outPath, err)
+		return false
+	}
+	defer f.Close()
+	if err = builder.ExportBlueprintImages(bp, f); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	fmt.Printf("Exported blueprint %s to %s. Load it with 'docker load -i %s'.\n", bp.Name, outPath, outPath)
+	return true
+}
+
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+var (
+	flagDir = flag.String("dir", os.Getenv("COMPLEMENT_BLUEPRINT_DIR"), "A directory of JSON/YAML blueprints to load, so they can be referred to by name. Defaults to COMPLEMENT_BLUEPRINT_DIR.")
+	flagPkg = flag.String("pkg", "fed", "For 'build', 'images', 'prune' and 'export': the package namespace of the images. This must match the tests which will use them e.g 'fed' for ./tests or 'csapi' for ./tests/csapi.")
+	flagAll = flag.Bool("all", false, "For 'images' and 'prune': include images from every package namespace. For 'prune', remove all images rather than only stale ones.")
+)
+
+const usage = `Usage: %s [flags] command args...
+
+Commands:
+  validate FILE|DIR...  Validate blueprint files, or every blueprint file in a directory.
+  instructions BLUEPRINT  Print the HTTP requests which would be made to build the blueprint.
+  build BLUEPRINT...      Build the blueprint images ahead of time, using COMPLEMENT_BASE_IMAGE.
+  images                  List built blueprint images, and whether they are stale.
+  prune                   Remove stale blueprint images, which will be rebuilt when next used.
+  export BLUEPRINT FILE   Save the images of a built blueprint and its parents to a tar file for 'docker load'.
+
+Images are stale if the blueprint definition or COMPLEMENT_BASE_IMAGE has changed since they were built.
+
+BLUEPRINT is either a blueprint file, or the name of a known blueprint or one in -dir.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *flagDir != "" {
+		if err := b.RegisterBlueprints(*flagDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load blueprints: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var ok bool
+	switch flag.Arg(0) {
+	case "validate":
+		ok = validate(flag.Args()[1:])
+	case "instructions":
+		ok = instructions(flag.Arg(1))
+	case "build":
+		ok = build(flag.Args()[1:])
+	case "images":
+		ok = images()
+	case "prune":
+		ok = prune()
+	case "export":
+		if flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		ok = export(flag.Arg(1), flag.Arg(2))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// validate loads each file or directory of blueprints and reports any problems with them.
+func validate(paths []string) bool {
+	ok := true
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("FAIL %s\n", err)
+			ok = false
+			continue
+		}
+		var blueprints []b.Blueprint
+		if info.IsDir() {
+			blueprints, err = b.LoadBlueprints(path)
+		} else {
+			var bp b.Blueprint
+			bp, err = b.LoadBlueprint(path)
+			blueprints = append(blueprints, bp)
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s\n", err)
+			ok = false
+			continue
+		}
+		for _, bp := range blueprints {
+			problems := lint(bp)
+			if len(problems) > 0 {
+				fmt.Printf("FAIL %s: blueprint '%s':\n", path, bp.Name)
+				for _, p := range problems {
+					fmt.Printf("    %s\n", p)
+				}
+				ok = false
+				continue
+			}
+			fmt.Printf("ok   %s: blueprint '%s' (%s)\n", path, bp.Name, summary(bp))
+		}
+	}
+	return ok
+}
+
+// lint finds problems in a valid blueprint which would only show up when building it.
+func lint(bp b.Blueprint) (problems []string) {
+	hsNames := make(map[string]bool)
+	for _, hs := range bp.Homeservers {
+		if hs.Name == "" {
+			problems = append(problems, "homeserver has no Name")
+		}
+		if hsNames[hs.Name] {
+			problems = append(problems, fmt.Sprintf("HS name '%s' is used more than once", hs.Name))
+		}
+		hsNames[hs.Name] = true
+	}
+	// check users and rooms including those in the parents, as they can be used by this blueprint
+	bp = b.Flatten(bp)
+	createdRefs := make(map[string]bool)
+	for _, hs := range bp.Homeservers {
+		for _, room := range hs.Rooms {
+			if room.Ref != "" && room.Creator != "" {
+				createdRefs[room.Ref] = true
+			}
+		}
+	}
+	for _, hs := range bp.Homeservers {
+		users := make(map[string]bool)
+		for _, u := range hs.Users {
+			users["@"+u.Localpart+":"+hs.Name] = true
+			if u.OneTimeKeys > 0 && u.DeviceID == nil {
+				problems = append(problems, fmt.Sprintf("HS %s user '%s' has OneTimeKeys but no DeviceID", hs.Name, u.Localpart))
+			}
+		}
+		for i, room := range hs.Rooms {
+			if room.Creator != "" && !users[room.Creator] {
+				problems = append(problems, fmt.Sprintf("HS %s room %d creator '%s' is not a user on %s", hs.Name, i, room.Creator, hs.Name))
+			}
+			if room.Creator == "" && !createdRefs[room.Ref] {
+				problems = append(problems, fmt.Sprintf("HS %s room %d joins Ref '%s' which no homeserver creates", hs.Name, i, room.Ref))
+			}
+			for j, ev := range room.Events {
+				if !users[ev.Sender] {
+					problems = append(problems, fmt.Sprintf("HS %s room %d event %d sender '%s' is not a user on %s", hs.Name, i, j, ev.Sender, hs.Name))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func summary(bp b.Blueprint) string {
+	var parent string
+	if bp.Parent != nil {
+		parent = ", extends " + bp.Parent.Name
+	}
+	bp = b.Flatten(bp)
+	var users, rooms int
+	for _, hs := range bp.Homeservers {
+		users += len(hs.Users)
+		rooms += len(hs.Rooms)
+	}
+	return fmt.Sprintf("%d homeservers, %d users, %d rooms%s", len(bp.Homeservers), users, rooms, parent)
+}
+
+// instructions prints the requests the instruction runner would make for each homeserver in the blueprint.
+func instructions(nameOrPath string) bool {
+	bp, err := resolve(nameOrPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	// parents are built first, and the blueprint is built on top of their images
+	for _, ancestor := range b.Lineage(bp) {
+		if ancestor.Parent != nil {
+			fmt.Printf("%s (starting from the images of %s):\n", ancestor.Name, ancestor.Parent.Name)
+		} else {
+			fmt.Printf("%s:\n", ancestor.Name)
+		}
+		runner := instruction.NewRunner(ancestor.Name, false, false)
+		for _, hs := range ancestor.Homeservers {
+			fmt.Printf("  %s:\n", hs.Name)
+			for _, line := range runner.Describe(hs) {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+	}
+	return true
+}
+
+// build constructs the images for each blueprint, so tests do not need to.
+func build(namesOrPaths []string) bool {
+	var blueprints []b.Blueprint
+	for _, nameOrPath := range namesOrPaths {
+		bp, err := resolve(nameOrPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return false
+		}
+		blueprints = append(blueprints, bp)
+	}
+	builder, err := newBuilder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return false
+	}
+	var names []string
+	for _, bp := range blueprints {
+		if err = builder.ConstructBlueprintIfNotExist(bp); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build blueprint '%s': %s\n", bp.Name, err)
+			return false
+		}
+		for _, hs := range b.Flatten(bp).Homeservers {
+			fmt.Printf("Built localhost/complement:%s.%s.%s\n", builder.Config.PackageNamespace, bp.Name, hs.Name)
+		}
+		// images of parents must be kept too, as the blueprint's images are built on top of them
+		for _, ancestor := range b.Lineage(bp) {
+			if !contains(names, ancestor.Name) {
+				names = append(names, ancestor.Name)
+			}
+		}
+	}
+	fmt.Printf("Run tests with COMPLEMENT_KEEP_BLUEPRINTS='%s' to use these images rather than cleaning them up.\n", strings.Join(names, " "))
+	return true
+}
+
+// resolve returns the blueprint in the file at `nameOrPath` if it exists, else the known blueprint with that name.
+func resolve(nameOrPath string) (b.Blueprint, error) {
+	if _, err := os.Stat(nameOrPath); err == nil {
+		return b.LoadBlueprint(nameOrPath)
+	}
+	bp, ok := b.KnownBlueprints[nameOrPath]
+	if !ok {
+		return b.Blueprint{}, fmt.Errorf("'%s' is not a file or the name of a known blueprint", nameOrPath)
+	}
+	return *bp, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, l := range list {
+		if l == item {
+			return true
+		}
+	}
+	return false
+}
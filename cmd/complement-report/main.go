@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/complement/internal/report"
+)
+
+var (
+	flagDir    = flag.String("dir", "", "Required. The COMPLEMENT_REPORT_DIR the tests wrote their reports to.")
+	flagEvents = flag.String("events", "", "The file containing the output of `go test -json`. Reads stdin if not set.")
+)
+
+func main() {
+	flag.Parse()
+	if *flagDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var events []byte
+	var err error
+	if *flagEvents == "" {
+		events, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		events, err = ioutil.ReadFile(*flagEvents)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read test events: %s\n", err)
+		os.Exit(1)
+	}
+	paths, err := filepath.Glob(filepath.Join(*flagDir, "complement-*.json"))
+	if err != nil || len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "No reports found in %s\n", *flagDir)
+		os.Exit(1)
+	}
+	for _, path := range paths {
+		r, err := report.ReadReporter(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read report: %s\n", err)
+			os.Exit(1)
+		}
+		if err = r.AddTestEvents(bytes.NewReader(events)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add test events to %s: %s\n", path, err)
+			os.Exit(1)
+		}
+		if err = r.WriteFiles(*flagDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write report: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Merged test events into %s: %d tests\n", path, len(r.Tests()))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/scenario"
+)
+
+var (
+	flagVerbose = flag.Bool("v", false, "Print the result of every step, not just failures.")
+	flagRun     = flag.String("run", "", "Only run scenarios whose name matches this regular expression.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] scenario.yaml|dir ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var runRegexp *regexp.Regexp
+	if *flagRun != "" {
+		var err error
+		runRegexp, err = regexp.Compile(*flagRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -run: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	cfg := config.NewConfigFromEnvVars("scenario", "")
+	if cfg.BlueprintDir != "" {
+		if err := b.RegisterBlueprints(cfg.BlueprintDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load blueprints: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	files, err := scenarioFiles(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find scenarios: %s\n", err)
+		os.Exit(1)
+	}
+	var scenarios []*scenario.Scenario
+	for _, file := range files {
+		s, err := scenario.Load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load scenario: %s\n", err)
+			os.Exit(1)
+		}
+		if runRegexp != nil && !runRegexp.MatchString(s.Name) {
+			continue
+		}
+		scenarios = append(scenarios, s)
+	}
+
+	builder, err := docker.NewBuilder(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create builder: %s\n", err)
+		os.Exit(1)
+	}
+	builder.Cleanup() // remove any previous runs
+	defer builder.Cleanup()
+
+	start := time.Now()
+	passed := true
+	for i, s := range scenarios {
+		if !runScenario(builder, fmt.Sprintf("%d", i), s) {
+			passed = false
+		}
+	}
+	if passed {
+		fmt.Println("PASS")
+		fmt.Printf("ok  \tcomplement-scenario\t%.3fs\n", time.Since(start).Seconds())
+		return
+	}
+	fmt.Println("FAIL")
+	fmt.Printf("FAIL\tcomplement-scenario\t%.3fs\n", time.Since(start).Seconds())
+	builder.Cleanup()
+	os.Exit(1)
+}
+
+// runScenario deploys the blueprint for the scenario and runs it, returning true if it passed.
+func runScenario(builder *docker.Builder, namespace string, s *scenario.Scenario) bool {
+	var out io.Writer
+	if *flagVerbose {
+		out = os.Stdout
+	}
+	name := strings.Replace(s.Name, " ", "_", -1)
+	if err := builder.ConstructBlueprintIfNotExist(s.Blueprint.Blueprint); err != nil {
+		fmt.Printf("--- FAIL: %s\n    Failed to construct blueprint: %s\n", name, err)
+		return false
+	}
+	deployer, err := docker.NewDeployer("scenario"+namespace, builder.Config)
+	if err != nil {
+		fmt.Printf("--- FAIL: %s\n    NewDeployer returned error %s\n", name, err)
+		return false
+	}
+	dep, err := deployer.Deploy(context.Background(), s.Blueprint.Name)
+	if err != nil {
+		fmt.Printf("--- FAIL: %s\n    Deploy returned error %s\n", name, err)
+		return false
+	}
+	res := s.Run(dep, out)
+	res.Print(os.Stdout, *flagVerbose)
+	deployer.Destroy(dep, !res.Passed)
+	return res.Passed
+}
+
+// scenarioFiles expands directories in `paths` into the YAML and JSON files they contain.
+func scenarioFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Keys whose values are allocated by the homeserver, so will differ between the recorded and replayed responses.
+var learnKeys = map[string]bool{
+	"access_token": true,
+	"device_id":    true,
+	"next_batch":   true,
+	"prev_batch":   true,
+	"start":        true,
+	"end":          true,
+	"filter_id":    true,
+	"content_uri":  true,
+	"sid":          true,
+	"session":      true,
+}
+
+// substitutions maps values in the recording to the equivalent values from the replay, e.g room IDs.
+type substitutions struct {
+	oldToNew map[string]string
+}
+
+func newSubstitutions() *substitutions {
+	return &substitutions{
+		oldToNew: make(map[string]string),
+	}
+}
+
+func (s *substitutions) add(oldVal, newVal string) {
+	if oldVal == "" || newVal == "" || oldVal == newVal {
+		return
+	}
+	s.oldToNew[oldVal] = newVal
+}
+
+// apply replaces all known recorded values in the input, including URL escaped forms. Longer values are
+// replaced first so a value which is a prefix of another does not clobber it.
+func (s *substitutions) apply(input string) string {
+	olds := make([]string, 0, len(s.oldToNew))
+	for old := range s.oldToNew {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool {
+		return len(olds[i]) > len(olds[j])
+	})
+	for _, old := range olds {
+		input = strings.Replace(input, old, s.oldToNew[old], -1)
+		if escaped := url.PathEscape(old); escaped != old {
+			input = strings.Replace(input, escaped, url.PathEscape(s.oldToNew[old]), -1)
+		}
+	}
+	return input
+}
+
+// learn walks the recorded and replayed responses together, and adds a substitution for every homeserver
+// allocated value which differs, e.g room IDs, event IDs and sync tokens.
+func (s *substitutions) learn(recorded, replayed gjson.Result) {
+	if recorded.IsObject() && replayed.IsObject() {
+		replayedMap := replayed.Map()
+		for key, val := range recorded.Map() {
+			other := replayedMap[key]
+			if val.Type == gjson.String && other.Type == gjson.String {
+				if learnKeys[key] || isMatrixID(val.Str) {
+					s.add(val.Str, other.Str)
+				}
+				continue
+			}
+			s.learn(val, other)
+		}
+		return
+	}
+	if recorded.IsArray() && replayed.IsArray() {
+		recordedArr := recorded.Array()
+		replayedArr := replayed.Array()
+		for i := 0; i < len(recordedArr) && i < len(replayedArr); i++ {
+			if recordedArr[i].Type == gjson.String && replayedArr[i].Type == gjson.String {
+				if isMatrixID(recordedArr[i].Str) {
+					s.add(recordedArr[i].Str, replayedArr[i].Str)
+				}
+				continue
+			}
+			s.learn(recordedArr[i], replayedArr[i])
+		}
+	}
+}
+
+// isMatrixID returns true for room and event IDs, which are allocated by the homeserver.
+func isMatrixID(val string) bool {
+	return strings.HasPrefix(val, "!") || strings.HasPrefix(val, "$")
+}
+
+// diffJSON returns a human readable list of differences between two JSON values, skipping ignored keys.
+func diffJSON(path string, recorded, replayed gjson.Result, ignore map[string]bool) (diffs []string) {
+	if recorded.IsObject() && replayed.IsObject() {
+		recordedMap := recorded.Map()
+		replayedMap := replayed.Map()
+		keys := make(map[string]bool)
+		for key := range recordedMap {
+			keys[key] = true
+		}
+		for key := range replayedMap {
+			keys[key] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			if !ignore[key] {
+				sortedKeys = append(sortedKeys, key)
+			}
+		}
+		sort.Strings(sortedKeys)
+		for _, key := range sortedKeys {
+			diffs = append(diffs, diffJSON(path+"."+key, recordedMap[key], replayedMap[key], ignore)...)
+		}
+		return diffs
+	}
+	if recorded.IsArray() && replayed.IsArray() {
+		recordedArr := recorded.Array()
+		replayedArr := replayed.Array()
+		if len(recordedArr) != len(replayedArr) {
+			return []string{fmt.Sprintf("%s: recorded %d elements, replayed %d elements", pathOrRoot(path), len(recordedArr), len(replayedArr))}
+		}
+		for i := range recordedArr {
+			diffs = append(diffs, diffJSON(fmt.Sprintf("%s[%d]", path, i), recordedArr[i], replayedArr[i], ignore)...)
+		}
+		return diffs
+	}
+	if !recorded.Exists() {
+		return []string{fmt.Sprintf("%s: missing in recording, replayed %s", pathOrRoot(path), replayed.Raw)}
+	}
+	if !replayed.Exists() {
+		return []string{fmt.Sprintf("%s: recorded %s, missing in replay", pathOrRoot(path), recorded.Raw)}
+	}
+	if !equalScalars(recorded, replayed) {
+		return []string{fmt.Sprintf("%s: recorded %s, replayed %s", pathOrRoot(path), recorded.Raw, replayed.Raw)}
+	}
+	return nil
+}
+
+// equalScalars compares two JSON values which are not both objects or both arrays.
+func equalScalars(a, b gjson.Result) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case gjson.Number:
+		return a.Num == b.Num
+	case gjson.String:
+		return a.Str == b.Str
+	default:
+		return a.Raw == b.Raw
+	}
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
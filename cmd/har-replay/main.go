@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/har"
+)
+
+type hsURLs map[string]string
+
+func (h hsURLs) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h hsURLs) Set(val string) error {
+	segments := strings.SplitN(val, "=", 2)
+	if len(segments) != 2 {
+		return fmt.Errorf("expected hs_name=base_url, got %s", val)
+	}
+	h[segments[0]] = strings.TrimSuffix(segments[1], "/")
+	return nil
+}
+
+var (
+	flagHAR    = flag.String("har", "", "Required. The HAR file recorded by Complement to replay.")
+	flagIgnore = flag.String("ignore", "origin_server_ts,age,unsigned,next_batch,prev_batch,start,end,expires_in_ms", "Comma separated JSON keys to ignore when diffing responses.")
+	flagHS     = hsURLs{}
+)
+
+func main() {
+	flag.Var(flagHS, "hs", "Required. The base URL of the homeserver to replay requests for a HS name against e.g 'hs1=http://localhost:8008'. Can be repeated.")
+	flag.Parse()
+	if *flagHAR == "" || len(flagHS) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	h, err := har.ReadFile(*flagHAR)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read HAR: %s\n", err)
+		os.Exit(1)
+	}
+	ignore := make(map[string]bool)
+	for _, key := range strings.Split(*flagIgnore, ",") {
+		ignore[strings.TrimSpace(key)] = true
+	}
+	r := &replayer{
+		hsURLs: flagHS,
+		subs:   newSubstitutions(),
+		ignore: ignore,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+	if err = r.loginUsers(h.Log); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up users from blueprint %s: %s\n", h.Log.Blueprint, err)
+		os.Exit(1)
+	}
+	numDiffs := 0
+	numReplayed := 0
+	for i, entry := range h.Log.Entries {
+		if entry.Kind != har.KindCSAPI || entry.Error != "" {
+			// federation requests are signed by servers which no longer exist, so they cannot be replayed
+			continue
+		}
+		numReplayed++
+		diffs, err := r.replay(entry)
+		path := entry.Request.URL
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+		if err != nil {
+			numDiffs++
+			fmt.Printf("[%d] %s %s%s => ERROR: %s\n", i, entry.Request.Method, entry.HSName, path, err)
+			continue
+		}
+		if len(diffs) == 0 {
+			fmt.Printf("[%d] %s %s%s => OK\n", i, entry.Request.Method, entry.HSName, path)
+			continue
+		}
+		numDiffs++
+		fmt.Printf("[%d] %s %s%s => DIFF\n", i, entry.Request.Method, entry.HSName, path)
+		for _, d := range diffs {
+			fmt.Printf("    %s\n", d)
+		}
+	}
+	fmt.Printf("Replayed %d requests, %d differed\n", numReplayed, numDiffs)
+	if numDiffs > 0 {
+		os.Exit(1)
+	}
+}
+
+type replayer struct {
+	hsURLs hsURLs
+	subs   *substitutions
+	ignore map[string]bool
+	client *http.Client
+}
+
+// loginUsers logs in as every user in the blueprint on the target homeservers, registering them if they do not
+// exist. Complement registers blueprint users with a deterministic password, so this works for homeservers
+// deployed from the same blueprint as well as empty ones.
+func (r *replayer) loginUsers(log har.Log) error {
+	for userID, hsName := range log.Users {
+		baseURL, ok := r.hsURLs[hsName]
+		if !ok {
+			return fmt.Errorf("no -hs given for %s", hsName)
+		}
+		localpart := strings.TrimPrefix(strings.Split(userID, ":")[0], "@")
+		password := "complement_meets_min_pasword_req_" + localpart
+		res, body, err := r.do("POST", baseURL+"/_matrix/client/v3/login", "", map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": localpart,
+			},
+			"password": password,
+		})
+		if err == nil && res.StatusCode != 200 {
+			res, body, err = r.do("POST", baseURL+"/_matrix/client/v3/register", "", map[string]interface{}{
+				"username": localpart,
+				"password": password,
+				"auth": map[string]interface{}{
+					"type": "m.login.dummy",
+				},
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", userID, err)
+		}
+		if res.StatusCode != 200 {
+			return fmt.Errorf("%s: failed to login or register: HTTP %d %s", userID, res.StatusCode, string(body))
+		}
+		r.subs.add(log.AccessTokens[userID], gjson.GetBytes(body, "access_token").Str)
+	}
+	return nil
+}
+
+// replay makes the request in the entry against the target homeserver and returns how the response differs
+// from the recorded response.
+func (r *replayer) replay(entry har.Entry) ([]string, error) {
+	baseURL, ok := r.hsURLs[entry.HSName]
+	if !ok {
+		return nil, fmt.Errorf("no -hs given for %s", entry.HSName)
+	}
+	recordedURL, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("bad recorded URL: %w", err)
+	}
+	target := baseURL + r.subs.apply(recordedURL.EscapedPath())
+	if recordedURL.RawQuery != "" {
+		target += "?" + r.subs.apply(recordedURL.RawQuery)
+	}
+	var body []byte
+	if entry.Request.PostData != nil {
+		body = []byte(r.subs.apply(entry.Request.PostData.Text))
+	}
+	req, err := http.NewRequest(entry.Request.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range entry.Request.Headers {
+		if h.Name == "Authorization" || h.Name == "Content-Type" {
+			req.Header.Set(h.Name, r.subs.apply(h.Value))
+		}
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	recordedBody := []byte(entry.Response.Content.Text)
+	// learn the new IDs before diffing so they are substituted in the recorded response
+	r.subs.learn(gjson.ParseBytes(recordedBody), gjson.ParseBytes(resBody))
+
+	var diffs []string
+	if res.StatusCode != entry.Response.Status {
+		diffs = append(diffs, fmt.Sprintf("status: recorded %d, replayed %d", entry.Response.Status, res.StatusCode))
+	}
+	recordedBody = []byte(r.subs.apply(string(recordedBody)))
+	if gjson.ValidBytes(recordedBody) && gjson.ValidBytes(resBody) {
+		diffs = append(diffs, diffJSON("", gjson.ParseBytes(recordedBody), gjson.ParseBytes(resBody), r.ignore)...)
+	} else if !bytes.Equal(recordedBody, resBody) {
+		diffs = append(diffs, fmt.Sprintf("body: recorded %q, replayed %q", recordedBody, resBody))
+	}
+	return diffs, nil
+}
+
+func (r *replayer) do(method, url, accessToken string, body interface{}) (*http.Response, []byte, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	return res, resBody, err
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
 	"github.com/sirupsen/logrus"
@@ -22,6 +23,7 @@ type Config struct {
 	SpawnHSTimeout         time.Duration
 	KeepBlueprints         []string
 	Snapshot               string
+	BlueprintDir           string
 }
 
 func (c *Config) DeriveComplementConfig(baseImageURI string) *config.Complement {
@@ -39,6 +41,7 @@ func NewConfig() *Config {
 		SpawnHSTimeout:         5 * time.Second,
 		KeepBlueprints:         strings.Split(os.Getenv("HOMERUNNER_KEEP_BLUEPRINTS"), " "),
 		Snapshot:               os.Getenv("HOMERUNNER_SNAPSHOT_BLUEPRINT"),
+		BlueprintDir:           os.Getenv("HOMERUNNER_BLUEPRINT_DIR"),
 	}
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_LIFETIME_MINS")); val != 0 {
 		cfg.HomeserverLifetimeMins = val
@@ -68,6 +71,11 @@ func main() {
 		logrus.Fatalf("failed to setup new runtime: %s", err)
 	}
 	cleanup(cfg)
+	if cfg.BlueprintDir != "" {
+		if err := b.RegisterBlueprints(cfg.BlueprintDir); err != nil {
+			logrus.Fatalf("failed to load blueprints: %s", err)
+		}
+	}
 
 	if cfg.Snapshot != "" {
 		logrus.Infof("Running in single-shot snapshot mode for request file '%s'", cfg.Snapshot)
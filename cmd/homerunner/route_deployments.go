@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/complement/homerunnerclient"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+type (
+	ResDeployments = homerunnerclient.ResDeployments
+	ReqExtend      = homerunnerclient.ReqExtend
+	ResExtend      = homerunnerclient.ResExtend
+)
+
+type ResDeployment struct {
+	BlueprintName string                                  `json:"blueprint_name"`
+	Homeservers   map[string]*docker.HomeserverDeployment `json:"homeservers"`
+	Expires       time.Time                               `json:"expires"`
+}
+
+// RouteDeployments lists the blueprint names of all running deployments.
+func RouteDeployments(ctx context.Context, rt *Runtime) util.JSONResponse {
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResDeployments{
+			Deployments: rt.DeploymentNames(),
+		},
+	}
+}
+
+// RouteDeployment returns the homeservers of a running deployment.
+func RouteDeployment(ctx context.Context, rt *Runtime, blueprintName string) util.JSONResponse {
+	dep, expires, err := rt.GetDeployment(blueprintName)
+	if err != nil {
+		return util.MessageResponse(404, err.Error())
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResDeployment{
+			BlueprintName: blueprintName,
+			Homeservers:   dep.HS,
+			Expires:       expires,
+		},
+	}
+}
+
+// RouteExtend pushes back the expiry time of a running deployment.
+func RouteExtend(ctx context.Context, rt *Runtime, blueprintName string, rc *ReqExtend) util.JSONResponse {
+	if rc.LifetimeMins < 0 {
+		return util.MessageResponse(400, "lifetime_mins must not be negative")
+	}
+	lifetimeMins := rc.LifetimeMins
+	if lifetimeMins == 0 {
+		lifetimeMins = rt.Config.HomeserverLifetimeMins
+	}
+	expires, err := rt.ExtendDeployment(blueprintName, time.Duration(lifetimeMins)*time.Minute)
+	if err != nil {
+		return util.MessageResponse(404, err.Error())
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResExtend{
+			Expires: expires,
+		},
+	}
+}
+
+// RouteHomeserver performs `action` (one of restart, stop or start) on a single homeserver in a running
+// deployment, returning the homeserver as its ports may have changed.
+func RouteHomeserver(ctx context.Context, rt *Runtime, blueprintName, hsName, action string) util.JSONResponse {
+	dep, hsDep, err := lookupHomeserver(rt, blueprintName, hsName)
+	if err != nil {
+		return util.MessageResponse(404, err.Error())
+	}
+	switch action {
+	case "restart":
+		err = dep.Deployer.Restart(hsDep, dep.Config)
+	case "stop":
+		err = dep.Deployer.Stop(hsDep, dep.Config)
+	case "start":
+		err = dep.Deployer.Start(hsDep, dep.Config)
+	default:
+		return util.MessageResponse(404, fmt.Sprintf("unknown action '%s'", action))
+	}
+	if err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to %s homeserver: %s", action, err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: hsDep,
+	}
+}
+
+// RouteLogs writes the container logs of a single homeserver in a running deployment as plain text.
+func RouteLogs(res http.ResponseWriter, rt *Runtime, blueprintName, hsName string) {
+	dep, hsDep, err := lookupHomeserver(rt, blueprintName, hsName)
+	if err != nil {
+		http.Error(res, err.Error(), 404)
+		return
+	}
+	logs, err := dep.Deployer.Logs(hsDep)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("failed to get logs: %s", err), 500)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(200)
+	res.Write([]byte(logs))
+}
+
+// lookupHomeserver finds the named homeserver in a running deployment.
+func lookupHomeserver(rt *Runtime, blueprintName, hsName string) (*docker.Deployment, *docker.HomeserverDeployment, error) {
+	dep, _, err := rt.GetDeployment(blueprintName)
+	if err != nil {
+		return nil, nil, err
+	}
+	hsDep, ok := dep.HS[hsName]
+	if !ok {
+		return nil, nil, fmt.Errorf("no homeserver with name '%s' in deployment '%s'", hsName, blueprintName)
+	}
+	return dep, hsDep, nil
+}
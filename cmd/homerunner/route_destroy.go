@@ -4,15 +4,15 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/matrix-org/complement/homerunnerclient"
+
 	"github.com/matrix-org/util"
 )
 
-type ReqDestroy struct {
-	BlueprintName string `json:"blueprint_name"`
-}
-
-type ResDestroy struct {
-}
+type (
+	ReqDestroy = homerunnerclient.ReqDestroy
+	ResDestroy = homerunnerclient.ResDestroy
+)
 
 func RouteDestroy(ctx context.Context, rt *Runtime, rc *ReqDestroy) util.JSONResponse {
 	if rc.BlueprintName == "" {
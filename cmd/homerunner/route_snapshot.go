@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/complement/homerunnerclient"
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/util"
+)
+
+type (
+	ReqSnapshot = homerunnerclient.ReqSnapshot
+	ResSnapshot = homerunnerclient.ResSnapshot
+)
+
+// RouteSnapshot handles committing a running deployment into images for a new blueprint. The deployment is
+// destroyed afterwards.
+func RouteSnapshot(ctx context.Context, rt *Runtime, rc *ReqSnapshot) util.JSONResponse {
+	if rc.BlueprintName == "" {
+		return util.MessageResponse(400, "missing blueprint name")
+	}
+	if rc.SnapshotName == "" {
+		return util.MessageResponse(400, "missing snapshot name")
+	}
+	if _, ok := b.KnownBlueprints[rc.SnapshotName]; ok {
+		return util.MessageResponse(400, fmt.Sprintf("snapshot name '%s' is already used by a static blueprint", rc.SnapshotName))
+	}
+	if err := rt.SnapshotDeployment(rc.BlueprintName, rc.SnapshotName); err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to snapshot deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResSnapshot{
+			BlueprintName: rc.SnapshotName,
+		},
+	}
+}
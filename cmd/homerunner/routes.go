@@ -9,8 +9,8 @@ import (
 )
 
 func Routes(rt *Runtime, cfg *Config) http.Handler {
-	mux := mux.NewRouter()
-	mux.Path("/create").Methods("POST").HandlerFunc(
+	router := mux.NewRouter()
+	router.Path("/create").Methods("POST").HandlerFunc(
 		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqCreate{}
@@ -21,7 +21,7 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 			},
 		))),
 	)
-	mux.Path("/destroy").Methods("POST").HandlerFunc(
+	router.Path("/destroy").Methods("POST").HandlerFunc(
 		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqDestroy{}
@@ -32,10 +32,63 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 			},
 		))),
 	)
-	mux.Path("/health").Methods("GET").HandlerFunc(
+	router.Path("/snapshot").Methods("POST").HandlerFunc(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqSnapshot{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteSnapshot(req.Context(), rt, &rc)
+			},
+		))),
+	)
+	router.Path("/deployments").Methods("GET").HandlerFunc(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				return RouteDeployments(req.Context(), rt)
+			},
+		))),
+	)
+	router.Path("/deployments/{name}").Methods("GET").HandlerFunc(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				return RouteDeployment(req.Context(), rt, mux.Vars(req)["name"])
+			},
+		))),
+	)
+	router.Path("/deployments/{name}/extend").Methods("POST").HandlerFunc(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqExtend{}
+				// the body is optional
+				if req.ContentLength != 0 {
+					if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+						return util.MessageResponse(400, "request body not JSON")
+					}
+				}
+				return RouteExtend(req.Context(), rt, mux.Vars(req)["name"], &rc)
+			},
+		))),
+	)
+	router.Path("/deployments/{name}/homeservers/{hs}/{action:restart|stop|start}").Methods("POST").HandlerFunc(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				vars := mux.Vars(req)
+				return RouteHomeserver(req.Context(), rt, vars["name"], vars["hs"], vars["action"])
+			},
+		))),
+	)
+	router.Path("/deployments/{name}/homeservers/{hs}/logs").Methods("GET").HandlerFunc(
+		util.WithCORSOptions(func(res http.ResponseWriter, req *http.Request) {
+			vars := mux.Vars(req)
+			RouteLogs(res, rt, vars["name"], vars["hs"])
+		}),
+	)
+	router.Path("/health").Methods("GET").HandlerFunc(
 		func(res http.ResponseWriter, req *http.Request) {
 			res.WriteHeader(200)
 		},
 	)
-	return mux
+	return router
 }
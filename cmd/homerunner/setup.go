@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,6 +17,7 @@ type Runtime struct {
 	mu                    *sync.Mutex
 	BlueprintToDeployment map[string]*docker.Deployment
 	BlueprintToTimer      map[string]*time.Timer
+	BlueprintToExpiry     map[string]time.Time
 }
 
 // NewRuntime makes a homerunner runtime
@@ -24,6 +26,7 @@ func NewRuntime(cfg *Config) (*Runtime, error) {
 		Config:                cfg,
 		BlueprintToDeployment: make(map[string]*docker.Deployment),
 		BlueprintToTimer:      make(map[string]*time.Timer),
+		BlueprintToExpiry:     make(map[string]time.Time),
 		mu:                    &sync.Mutex{},
 	}, nil
 }
@@ -64,6 +67,7 @@ func (r *Runtime) addDeployment(blueprintName string, d *docker.Deployment, dura
 		return fmt.Errorf("deployment with name %s already exists", blueprintName)
 	}
 	r.BlueprintToDeployment[blueprintName] = d
+	r.BlueprintToExpiry[blueprintName] = time.Now().Add(duration)
 	r.BlueprintToTimer[blueprintName] = time.AfterFunc(duration, func() {
 		logrus.Infof("Blueprint '%s' has expired. Tearing down network.", blueprintName)
 		err := r.DestroyDeployment(blueprintName)
@@ -86,5 +90,81 @@ func (r *Runtime) DestroyDeployment(blueprintName string) error {
 	timer := r.BlueprintToTimer[blueprintName]
 	timer.Stop()
 	delete(r.BlueprintToTimer, blueprintName)
+	delete(r.BlueprintToExpiry, blueprintName)
 	return nil
 }
+
+// SnapshotDeployment commits the homeservers of a running deployment as images of a new blueprint, then destroys
+// the deployment as its homeservers have been stopped. If the snapshot fails the deployment is kept.
+func (r *Runtime) SnapshotDeployment(blueprintName, snapshotName string) error {
+	r.mu.Lock()
+	d, ok := r.BlueprintToDeployment[blueprintName]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	// the lock isn't held while snapshotting, so stop the deployment expiring part way through
+	timer := r.BlueprintToTimer[blueprintName]
+	if !timer.Stop() {
+		r.mu.Unlock()
+		return fmt.Errorf("deployment with name '%s' has expired", blueprintName)
+	}
+	expires := r.BlueprintToExpiry[blueprintName]
+	r.mu.Unlock()
+
+	if err := d.Deployer.Snapshot(d, snapshotName); err != nil {
+		// leave the deployment so homeservers which were stopped can be started again
+		r.mu.Lock()
+		if r.BlueprintToTimer[blueprintName] == timer {
+			timer.Reset(time.Until(expires))
+		}
+		r.mu.Unlock()
+		return err
+	}
+	if err := r.DestroyDeployment(blueprintName); err != nil {
+		// the deployment was destroyed while snapshotting, which doesn't affect the snapshot
+		logrus.WithError(err).Warn("SnapshotDeployment: failed to destroy deployment")
+	}
+	return nil
+}
+
+// DeploymentNames returns the blueprint names of all running deployments, sorted.
+func (r *Runtime) DeploymentNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.BlueprintToDeployment))
+	for name := range r.BlueprintToDeployment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetDeployment returns the running deployment for the blueprint and when it expires.
+func (r *Runtime) GetDeployment(blueprintName string) (*docker.Deployment, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.BlueprintToDeployment[blueprintName]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	return d, r.BlueprintToExpiry[blueprintName], nil
+}
+
+// ExtendDeployment changes the expiry of the deployment to `duration` from now, returning the new expiry time.
+func (r *Runtime) ExtendDeployment(blueprintName string, duration time.Duration) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timer, ok := r.BlueprintToTimer[blueprintName]
+	if !ok {
+		return time.Time{}, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	if !timer.Stop() {
+		// the timer has fired and is waiting for the lock to destroy the deployment
+		return time.Time{}, fmt.Errorf("deployment with name '%s' has expired", blueprintName)
+	}
+	timer.Reset(duration)
+	expires := time.Now().Add(duration)
+	r.BlueprintToExpiry[blueprintName] = expires
+	return expires, nil
+}
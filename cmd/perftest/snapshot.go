@@ -26,7 +26,7 @@ type Snapshot struct {
 
 func snapshotStats(spanName, desc string, deployment *docker.Deployment, absDuration, duration time.Duration) (snapshots []Snapshot) {
 	for hsName, hsInfo := range deployment.HS {
-		stats, err := deployment.Deployer.Docker.ContainerStatsOneShot(context.Background(), hsInfo.ContainerID)
+		stats, err := deployment.Deployer.Runtime.ContainerStatsOneShot(context.Background(), hsInfo.ContainerID)
 		if err != nil {
 			return nil
 		}
@@ -0,0 +1,180 @@
+// Package homerunnerclient is a client for the Homerunner HTTP API, which deploys ephemeral homeservers in
+// Docker. See cmd/homerunner for how to run Homerunner.
+//
+// A typical use is:
+//   hr := homerunnerclient.New("")
+//   dep, err := hr.Create(ctx, homerunnerclient.ReqCreate{
+//       BaseImageURI:  "complement-dendrite",
+//       BlueprintName: "one_to_one_room",
+//   })
+//   if err != nil { ... }
+//   defer dep.Close()
+//   alice, err := dep.Client("hs1", "@alice:hs1")
+//   res, err := alice.Get(alice.URL("_matrix", "client", "v3", "account", "whoami"))
+package homerunnerclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the URL Homerunner listens on when HOMERUNNER_PORT is not set.
+const DefaultBaseURL = "http://localhost:54321"
+
+// Error is returned when Homerunner responds with a non-2xx status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("homerunner responded with HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// Client talks to a Homerunner server.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// New makes a client for the Homerunner server at baseURL, or DefaultBaseURL if it is empty.
+func New(baseURL string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		// deployments can take a while to make if blueprint images need to be built
+		HTTPClient: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// Create deploys a blueprint. Close the returned Deployment to destroy it.
+func (c *Client) Create(ctx context.Context, req ReqCreate) (*Deployment, error) {
+	blueprintName := req.BlueprintName
+	if len(req.Blueprint) > 0 {
+		// Homerunner names deployments of in-line blueprints after the blueprint
+		var bprint struct {
+			Name string
+		}
+		if err := json.Unmarshal(req.Blueprint, &bprint); err != nil {
+			return nil, fmt.Errorf("Create: blueprint is not valid JSON: %w", err)
+		}
+		blueprintName = bprint.Name
+	}
+	var res ResCreate
+	if err := c.do(ctx, "POST", "/create", req, &res); err != nil {
+		return nil, fmt.Errorf("Create: %w", err)
+	}
+	return &Deployment{
+		BlueprintName: blueprintName,
+		Homeservers:   res.Homeservers,
+		Expires:       res.Expires,
+		client:        c,
+	}, nil
+}
+
+// Destroy the deployment of the blueprint.
+func (c *Client) Destroy(ctx context.Context, blueprintName string) error {
+	if err := c.do(ctx, "POST", "/destroy", ReqDestroy{BlueprintName: blueprintName}, &ResDestroy{}); err != nil {
+		return fmt.Errorf("Destroy: %w", err)
+	}
+	return nil
+}
+
+// Deployments returns the blueprint names of all running deployments.
+func (c *Client) Deployments(ctx context.Context) ([]string, error) {
+	var res ResDeployments
+	if err := c.do(ctx, "GET", "/deployments", nil, &res); err != nil {
+		return nil, fmt.Errorf("Deployments: %w", err)
+	}
+	return res.Deployments, nil
+}
+
+// Deployment returns a running deployment, e.g one created by another process. Closing it will destroy it.
+func (c *Client) Deployment(ctx context.Context, blueprintName string) (*Deployment, error) {
+	var res ResDeployment
+	if err := c.do(ctx, "GET", "/deployments/"+url.PathEscape(blueprintName), nil, &res); err != nil {
+		return nil, fmt.Errorf("Deployment: %w", err)
+	}
+	return &Deployment{
+		BlueprintName: res.BlueprintName,
+		Homeservers:   res.Homeservers,
+		Expires:       res.Expires,
+		client:        c,
+	}, nil
+}
+
+// Snapshot commits a running deployment into images for a new blueprint, which can then be deployed with
+// Create by setting BlueprintName to snapshotName. The deployment is destroyed.
+func (c *Client) Snapshot(ctx context.Context, blueprintName, snapshotName string) error {
+	req := ReqSnapshot{
+		BlueprintName: blueprintName,
+		SnapshotName:  snapshotName,
+	}
+	if err := c.do(ctx, "POST", "/snapshot", req, &ResSnapshot{}); err != nil {
+		return fmt.Errorf("Snapshot: %w", err)
+	}
+	return nil
+}
+
+// do sends reqBody as JSON, if it isn't nil, and decodes the JSON response into resBody.
+func (c *Client) do(ctx context.Context, method, path string, reqBody, resBody interface{}) error {
+	res, err := c.send(ctx, method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(resBody); err != nil {
+		return fmt.Errorf("failed to decode response from %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// send makes a request to Homerunner, returning an *Error for non-2xx responses.
+func (c *Client) send(ctx context.Context, method, path string, reqBody interface{}) (*http.Response, error) {
+	var body io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		// JSON errors are of the form {"message":"..."}, logs errors are plain text
+		var jsonErr struct {
+			Message string `json:"message"`
+		}
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &jsonErr) == nil && jsonErr.Message != "" {
+			msg = jsonErr.Message
+		}
+		return nil, &Error{
+			StatusCode: res.StatusCode,
+			Message:    msg,
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,146 @@
+package homerunnerclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeployment(t *testing.T) {
+	ctx := context.Background()
+	expires := time.Date(2021, 3, 9, 18, 2, 37, 0, time.UTC)
+	var hsSrv *httptest.Server
+	hsSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer alice_token" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"path": req.URL.EscapedPath()})
+	}))
+	defer hsSrv.Close()
+	destroyed := false
+	hrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.EscapedPath() {
+		case "POST /create":
+			var rc ReqCreate
+			if err := json.NewDecoder(req.Body).Decode(&rc); err != nil || rc.BlueprintName != "one_to_one_room" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"message":"bad request"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(ResCreate{
+				Homeservers: map[string]*HomeserverDeployment{
+					"hs1": {
+						BaseURL:      "http://wrong",
+						AccessTokens: map[string]string{"@alice:hs1": "alice_token"},
+						DeviceIDs:    map[string]string{"@alice:hs1": "ALICE"},
+					},
+				},
+				Expires: expires,
+			})
+		case "POST /deployments/one_to_one_room/homeservers/hs1/restart":
+			json.NewEncoder(w).Encode(HomeserverDeployment{
+				BaseURL:      hsSrv.URL,
+				AccessTokens: map[string]string{"@alice:hs1": "alice_token"},
+			})
+		case "POST /deployments/one_to_one_room/extend":
+			var rc ReqExtend
+			json.NewDecoder(req.Body).Decode(&rc)
+			json.NewEncoder(w).Encode(ResExtend{
+				Expires: expires.Add(time.Duration(rc.LifetimeMins) * time.Minute),
+			})
+		case "GET /deployments/one_to_one_room/homeservers/hs1/logs":
+			w.Write([]byte("some logs"))
+		case "GET /deployments/one_to_one_room/homeservers/hs2/logs":
+			http.Error(w, "no homeserver with name 'hs2'", 404)
+		case "POST /destroy":
+			destroyed = true
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"message":"not found"}`))
+		}
+	}))
+	defer hrSrv.Close()
+
+	hr := New(hrSrv.URL)
+	if _, err := hr.Create(ctx, ReqCreate{BlueprintName: "unknown"}); err == nil {
+		t.Fatalf("Create: expected an error for an unknown blueprint")
+	} else {
+		var hrErr *Error
+		if !errors.As(err, &hrErr) || hrErr.StatusCode != 400 || hrErr.Message != "bad request" {
+			t.Fatalf("Create: got error %v, want a 400 *Error", err)
+		}
+	}
+
+	dep, err := hr.Create(ctx, ReqCreate{BaseImageURI: "complement-dendrite", BlueprintName: "one_to_one_room"})
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if !dep.Expires.Equal(expires) {
+		t.Errorf("Create: got expires %v want %v", dep.Expires, expires)
+	}
+	alice, err := dep.Client("hs1", "@alice:hs1")
+	if err != nil {
+		t.Fatalf("Client: %s", err)
+	}
+	if alice.DeviceID != "ALICE" {
+		t.Errorf("Client: got device ID %s want ALICE", alice.DeviceID)
+	}
+	if _, err = dep.Client("hs1", "@bob:hs1"); err == nil {
+		t.Errorf("Client: expected an error for an unknown user")
+	}
+
+	// the client should use the new base URL after a restart
+	if err = dep.Restart(ctx, "hs1"); err != nil {
+		t.Fatalf("Restart: %s", err)
+	}
+	res, err := alice.Get(alice.URL("_matrix", "client", "v3", "rooms", "!room:hs1", "state"))
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	var body struct {
+		Path string `json:"path"`
+	}
+	json.NewDecoder(res.Body).Decode(&body)
+	res.Body.Close()
+	if res.StatusCode != 200 || body.Path != "/_matrix/client/v3/rooms/%21room:hs1/state" {
+		t.Errorf("Get: got HTTP %d for path %s", res.StatusCode, body.Path)
+	}
+
+	if err = dep.Extend(ctx, time.Hour); err != nil {
+		t.Fatalf("Extend: %s", err)
+	}
+	if want := expires.Add(time.Hour); !dep.Expires.Equal(want) {
+		t.Errorf("Extend: got expires %v want %v", dep.Expires, want)
+	}
+	// lifetimes are rounded up to the minute rather than becoming the default lifetime
+	if err = dep.Extend(ctx, 30*time.Second); err != nil {
+		t.Fatalf("Extend: %s", err)
+	}
+	if want := expires.Add(time.Minute); !dep.Expires.Equal(want) {
+		t.Errorf("Extend: got expires %v want %v", dep.Expires, want)
+	}
+	if err = dep.Extend(ctx, -time.Minute); err == nil {
+		t.Errorf("Extend: expected an error for a negative lifetime")
+	}
+
+	logs, err := dep.Logs(ctx, "hs1")
+	if err != nil || logs != "some logs" {
+		t.Errorf("Logs: got %q, %v", logs, err)
+	}
+	if _, err = dep.Logs(ctx, "hs2"); err == nil {
+		t.Errorf("Logs: expected an error for an unknown homeserver")
+	}
+
+	if err = dep.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if !destroyed {
+		t.Errorf("Close: deployment was not destroyed")
+	}
+}
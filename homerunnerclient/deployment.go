@@ -0,0 +1,161 @@
+package homerunnerclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Deployment is a running deployment of a blueprint in Homerunner.
+type Deployment struct {
+	BlueprintName string
+	// A map of HS name to a HomeserverDeployment
+	Homeservers map[string]*HomeserverDeployment
+	// When Homerunner will destroy the deployment, unless it is extended
+	Expires time.Time
+
+	client *Client
+}
+
+// UserClient is an HTTP client which sends the access token of a user in a deployment with every request.
+type UserClient struct {
+	*http.Client
+	UserID      string
+	DeviceID    string
+	AccessToken string
+
+	hs *HomeserverDeployment
+}
+
+// URL returns the URL on the user's homeserver with the given path segments, which are escaped e.g
+//   c.URL("_matrix", "client", "v3", "rooms", roomID, "state")
+func (c *UserClient) URL(paths ...string) string {
+	escaped := make([]string, len(paths))
+	for i := range paths {
+		escaped[i] = url.PathEscape(paths[i])
+	}
+	return c.hs.BaseURL + "/" + strings.Join(escaped, "/")
+}
+
+// Client returns an HTTP client for a user created by the blueprint. The client keeps working if the
+// homeserver is restarted through this Deployment, as URL always uses the current base URL.
+func (d *Deployment) Client(hsName, userID string) (*UserClient, error) {
+	hs, ok := d.Homeservers[hsName]
+	if !ok {
+		return nil, fmt.Errorf("Deployment.Client - HS name '%s' not found", hsName)
+	}
+	token, ok := hs.AccessTokens[userID]
+	if !ok {
+		return nil, fmt.Errorf("Deployment.Client - HS name '%s' - user ID '%s' not found", hsName, userID)
+	}
+	return &UserClient{
+		Client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &authTransport{
+				accessToken: token,
+				next:        http.DefaultTransport,
+			},
+		},
+		UserID:      userID,
+		DeviceID:    hs.DeviceIDs[userID],
+		AccessToken: token,
+		hs:          hs,
+	}, nil
+}
+
+// Extend the lifetime of the deployment to `lifetime` from now, rounded up to the minute, or to
+// HOMERUNNER_LIFETIME_MINS from now if it is zero. Returns an error if `lifetime` is negative.
+func (d *Deployment) Extend(ctx context.Context, lifetime time.Duration) error {
+	if lifetime < 0 {
+		return fmt.Errorf("Deployment.Extend: lifetime must not be negative, got %v", lifetime)
+	}
+	var res ResExtend
+	// round up, so a lifetime of less than a minute doesn't mean the default lifetime
+	req := ReqExtend{LifetimeMins: int((lifetime + time.Minute - 1) / time.Minute)}
+	if err := d.client.do(ctx, "POST", d.path("extend"), req, &res); err != nil {
+		return fmt.Errorf("Deployment.Extend: %w", err)
+	}
+	d.Expires = res.Expires
+	return nil
+}
+
+// Restart a homeserver in the deployment.
+func (d *Deployment) Restart(ctx context.Context, hsName string) error {
+	return d.homeserverAction(ctx, hsName, "restart")
+}
+
+// Stop a homeserver in the deployment. It can be started again with Start.
+func (d *Deployment) Stop(ctx context.Context, hsName string) error {
+	return d.homeserverAction(ctx, hsName, "stop")
+}
+
+// Start a stopped homeserver in the deployment.
+func (d *Deployment) Start(ctx context.Context, hsName string) error {
+	return d.homeserverAction(ctx, hsName, "start")
+}
+
+// Logs returns the container logs of a homeserver in the deployment.
+func (d *Deployment) Logs(ctx context.Context, hsName string) (string, error) {
+	res, err := d.client.send(ctx, "GET", d.path("homeservers", hsName, "logs"), nil)
+	if err != nil {
+		return "", fmt.Errorf("Deployment.Logs: %w", err)
+	}
+	defer res.Body.Close()
+	logs, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("Deployment.Logs: %w", err)
+	}
+	return string(logs), nil
+}
+
+// Snapshot commits the deployment into images for a new blueprint. The deployment is destroyed.
+func (d *Deployment) Snapshot(ctx context.Context, snapshotName string) error {
+	return d.client.Snapshot(ctx, d.BlueprintName, snapshotName)
+}
+
+// Close destroys the deployment.
+func (d *Deployment) Close() error {
+	return d.client.Destroy(context.Background(), d.BlueprintName)
+}
+
+// homeserverAction restarts, stops or starts a homeserver then updates it in place, as its ports may have changed.
+func (d *Deployment) homeserverAction(ctx context.Context, hsName, action string) error {
+	hs, ok := d.Homeservers[hsName]
+	if !ok {
+		return fmt.Errorf("Deployment.%s - HS name '%s' not found", strings.Title(action), hsName)
+	}
+	var res HomeserverDeployment
+	if err := d.client.do(ctx, "POST", d.path("homeservers", hsName, action), nil, &res); err != nil {
+		return fmt.Errorf("Deployment.%s: %w", strings.Title(action), err)
+	}
+	*hs = res
+	return nil
+}
+
+// path returns the path of an endpoint for this deployment.
+func (d *Deployment) path(paths ...string) string {
+	p := "/deployments/" + url.PathEscape(d.BlueprintName)
+	for _, segment := range paths {
+		p += "/" + url.PathEscape(segment)
+	}
+	return p
+}
+
+type authTransport struct {
+	accessToken string
+	next        http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.accessToken)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,78 @@
+package homerunnerclient
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ReqCreate is the request body of POST /create. One of BlueprintName or Blueprint must be set.
+type ReqCreate struct {
+	// The base image to build blueprints from e.g "complement-dendrite". Not needed when deploying a
+	// pre-built blueprint image.
+	BaseImageURI string `json:"base_image_uri,omitempty"`
+	// The name of a static blueprint, or a blueprint which has already been built into images.
+	BlueprintName string `json:"blueprint_name,omitempty"`
+	// An in-line blueprint, in the same format as the `Blueprint` struct in Complement.
+	Blueprint json.RawMessage `json:"blueprint,omitempty"`
+}
+
+// ResCreate is the response body of POST /create.
+type ResCreate struct {
+	Homeservers map[string]*HomeserverDeployment `json:"homeservers"`
+	Expires     time.Time                        `json:"expires"`
+}
+
+// HomeserverDeployment is a running homeserver in a deployment.
+type HomeserverDeployment struct {
+	BaseURL             string            // e.g http://localhost:38646
+	FedBaseURL          string            // e.g https://localhost:48373
+	ContainerID         string            // e.g 10de45efba
+	AccessTokens        map[string]string // e.g { "@alice:hs1": "myAcc3ssT0ken" }
+	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
+	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }
+}
+
+// ReqDestroy is the request body of POST /destroy.
+type ReqDestroy struct {
+	BlueprintName string `json:"blueprint_name"`
+}
+
+// ResDestroy is the response body of POST /destroy.
+type ResDestroy struct {
+}
+
+// ResDeployments is the response body of GET /deployments.
+type ResDeployments struct {
+	Deployments []string `json:"deployments"`
+}
+
+// ResDeployment is the response body of GET /deployments/{name}.
+type ResDeployment struct {
+	BlueprintName string                           `json:"blueprint_name"`
+	Homeservers   map[string]*HomeserverDeployment `json:"homeservers"`
+	Expires       time.Time                        `json:"expires"`
+}
+
+// ReqExtend is the request body of POST /deployments/{name}/extend.
+type ReqExtend struct {
+	// How long from now the deployment should live for. Defaults to HOMERUNNER_LIFETIME_MINS.
+	LifetimeMins int `json:"lifetime_mins"`
+}
+
+// ResExtend is the response body of POST /deployments/{name}/extend.
+type ResExtend struct {
+	Expires time.Time `json:"expires"`
+}
+
+// ReqSnapshot is the request body of POST /snapshot.
+type ReqSnapshot struct {
+	// The name of the running deployment to snapshot
+	BlueprintName string `json:"blueprint_name"`
+	// The name of the new blueprint, which can be used as the blueprint_name in /create
+	SnapshotName string `json:"snapshot_name"`
+}
+
+// ResSnapshot is the response body of POST /snapshot.
+type ResSnapshot struct {
+	BlueprintName string `json:"blueprint_name"`
+}
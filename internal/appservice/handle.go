@@ -0,0 +1,106 @@
+package appservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleTransactions is an option which will process PUT /transactions/{txnId} requests from the homeserver.
+// Every transaction is recorded and can be inspected via Transactions() and MustWaitForEvent(). If a
+// callback is provided it is invoked with each transaction before the homeserver is sent a 200 OK.
+// Retried transactions with an ID which has already been seen are acknowledged without being recorded twice.
+func HandleTransactions(cb func(txn Transaction)) func(*Server) {
+	return func(srv *Server) {
+		h := func(w http.ResponseWriter, req *http.Request) {
+			if !srv.authenticate(w, req) {
+				return
+			}
+			txnID := mux.Vars(req)["txnId"]
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"complement: failed to read request body"}`))
+				return
+			}
+			var payload struct {
+				Events    []json.RawMessage `json:"events"`
+				Ephemeral []json.RawMessage `json:"de.sorunome.msc2409.ephemeral"`
+			}
+			if err = json.Unmarshal(body, &payload); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errcode":"M_NOT_JSON","error":"complement: transaction body is not JSON"}`))
+				return
+			}
+			txn := Transaction{
+				ID:        txnID,
+				Events:    payload.Events,
+				Ephemeral: payload.Ephemeral,
+			}
+			if !srv.hasTransaction(txnID) {
+				srv.addTransaction(txn)
+				if cb != nil {
+					cb(txn)
+				}
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{}`))
+		}
+		srv.mux.HandleFunc("/transactions/{txnId}", h).Methods("PUT")
+		srv.mux.HandleFunc("/_matrix/app/v1/transactions/{txnId}", h).Methods("PUT")
+	}
+}
+
+// HandleUserQueries is an option which will process GET /users/{userId} requests from the homeserver.
+// The callback should return true if the application service claims the user ID, in which case the homeserver
+// is told the user exists. If the callback is nil, no users exist.
+func HandleUserQueries(cb func(userID string) bool) func(*Server) {
+	return func(srv *Server) {
+		h := func(w http.ResponseWriter, req *http.Request) {
+			if !srv.authenticate(w, req) {
+				return
+			}
+			userID := mux.Vars(req)["userId"]
+			srv.mu.Lock()
+			srv.userQueries = append(srv.userQueries, userID)
+			srv.mu.Unlock()
+			if cb == nil || !cb(userID) {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: user does not exist"}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{}`))
+		}
+		srv.mux.HandleFunc("/users/{userId}", h).Methods("GET")
+		srv.mux.HandleFunc("/_matrix/app/v1/users/{userId}", h).Methods("GET")
+	}
+}
+
+// HandleRoomAliasQueries is an option which will process GET /rooms/{alias} requests from the homeserver.
+// The callback should return true if the application service has created the room for this alias, in which
+// case the homeserver is told the alias exists. If the callback is nil, no aliases exist.
+func HandleRoomAliasQueries(cb func(alias string) bool) func(*Server) {
+	return func(srv *Server) {
+		h := func(w http.ResponseWriter, req *http.Request) {
+			if !srv.authenticate(w, req) {
+				return
+			}
+			alias := mux.Vars(req)["alias"]
+			srv.mu.Lock()
+			srv.roomAliasQueries = append(srv.roomAliasQueries, alias)
+			srv.mu.Unlock()
+			if cb == nil || !cb(alias) {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: room alias does not exist"}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{}`))
+		}
+		srv.mux.HandleFunc("/rooms/{alias}", h).Methods("GET")
+		srv.mux.HandleFunc("/_matrix/app/v1/rooms/{alias}", h).Methods("GET")
+	}
+}
@@ -0,0 +1,269 @@
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Transaction is a single PUT /transactions/{txnId} request which was pushed to the application service.
+type Transaction struct {
+	// The transaction ID in the request path
+	ID string
+	// The client-formatted events in this transaction
+	Events []json.RawMessage
+	// The ephemeral events in this transaction, if the homeserver sends them (MSC2409)
+	Ephemeral []json.RawMessage
+}
+
+// Server represents an application service which the homeserver under test can push events to
+// and query for users and room aliases.
+type Server struct {
+	t *testing.T
+
+	// Default: true
+	UnexpectedRequestsAreErrors bool
+
+	// The ID of the application service in the blueprint which this server is acting as.
+	ID string
+	// The hs_token the homeserver must present on every request. Requests are not authenticated
+	// if this is empty. See LoadRegistration.
+	HSToken string
+
+	hostname  string
+	url       string
+	listening bool
+
+	mux *mux.Router
+	srv *http.Server
+
+	mu               sync.Mutex
+	transactions     []Transaction
+	userQueries      []string
+	roomAliasQueries []string
+	// closed and replaced whenever a new transaction arrives, to wake up waiters
+	txnNotify chan struct{}
+}
+
+// NewServer creates a new application service server with configured options. The server will act as
+// the application service with the ID `asID`.
+//
+// The homeserver can only push events to this server if it knows where it is listening, so deployments
+// which use this server must be made via a Deployer with ApplicationServiceURLs set to the URL()
+// of this server.
+func NewServer(t *testing.T, cfg *config.Complement, asID string, opts ...func(*Server)) *Server {
+	srv := &Server{
+		t:                           t,
+		ID:                          asID,
+		hostname:                    cfg.HostnameRunningComplement,
+		mux:                         mux.NewRouter(),
+		UnexpectedRequestsAreErrors: true,
+		txnNotify:                   make(chan struct{}),
+	}
+	srv.mux.Use(func(h http.Handler) http.Handler {
+		// Return a json Content-Type header to all requests by default
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			h.ServeHTTP(w, r)
+		})
+	})
+	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.UnexpectedRequestsAreErrors {
+			body, _ := ioutil.ReadAll(req.Body)
+			t.Errorf("Server.UnexpectedRequestsAreErrors=true received unexpected request to application service: %s %s\n%s", req.Method, req.URL.Path, string(body))
+		} else {
+			t.Logf("Server.UnexpectedRequestsAreErrors=false received unexpected request to application service: %s %s - sending 404", req.Method, req.URL.Path)
+		}
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"complement: application service is not listening for this path"}`))
+	})
+	srv.srv = &http.Server{
+		Handler: srv.mux,
+	}
+
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// URL returns the base URL which homeservers should use to contact this application service.
+// Only valid AFTER calling Listen() - doing so before will fail the test, as Listen() chooses the port.
+func (s *Server) URL() string {
+	if !s.listening {
+		s.t.Fatalf("URL() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the URL. Ensure you Listen() first!")
+	}
+	return s.url
+}
+
+// Mux returns this server's router so you can attach additional paths.
+func (s *Server) Mux() *mux.Router {
+	return s.mux
+}
+
+// LoadRegistration reads the hs_token for this application service from the deployment, so incoming
+// requests can be checked to have come from the homeserver. Fails the test if no homeserver in the
+// deployment has registered this application service.
+func (s *Server) LoadRegistration(t *testing.T, deployment *docker.Deployment) {
+	t.Helper()
+	for _, hsDep := range deployment.HS {
+		registration, ok := hsDep.ApplicationServices[s.ID]
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(registration, "\n") {
+			if strings.HasPrefix(line, "hs_token: ") {
+				s.HSToken = strings.TrimPrefix(line, "hs_token: ")
+				return
+			}
+		}
+		t.Fatalf("LoadRegistration: registration for application service '%s' has no hs_token", s.ID)
+	}
+	t.Fatalf("LoadRegistration: no homeserver in the deployment has the application service '%s'", s.ID)
+}
+
+// Transactions returns all the transactions the homeserver has pushed to this server so far, in the order
+// they were received.
+func (s *Server) Transactions() []Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txns := make([]Transaction, len(s.transactions))
+	copy(txns, s.transactions)
+	return txns
+}
+
+// UserQueries returns all the user IDs the homeserver has queried this server for, in the order they were queried.
+func (s *Server) UserQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.userQueries...)
+}
+
+// RoomAliasQueries returns all the room aliases the homeserver has queried this server for, in the order they
+// were queried.
+func (s *Server) RoomAliasQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.roomAliasQueries...)
+}
+
+// MustWaitForEvent blocks until an event which passes the `check` function has been pushed to this server
+// in a transaction, and returns it. Events which arrived before this function was called are also checked.
+// Fails the test if no such event arrives before the timeout.
+func (s *Server) MustWaitForEvent(t *testing.T, timeout time.Duration, check func(gjson.Result) bool) gjson.Result {
+	t.Helper()
+	deadline := time.After(timeout)
+	seen := 0
+	for {
+		s.mu.Lock()
+		txns := s.transactions[seen:]
+		notify := s.txnNotify
+		s.mu.Unlock()
+		for _, txn := range txns {
+			for _, ev := range txn.Events {
+				res := gjson.ParseBytes(ev)
+				if check(res) {
+					return res
+				}
+			}
+		}
+		seen += len(txns)
+		select {
+		case <-notify:
+			continue
+		case <-deadline:
+			t.Fatalf("MustWaitForEvent: timed out after %v. Seen %d transactions.", timeout, seen)
+			return gjson.Result{}
+		}
+	}
+}
+
+func (s *Server) hasTransaction(txnID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, txn := range s.transactions {
+		if txn.ID == txnID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) addTransaction(txn Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactions = append(s.transactions, txn)
+	close(s.txnNotify)
+	s.txnNotify = make(chan struct{})
+}
+
+// authenticate checks that the request has come from the homeserver, writing a response and returning
+// false if not.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	if s.HSToken == "" {
+		return true
+	}
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"errcode":"M_UNAUTHORIZED","error":"complement: missing hs_token"}`))
+		return false
+	}
+	if token != s.HSToken {
+		s.t.Errorf("complement: application service %s received request with the wrong hs_token: %s %s", s.ID, req.Method, req.URL.Path)
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"complement: wrong hs_token"}`))
+		return false
+	}
+	return true
+}
+
+// Listen for application service requests - call the returned function to gracefully close the server.
+func (s *Server) Listen() (cancel func()) {
+	if s.listening {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		s.t.Fatalf("ListenApplicationService: net.Listen failed: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	s.url = fmt.Sprintf("http://%s:%d", s.hostname, port)
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("ListenApplicationService: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Shutdown(context.Background())
+		if err != nil {
+			s.t.Fatalf("ListenApplicationService: failed to shutdown server: %s", err)
+		}
+		wg.Wait() // wait for the server to shutdown
+	}
+}
@@ -0,0 +1,72 @@
+package appservice
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+func TestServerRecordsTransactions(t *testing.T) {
+	cfg := &config.Complement{
+		HostnameRunningComplement: "localhost",
+	}
+	srv := NewServer(t, cfg, "my_as_id", HandleTransactions(nil))
+	srv.HSToken = "hs_token"
+	cancel := srv.Listen()
+	defer cancel()
+
+	testCases := []struct {
+		path     string
+		token    string
+		wantCode int
+	}{
+		{
+			path:     "/transactions/1",
+			token:    "hs_token",
+			wantCode: 200,
+		},
+		{
+			path:     "/transactions/2",
+			wantCode: 401,
+		},
+		{
+			// retries of the same transaction are not recorded twice
+			path:     "/_matrix/app/v1/transactions/1",
+			token:    "hs_token",
+			wantCode: 200,
+		},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("PUT", srv.URL()+tc.path, bytes.NewBufferString(`{"events":[{"event_id":"$foo","type":"m.room.message"}]}`))
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to PUT %s: %s", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantCode {
+			t.Errorf("PUT %s: expected %d, got %d", tc.path, tc.wantCode, resp.StatusCode)
+		}
+	}
+
+	txns := srv.Transactions()
+	if len(txns) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txns))
+	}
+	ev := srv.MustWaitForEvent(t, time.Second, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == "$foo"
+	})
+	if ev.Get("type").Str != "m.room.message" {
+		t.Errorf("expected m.room.message, got %s", ev.Get("type").Str)
+	}
+}
@@ -43,6 +43,11 @@ type Blueprint struct {
 	Homeservers []Homeserver
 	// A set of user IDs to retain access_tokens for. If empty, all tokens are kept.
 	KeepAccessTokensForUsers []string
+	// Optional: the blueprint this one extends. Homeservers with the same name as one in the parent are built
+	// from the parent's image, and only the users, rooms and application services listed here are added to them.
+	// Events can be added to a parent's room by listing a room with the same Ref and no Creator. Homeservers
+	// which are not in the parent are built from the base image as usual.
+	Parent *Blueprint
 }
 
 type Homeserver struct {
@@ -130,6 +135,11 @@ func Validate(bp Blueprint) (Blueprint, error) {
 		return bp, fmt.Errorf("Blueprint must have a Name")
 	}
 	var err error
+	if bp.Parent != nil {
+		if err = validateAgainstParent(bp); err != nil {
+			return bp, err
+		}
+	}
 	for _, hs := range bp.Homeservers {
 		for i, u := range hs.Users {
 			if !strings.HasPrefix(u.Localpart, "@") {
@@ -158,6 +168,82 @@ func Validate(bp Blueprint) (Blueprint, error) {
 	return bp, nil
 }
 
+// validateAgainstParent checks that the blueprint doesn't create users or rooms which already exist in its parents.
+func validateAgainstParent(bp Blueprint) error {
+	parent := Flatten(*bp.Parent)
+	for _, ancestor := range Lineage(*bp.Parent) {
+		if ancestor.Name == bp.Name {
+			return fmt.Errorf("Blueprint %s cannot extend itself", bp.Name)
+		}
+	}
+	for _, hs := range bp.Homeservers {
+		for _, parentHS := range parent.Homeservers {
+			if parentHS.Name != hs.Name {
+				continue
+			}
+			for _, u := range hs.Users {
+				for _, parentUser := range parentHS.Users {
+					if "@"+parentUser.Localpart == u.Localpart {
+						return fmt.Errorf("HS %s user '%s' already exists in parent blueprint %s", hs.Name, u.Localpart, bp.Parent.Name)
+					}
+				}
+			}
+			for _, r := range hs.Rooms {
+				for _, parentRoom := range parentHS.Rooms {
+					if r.Ref != "" && r.Creator != "" && parentRoom.Ref == r.Ref && parentRoom.Creator != "" {
+						return fmt.Errorf("HS %s room Ref '%s' is already created in parent blueprint %s", hs.Name, r.Ref, bp.Parent.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Lineage returns the blueprint and all of its parents, starting with the blueprint which has no parent.
+func Lineage(bp Blueprint) []Blueprint {
+	lineage := []Blueprint{bp}
+	for p := bp.Parent; p != nil; p = p.Parent {
+		lineage = append([]Blueprint{*p}, lineage...)
+	}
+	return lineage
+}
+
+// Flatten returns the blueprint with the homeservers, users, rooms and application services of all of its
+// parents merged in, parents first. This is what a deployment of the blueprint contains. The result has no Parent.
+func Flatten(bp Blueprint) Blueprint {
+	if bp.Parent == nil {
+		return bp
+	}
+	flat := Blueprint{
+		Name:                     bp.Name,
+		KeepAccessTokensForUsers: bp.KeepAccessTokensForUsers,
+	}
+	for _, ancestor := range Lineage(bp) {
+		for _, hs := range ancestor.Homeservers {
+			i := -1
+			for j := range flat.Homeservers {
+				if flat.Homeservers[j].Name == hs.Name {
+					i = j
+					break
+				}
+			}
+			if i == -1 {
+				flat.Homeservers = append(flat.Homeservers, Homeserver{
+					Name:         hs.Name,
+					BaseImageURI: hs.BaseImageURI,
+				})
+				i = len(flat.Homeservers) - 1
+			}
+			flatHS := &flat.Homeservers[i]
+			flatHS.Users = append(flatHS.Users, hs.Users...)
+			flatHS.Rooms = append(flatHS.Rooms, hs.Rooms...)
+			flatHS.ApplicationServices = append(flatHS.ApplicationServices, hs.ApplicationServices...)
+		}
+	}
+	return flat
+}
+
 func normaliseRoom(hsName string, r Room) (Room, error) {
 	var err error
 	if r.Creator != "" {
@@ -0,0 +1,81 @@
+package b
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFlattenMergesParents(t *testing.T) {
+	flat := Flatten(BlueprintFederationOneToOneRoom)
+	if flat.Parent != nil || flat.Name != BlueprintFederationOneToOneRoom.Name {
+		t.Fatalf("got flattened blueprint %s with parent %v", flat.Name, flat.Parent)
+	}
+	if len(flat.Homeservers) != 2 || flat.Homeservers[0].Name != "hs1" || flat.Homeservers[1].Name != "hs2" {
+		t.Fatalf("got homeservers %+v", flat.Homeservers)
+	}
+	hs1 := flat.Homeservers[0]
+	if len(hs1.Users) != 1 || hs1.Users[0].Localpart != "alice" {
+		t.Errorf("hs1 users were not merged from the parent: %+v", hs1.Users)
+	}
+	if len(hs1.Rooms) != 1 || hs1.Rooms[0].Ref != "alice_room" {
+		t.Errorf("hs1 rooms were not merged from the child: %+v", hs1.Rooms)
+	}
+	lineage := Lineage(BlueprintFederationOneToOneRoom)
+	if len(lineage) != 2 || lineage[0].Name != "alice" || lineage[1].Name != "federation_one_to_one_room" {
+		t.Errorf("got lineage %+v", lineage)
+	}
+}
+
+func TestValidateAgainstParent(t *testing.T) {
+	testCases := []struct {
+		name    string
+		bp      Blueprint
+		wantErr string
+	}{
+		{
+			name: "duplicate user",
+			bp: Blueprint{
+				Name:        "dupe_user",
+				Parent:      &BlueprintAlice,
+				Homeservers: []Homeserver{{Name: "hs1", Users: []User{{Localpart: "@alice"}}}},
+			},
+			wantErr: "already exists in parent",
+		},
+		{
+			name: "duplicate room ref",
+			bp: Blueprint{
+				Name:        "dupe_ref",
+				Parent:      &BlueprintFederationOneToOneRoom,
+				Homeservers: []Homeserver{{Name: "hs1", Rooms: []Room{{Ref: "alice_room", Creator: "@alice"}}}},
+			},
+			wantErr: "already created in parent",
+		},
+		{
+			name: "same name",
+			bp: Blueprint{
+				Name:   "alice",
+				Parent: &BlueprintAlice,
+			},
+			wantErr: "cannot extend itself",
+		},
+		{
+			name: "extra events in parent room",
+			bp: Blueprint{
+				Name:   "extra_events",
+				Parent: &BlueprintFederationOneToOneRoom,
+				Homeservers: []Homeserver{{Name: "hs1", Rooms: []Room{{Ref: "alice_room", Events: []Event{
+					{Type: "m.room.message", Sender: "@alice", Content: map[string]interface{}{"body": "hi"}},
+				}}}}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(tc.bp)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want one containing '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
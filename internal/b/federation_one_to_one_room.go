@@ -3,16 +3,11 @@ package b
 // BlueprintFederationOneToOneRoom contains two homeservers with 1 user in each, who are joined
 // to the same room.
 var BlueprintFederationOneToOneRoom = MustValidate(Blueprint{
-	Name: "federation_one_to_one_room",
+	Name:   "federation_one_to_one_room",
+	Parent: &BlueprintAlice,
 	Homeservers: []Homeserver{
 		{
 			Name: "hs1",
-			Users: []User{
-				{
-					Localpart:   "@alice",
-					DisplayName: "Alice",
-				},
-			},
 			Rooms: []Room{
 				{
 					CreateRoom: map[string]interface{}{
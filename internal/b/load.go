@@ -0,0 +1,169 @@
+package b
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadBlueprint reads and validates a blueprint from a JSON or YAML file. Field names are the same as
+// the Go struct fields and are case-insensitive, so files are interchangeable with the inline blueprints
+// accepted by homerunner e.g:
+//
+//	name: alice
+//	homeservers:
+//	  - name: hs1
+//	    users:
+//	      - localpart: "@alice"
+//	        displayname: Alice
+//
+// Unknown fields are an error, so typos are caught rather than silently ignored. A blueprint can extend another by
+// setting `parent` to its name, which must be in KnownBlueprints.
+func LoadBlueprint(path string) (Blueprint, error) {
+	f, err := decodeBlueprintFile(path)
+	if err != nil {
+		return f.Blueprint, err
+	}
+	if f.Parent != "" {
+		parent, ok := KnownBlueprints[f.Parent]
+		if !ok {
+			return f.Blueprint, fmt.Errorf("%s: unknown parent blueprint '%s'", path, f.Parent)
+		}
+		f.Blueprint.Parent = parent
+	}
+	bp, err := Validate(f.Blueprint)
+	if err != nil {
+		return bp, fmt.Errorf("%s: %w", path, err)
+	}
+	return bp, nil
+}
+
+// blueprintFile is the format of a blueprint file, which refers to its parent by name.
+type blueprintFile struct {
+	Blueprint
+	// The name of the parent blueprint, if any
+	Parent string
+
+	path string
+}
+
+// decodeBlueprintFile reads a blueprint from a JSON or YAML file, without validating it.
+func decodeBlueprintFile(path string) (blueprintFile, error) {
+	f := blueprintFile{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		// convert to JSON so field names are matched the same way for both formats
+		var val interface{}
+		if err = yaml.Unmarshal(data, &val); err != nil {
+			return f, fmt.Errorf("%s: invalid YAML: %w", path, err)
+		}
+		data, err = json.Marshal(val)
+		if err != nil {
+			return f, fmt.Errorf("%s: cannot convert YAML to JSON: %w", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&f); err != nil {
+		return f, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// LoadBlueprints loads every .json, .yaml and .yml file in the directory as a blueprint, sorted by file name.
+// Blueprints can extend other blueprints in the same directory, as well as those in KnownBlueprints.
+func LoadBlueprints(dir string) ([]Blueprint, error) {
+	var paths []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	files := make(map[string]blueprintFile)
+	var names []string
+	for _, path := range paths {
+		f, err := decodeBlueprintFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := files[f.Name]; ok {
+			return nil, fmt.Errorf("%s: blueprint name '%s' is already used by %s", path, f.Name, other.path)
+		}
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	// validate parents before their children, as Validate needs the parent
+	validated := make(map[string]*Blueprint)
+	var resolve func(name string, children []string) (*Blueprint, error)
+	resolve = func(name string, children []string) (*Blueprint, error) {
+		if bp, ok := validated[name]; ok {
+			return bp, nil
+		}
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown parent blueprint '%s'", name)
+		}
+		for _, child := range children {
+			if child == name {
+				return nil, fmt.Errorf("%s: blueprint '%s' extends itself via %s", f.path, name, strings.Join(children, " -> "))
+			}
+		}
+		if f.Parent != "" {
+			parent, ok := KnownBlueprints[f.Parent]
+			if !ok {
+				var err error
+				parent, err = resolve(f.Parent, append(children, name))
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", f.path, err)
+				}
+			}
+			f.Blueprint.Parent = parent
+		}
+		bp, err := Validate(f.Blueprint)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.path, err)
+		}
+		validated[name] = &bp
+		return &bp, nil
+	}
+	blueprints := make([]Blueprint, 0, len(names))
+	for _, name := range names {
+		bp, err := resolve(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		blueprints = append(blueprints, *bp)
+	}
+	return blueprints, nil
+}
+
+// RegisterBlueprints loads the blueprints in the directory and adds them to KnownBlueprints. It is an error
+// for a loaded blueprint to have the same name as one of the static blueprints.
+func RegisterBlueprints(dir string) error {
+	blueprints, err := LoadBlueprints(dir)
+	if err != nil {
+		return err
+	}
+	for i := range blueprints {
+		if _, ok := KnownBlueprints[blueprints[i].Name]; ok {
+			return fmt.Errorf("blueprint '%s' in %s is already known", blueprints[i].Name, dir)
+		}
+	}
+	for i := range blueprints {
+		KnownBlueprints[blueprints[i].Name] = &blueprints[i]
+	}
+	return nil
+}
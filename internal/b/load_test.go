@@ -0,0 +1,88 @@
+package b
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadBlueprints(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": `
+name: loaded_yaml
+homeservers:
+  - name: hs1
+    users:
+      - localpart: "@alice"
+        displayname: Alice
+`,
+		"b.json": `{"Name":"loaded_json","Homeservers":[{"Name":"hs1","Rooms":[{"Creator":"@bob","Events":[{"Type":"m.room.message","Sender":"bob","Content":{"body":"hi"}}]}]}]}`,
+		"c.yml": `
+name: loaded_child
+parent: loaded_yaml
+homeservers:
+  - name: hs1
+    users:
+      - localpart: "@bob"
+`,
+		"ignored.txt": "not a blueprint",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	blueprints, err := LoadBlueprints(dir)
+	if err != nil {
+		t.Fatalf("LoadBlueprints: %s", err)
+	}
+	if len(blueprints) != 3 || blueprints[0].Name != "loaded_yaml" || blueprints[1].Name != "loaded_json" || blueprints[2].Name != "loaded_child" {
+		t.Fatalf("got blueprints %+v", blueprints)
+	}
+	if u := blueprints[0].Homeservers[0].Users[0]; u.Localpart != "alice" || u.DisplayName != "Alice" {
+		t.Errorf("YAML user was not loaded and validated: %+v", u)
+	}
+	if ev := blueprints[1].Homeservers[0].Rooms[0].Events[0]; ev.Sender != "bob:hs1" || ev.Content["body"] != "hi" {
+		t.Errorf("JSON event was not loaded and validated: %+v", ev)
+	}
+	if p := blueprints[2].Parent; p == nil || p.Name != "loaded_yaml" || len(Flatten(blueprints[2]).Homeservers[0].Users) != 2 {
+		t.Errorf("child blueprint was not given its parent: %+v", p)
+	}
+
+	if err = RegisterBlueprints(dir); err != nil {
+		t.Fatalf("RegisterBlueprints: %s", err)
+	}
+	defer delete(KnownBlueprints, "loaded_json")
+	defer delete(KnownBlueprints, "loaded_yaml")
+	defer delete(KnownBlueprints, "loaded_child")
+	if KnownBlueprints["loaded_yaml"] == nil || KnownBlueprints["loaded_json"] == nil {
+		t.Fatalf("blueprints were not added to KnownBlueprints")
+	}
+	if err = RegisterBlueprints(dir); err == nil {
+		t.Errorf("RegisterBlueprints: expected an error registering the same blueprints twice")
+	}
+}
+
+func TestLoadBlueprintErrors(t *testing.T) {
+	testCases := map[string]string{
+		"unknown.yaml":  "name: foo\nhomeserverz: []\n",
+		"nolocal.json":  `{"Name":"foo","Homeservers":[{"Name":"hs1","Users":[{"Localpart":"alice"}]}]}`,
+		"noname.yaml":   "homeservers: []\n",
+		"invalid.yaml":  "name: [",
+		"notobject.yml": "- foo\n",
+		"noparent.yaml": "name: foo\nparent: does_not_exist\n",
+	}
+	dir := t.TempDir()
+	for name, content := range testCases {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+		_, err := LoadBlueprint(path)
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: got error %v, want one prefixed with the path", name, err)
+		}
+	}
+}
@@ -2,15 +2,12 @@ package b
 
 // BlueprintOneToOneRoom contains a homeserver with 2 users, who are joined to the same room.
 var BlueprintOneToOneRoom = MustValidate(Blueprint{
-	Name: "one_to_one_room",
+	Name:   "one_to_one_room",
+	Parent: &BlueprintAlice,
 	Homeservers: []Homeserver{
 		{
 			Name: "hs1",
 			Users: []User{
-				{
-					Localpart:   "@alice",
-					DisplayName: "Alice",
-				},
 				{
 					Localpart:   "@bob",
 					DisplayName: "Bob",
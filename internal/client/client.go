@@ -23,6 +23,7 @@ import (
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/runtime"
 )
 
 const (
@@ -125,8 +126,14 @@ func (c *CSAPI) DownloadContent(t *testing.T, mxcUri string) ([]byte, string) {
 }
 
 // CreateRoom creates a room with an optional HTTP request body. Fails the test on error. Returns the room ID.
+//
+// If the test is being run by runtime.RunForEachRoomVersion and the body does not specify a `room_version`,
+// the room is created with the room version being tested.
 func (c *CSAPI) CreateRoom(t *testing.T, creationContent interface{}) string {
 	t.Helper()
+	if ver := runtime.RoomVersion(t); ver != "" {
+		creationContent = withRoomVersion(t, creationContent, ver)
+	}
 	res := c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "createRoom"}, creationContent)
 	body := ParseJSON(t, res)
 	return GetJSONFieldStr(t, body, "room_id")
@@ -388,9 +395,32 @@ func (c *CSAPI) GetCapabilities(t *testing.T) []byte {
 	return body
 }
 
-// GetDefaultRoomVersion returns the server's default room version
+// withRoomVersion returns the createRoom request body with `room_version` set to `ver`, unless it is already set.
+func withRoomVersion(t *testing.T, creationContent interface{}, ver gomatrixserverlib.RoomVersion) map[string]interface{} {
+	t.Helper()
+	content := make(map[string]interface{})
+	if creationContent != nil {
+		data, err := json.Marshal(creationContent)
+		if err != nil {
+			t.Fatalf("CSAPI.CreateRoom failed to marshal body: %s", err)
+		}
+		if err = json.Unmarshal(data, &content); err != nil {
+			t.Fatalf("CSAPI.CreateRoom body is not a JSON object: %s", err)
+		}
+	}
+	if _, ok := content["room_version"]; !ok {
+		content["room_version"] = ver
+	}
+	return content
+}
+
+// GetDefaultRoomVersion returns the server's default room version. If the test is being run by
+// runtime.RunForEachRoomVersion, returns the room version being tested instead.
 func (c *CSAPI) GetDefaultRoomVersion(t *testing.T) gomatrixserverlib.RoomVersion {
 	t.Helper()
+	if ver := runtime.RoomVersion(t); ver != "" {
+		return ver
+	}
 	capabilities := c.GetCapabilities(t)
 	defaultVersion := gjson.GetBytes(capabilities, `capabilities.m\.room_versions.default`)
 	if !defaultVersion.Exists() {
@@ -575,6 +605,13 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 
 // NewLoggedClient returns an http.Client which logs requests/responses
 func NewLoggedClient(t *testing.T, hsName string, cli *http.Client) *http.Client {
+	t.Helper()
+	return NewLoggedClientWithTranscript(t, hsName, cli, nil)
+}
+
+// NewLoggedClientWithTranscript returns an http.Client which logs requests/responses, and also passes each
+// logged line to `transcript` if it is not nil.
+func NewLoggedClientWithTranscript(t *testing.T, hsName string, cli *http.Client, transcript func(line string)) *http.Client {
 	t.Helper()
 	if cli == nil {
 		cli = &http.Client{
@@ -585,23 +622,29 @@ func NewLoggedClient(t *testing.T, hsName string, cli *http.Client) *http.Client
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
-	cli.Transport = &loggedRoundTripper{t, hsName, transport}
+	cli.Transport = &loggedRoundTripper{t, hsName, transport, transcript}
 	return cli
 }
 
 type loggedRoundTripper struct {
-	t      *testing.T
-	hsName string
-	wrap   http.RoundTripper
+	t          *testing.T
+	hsName     string
+	wrap       http.RoundTripper
+	transcript func(line string)
 }
 
 func (t *loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	res, err := t.wrap.RoundTrip(req)
+	var line string
 	if err != nil {
-		t.t.Logf("[CSAPI] %s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
+		line = fmt.Sprintf("[CSAPI] %s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
 	} else {
-		t.t.Logf("[CSAPI] %s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
+		line = fmt.Sprintf("[CSAPI] %s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
+	}
+	t.t.Log(line)
+	if t.transcript != nil {
+		t.transcript(line)
 	}
 	return res, err
 }
@@ -802,6 +845,14 @@ func SyncLeftFrom(userID, roomID string) SyncCheckOpt {
 	}
 }
 
+// Calls the `check` function for each to-device event, and returns with success if the `check` function
+// returns true for at least one event.
+func SyncToDeviceHas(check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		return loopArray(topLevelSyncJSON, "to_device.events", check)
+	}
+}
+
 // Calls the `check` function for each global account data event, and returns with success if the
 // `check` function returns true for at least one event.
 func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
@@ -0,0 +1,553 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+const (
+	OlmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	MegolmAlgorithm = "m.megolm.v1.aes-sha2"
+)
+
+// Device is a device whose keys have been queried and verified with MustQueryKeys.
+type Device struct {
+	UserID     string
+	DeviceID   string
+	Ed25519    id.Ed25519
+	Curve25519 id.Curve25519
+}
+
+// DecryptedEvent is an Olm encrypted to-device event or Megolm encrypted room event, after decryption.
+type DecryptedEvent struct {
+	// The event ID, for room events
+	EventID string
+	Sender  string
+	// The Curve25519 key of the sending device
+	SenderKey id.Curve25519
+	// The type and content of the decrypted payload e.g m.room.message
+	Type    string
+	Content gjson.Result
+}
+
+// E2EEClient is a CSAPI client with an Olm account, so it can upload real device keys, establish Olm sessions
+// with other devices, and send and decrypt Megolm encrypted room messages. It implements enough of the
+// end-to-end encryption module for tests to check that homeservers relay keys and encrypted events correctly,
+// but none of the key verification or backup parts. Example:
+//
+//	alice := client.NewE2EEClient(t, deployment.Client(t, "hs1", "@alice:hs1"))
+//	bob := client.NewE2EEClient(t, deployment.Client(t, "hs2", "@bob:hs2"))
+//	alice.MustUploadKeys(t, 5)
+//	bob.MustUploadKeys(t, 5)
+//	alice.MustShareRoomKey(t, roomID, alice.MustQueryKeys(t, bob.UserID))
+//	eventID := alice.MustSendMegolm(t, roomID, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": "hi"})
+//	bob.MustSyncUntil(t, client.SyncReq{}, bob.SyncRoomKeyReceived(roomID))
+//	bob.MustSyncUntil(t, client.SyncReq{}, bob.SyncTimelineHasDecrypted(roomID, func(ev client.DecryptedEvent) bool {
+//		return ev.EventID == eventID && ev.Content.Get("body").Str == "hi"
+//	}))
+type E2EEClient struct {
+	*CSAPI
+	Ed25519    id.Ed25519
+	Curve25519 id.Curve25519
+
+	account *olm.Account
+	mu      sync.Mutex
+	// user ID -> device ID -> device
+	devices map[string]map[string]Device
+	// their Curve25519 key -> Olm sessions with that device, most recently used first
+	olmSessions map[id.Curve25519][]*olm.Session
+	// room ID -> our Megolm session for the room
+	outboundGroupSessions map[string]*olm.OutboundGroupSession
+	// room ID|sender key|session ID -> Megolm session
+	inboundGroupSessions map[string]*olm.InboundGroupSession
+	// ciphertexts of to-device events which have already been decrypted, as they can only be decrypted once
+	decryptedToDevice map[string]DecryptedEvent
+}
+
+// NewE2EEClient creates a new Olm account for the client's device. The client must have a device ID.
+func NewE2EEClient(t *testing.T, c *CSAPI) *E2EEClient {
+	t.Helper()
+	if c.DeviceID == "" {
+		t.Fatalf("NewE2EEClient: %s has no device ID", c.UserID)
+	}
+	account := olm.NewAccount()
+	ed25519Key, curveKey := account.IdentityKeys()
+	return &E2EEClient{
+		CSAPI:                 c,
+		Ed25519:               ed25519Key,
+		Curve25519:            curveKey,
+		account:               account,
+		devices:               make(map[string]map[string]Device),
+		olmSessions:           make(map[id.Curve25519][]*olm.Session),
+		outboundGroupSessions: make(map[string]*olm.OutboundGroupSession),
+		inboundGroupSessions:  make(map[string]*olm.InboundGroupSession),
+		decryptedToDevice:     make(map[string]DecryptedEvent),
+	}
+}
+
+// MustUploadKeys uploads the device keys of the client's device, along with `otkCount` new signed one-time keys.
+func (c *E2EEClient) MustUploadKeys(t *testing.T, otkCount uint) {
+	t.Helper()
+	ed25519KeyID := "ed25519:" + c.DeviceID
+	deviceKeys := map[string]interface{}{
+		"user_id":    c.UserID,
+		"device_id":  c.DeviceID,
+		"algorithms": []string{OlmAlgorithm, MegolmAlgorithm},
+		"keys": map[string]string{
+			ed25519KeyID:               c.Ed25519.String(),
+			"curve25519:" + c.DeviceID: c.Curve25519.String(),
+		},
+	}
+	deviceKeys["signatures"] = c.sign(t, deviceKeys)
+
+	c.mu.Lock()
+	c.account.GenOneTimeKeys(otkCount)
+	oneTimeKeys := make(map[string]interface{})
+	for kid, key := range c.account.OneTimeKeys() {
+		keyMap := map[string]interface{}{
+			"key": key.String(),
+		}
+		keyMap["signatures"] = c.sign(t, keyMap)
+		oneTimeKeys["signed_curve25519:"+kid] = keyMap
+	}
+	c.account.MarkKeysAsPublished()
+	c.mu.Unlock()
+
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys":   deviceKeys,
+		"one_time_keys": oneTimeKeys,
+	}))
+}
+
+// sign returns the `signatures` object for the JSON object, signed by the client's device.
+func (c *E2EEClient) sign(t *testing.T, obj interface{}) map[string]map[string]string {
+	t.Helper()
+	signature, err := c.account.SignJSON(obj)
+	if err != nil {
+		t.Fatalf("E2EEClient: failed to sign JSON: %s", err)
+	}
+	return map[string]map[string]string{
+		c.UserID: {
+			"ed25519:" + c.DeviceID: signature,
+		},
+	}
+}
+
+// MustQueryKeys queries the device keys of the users, and fails the test unless every device's keys are signed
+// by the device. Returns the devices, which are remembered for MustShareRoomKey and for checking the senders
+// of encrypted events.
+func (c *E2EEClient) MustQueryKeys(t *testing.T, userIDs ...string) []Device {
+	t.Helper()
+	deviceKeys := make(map[string][]string, len(userIDs))
+	for _, userID := range userIDs {
+		deviceKeys[userID] = []string{}
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys": deviceKeys,
+	}))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	var devices []Device
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, userID := range userIDs {
+		body.Get("device_keys." + GjsonEscape(userID)).ForEach(func(deviceID, keys gjson.Result) bool {
+			dev := Device{
+				UserID:     userID,
+				DeviceID:   deviceID.Str,
+				Ed25519:    id.Ed25519(keys.Get("keys." + GjsonEscape("ed25519:"+deviceID.Str)).Str),
+				Curve25519: id.Curve25519(keys.Get("keys." + GjsonEscape("curve25519:"+deviceID.Str)).Str),
+			}
+			if keys.Get("user_id").Str != userID || keys.Get("device_id").Str != deviceID.Str {
+				t.Fatalf("MustQueryKeys: device keys for %s %s are for %s %s", userID, deviceID.Str, keys.Get("user_id").Str, keys.Get("device_id").Str)
+			}
+			ok, err := olm.VerifySignatureJSON(json.RawMessage(keys.Raw), id.UserID(userID), deviceID.Str, dev.Ed25519)
+			if !ok {
+				t.Fatalf("MustQueryKeys: device keys for %s %s are not signed by the device: %v", userID, deviceID.Str, err)
+			}
+			if c.devices[userID] == nil {
+				c.devices[userID] = make(map[string]Device)
+			}
+			c.devices[userID][dev.DeviceID] = dev
+			devices = append(devices, dev)
+			return true
+		})
+	}
+	return devices
+}
+
+// MustClaimOneTimeKey claims a signed one-time key for the device, and fails the test unless the device signed it.
+func (c *E2EEClient) MustClaimOneTimeKey(t *testing.T, dev Device) id.Curve25519 {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "claim"}, WithJSONBody(t, map[string]interface{}{
+		"one_time_keys": map[string]map[string]string{
+			dev.UserID: {
+				dev.DeviceID: "signed_curve25519",
+			},
+		},
+	}))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	var otk gjson.Result
+	body.Get("one_time_keys." + GjsonEscape(dev.UserID) + "." + GjsonEscape(dev.DeviceID)).ForEach(func(keyID, key gjson.Result) bool {
+		otk = key
+		return false
+	})
+	if !otk.Exists() {
+		t.Fatalf("MustClaimOneTimeKey: no one-time keys left for %s %s: %s", dev.UserID, dev.DeviceID, body.Raw)
+	}
+	ok, err := olm.VerifySignatureJSON(json.RawMessage(otk.Raw), id.UserID(dev.UserID), dev.DeviceID, dev.Ed25519)
+	if !ok {
+		t.Fatalf("MustClaimOneTimeKey: one-time key for %s %s is not signed by the device: %v", dev.UserID, dev.DeviceID, err)
+	}
+	return id.Curve25519(otk.Get("key").Str)
+}
+
+// MustStartOlmSession claims a one-time key for the device and creates a new Olm session with it. Messages
+// sent to the device will use this session until the device replies on another one.
+func (c *E2EEClient) MustStartOlmSession(t *testing.T, dev Device) {
+	t.Helper()
+	otk := c.MustClaimOneTimeKey(t, dev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, err := c.account.NewOutboundSession(dev.Curve25519, otk)
+	if err != nil {
+		t.Fatalf("MustStartOlmSession: failed to create session with %s %s: %s", dev.UserID, dev.DeviceID, err)
+	}
+	c.olmSessions[dev.Curve25519] = append([]*olm.Session{session}, c.olmSessions[dev.Curve25519]...)
+}
+
+// MustSendEncryptedToDevice sends an Olm encrypted to-device event to the device, starting an Olm session with
+// the device first if there isn't one.
+func (c *E2EEClient) MustSendEncryptedToDevice(t *testing.T, dev Device, evType string, content interface{}) {
+	t.Helper()
+	c.mu.Lock()
+	hasSession := len(c.olmSessions[dev.Curve25519]) > 0
+	c.mu.Unlock()
+	if !hasSession {
+		c.MustStartOlmSession(t, dev)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":      evType,
+		"content":   content,
+		"sender":    c.UserID,
+		"recipient": dev.UserID,
+		"recipient_keys": map[string]string{
+			"ed25519": dev.Ed25519.String(),
+		},
+		"keys": map[string]string{
+			"ed25519": c.Ed25519.String(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("MustSendEncryptedToDevice: failed to marshal payload: %s", err)
+	}
+	c.mu.Lock()
+	msgType, ciphertext := c.olmSessions[dev.Curve25519][0].Encrypt(payload)
+	c.mu.Unlock()
+	c.txnID++
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "sendToDevice", "m.room.encrypted", strconv.Itoa(c.txnID)}, WithJSONBody(t, map[string]interface{}{
+		"messages": map[string]map[string]interface{}{
+			dev.UserID: {
+				dev.DeviceID: map[string]interface{}{
+					"algorithm":  OlmAlgorithm,
+					"sender_key": c.Curve25519.String(),
+					"ciphertext": map[string]interface{}{
+						dev.Curve25519.String(): map[string]interface{}{
+							"type": msgType,
+							"body": string(ciphertext),
+						},
+					},
+				},
+			},
+		},
+	}))
+}
+
+// DecryptToDevice decrypts an m.room.encrypted to-device event sent with Olm, creating a new Olm session if
+// the event starts one. m.room_key events are remembered so the room events they are for can be decrypted.
+func (c *E2EEClient) DecryptToDevice(ev gjson.Result) (DecryptedEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ev.Get("type").Str != "m.room.encrypted" || ev.Get("content.algorithm").Str != OlmAlgorithm {
+		return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: not an Olm encrypted event: %s", ev.Raw)
+	}
+	senderKey := id.Curve25519(ev.Get("content.sender_key").Str)
+	ciphertext := ev.Get("content.ciphertext." + GjsonEscape(c.Curve25519.String()))
+	if !ciphertext.Exists() {
+		return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: event is not encrypted for this device: %s", ev.Raw)
+	}
+	body := ciphertext.Get("body").Str
+	if decrypted, ok := c.decryptedToDevice[body]; ok {
+		return decrypted, nil
+	}
+	msgType := id.OlmMsgType(ciphertext.Get("type").Int())
+	plaintext, err := c.decryptOlm(senderKey, msgType, body)
+	if err != nil {
+		return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: %w", err)
+	}
+	payload := gjson.ParseBytes(plaintext)
+	if payload.Get("sender").Str != ev.Get("sender").Str {
+		return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: payload sender %s does not match event sender %s", payload.Get("sender").Str, ev.Get("sender").Str)
+	}
+	if payload.Get("recipient").Str != c.UserID || payload.Get("recipient_keys.ed25519").Str != c.Ed25519.String() {
+		return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: payload is not for this device: %s", payload.Raw)
+	}
+	// if we know the sending device, check the payload claims to be from it
+	for _, dev := range c.devices[payload.Get("sender").Str] {
+		if dev.Curve25519 == senderKey && payload.Get("keys.ed25519").Str != dev.Ed25519.String() {
+			return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: payload ed25519 key does not match device %s", dev.DeviceID)
+		}
+	}
+	decrypted := DecryptedEvent{
+		Sender:    payload.Get("sender").Str,
+		SenderKey: senderKey,
+		Type:      payload.Get("type").Str,
+		Content:   payload.Get("content"),
+	}
+	if decrypted.Type == "m.room_key" && decrypted.Content.Get("algorithm").Str == MegolmAlgorithm {
+		session, err := olm.NewInboundGroupSession([]byte(decrypted.Content.Get("session_key").Str))
+		if err != nil {
+			return DecryptedEvent{}, fmt.Errorf("DecryptToDevice: invalid m.room_key: %w", err)
+		}
+		key := groupSessionKey(decrypted.Content.Get("room_id").Str, senderKey, decrypted.Content.Get("session_id").Str)
+		c.inboundGroupSessions[key] = session
+	}
+	c.decryptedToDevice[body] = decrypted
+	return decrypted, nil
+}
+
+// decryptOlm decrypts the message with an existing Olm session with the sender, or a new session if it is a
+// pre-key message which doesn't match any of them. The caller must hold c.mu.
+func (c *E2EEClient) decryptOlm(senderKey id.Curve25519, msgType id.OlmMsgType, body string) ([]byte, error) {
+	sessions := c.olmSessions[senderKey]
+	for i, session := range sessions {
+		if msgType == id.OlmMsgTypePreKey {
+			matches, err := session.MatchesInboundSessionFrom(senderKey.String(), body)
+			if err != nil || !matches {
+				continue
+			}
+		}
+		plaintext, err := session.Decrypt(body, msgType)
+		if err != nil {
+			if msgType == id.OlmMsgTypePreKey {
+				return nil, fmt.Errorf("failed to decrypt pre-key message on matching session: %w", err)
+			}
+			continue
+		}
+		// move the session to the front, so replies use it
+		c.olmSessions[senderKey] = append([]*olm.Session{session}, append(sessions[:i:i], sessions[i+1:]...)...)
+		return plaintext, nil
+	}
+	if msgType != id.OlmMsgTypePreKey {
+		return nil, fmt.Errorf("no Olm session with %s can decrypt the message", senderKey)
+	}
+	session, err := c.account.NewInboundSessionFrom(senderKey, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound Olm session with %s: %w", senderKey, err)
+	}
+	if err = c.account.RemoveOneTimeKeys(session); err != nil {
+		return nil, fmt.Errorf("failed to remove used one-time key: %w", err)
+	}
+	plaintext, err := session.Decrypt(body, msgType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt pre-key message: %w", err)
+	}
+	c.olmSessions[senderKey] = append([]*olm.Session{session}, sessions...)
+	return plaintext, nil
+}
+
+// MustShareRoomKey sends the key for the client's Megolm session in the room to each device as an m.room_key
+// to-device event, creating the session if there isn't one. Room events sent with MustSendMegolm can then be
+// decrypted by those devices.
+func (c *E2EEClient) MustShareRoomKey(t *testing.T, roomID string, devices []Device) {
+	t.Helper()
+	c.mu.Lock()
+	session := c.outboundGroupSession(roomID)
+	content := map[string]interface{}{
+		"algorithm":   MegolmAlgorithm,
+		"room_id":     roomID,
+		"session_id":  session.ID(),
+		"session_key": session.Key(),
+	}
+	c.mu.Unlock()
+	for _, dev := range devices {
+		c.MustSendEncryptedToDevice(t, dev, "m.room_key", content)
+	}
+}
+
+// outboundGroupSession returns the client's Megolm session for the room, creating it if needed. Our own
+// room events can be decrypted too, as with real clients. The caller must hold c.mu.
+func (c *E2EEClient) outboundGroupSession(roomID string) *olm.OutboundGroupSession {
+	session, ok := c.outboundGroupSessions[roomID]
+	if ok {
+		return session
+	}
+	session = olm.NewOutboundGroupSession()
+	c.outboundGroupSessions[roomID] = session
+	inbound, err := olm.NewInboundGroupSession([]byte(session.Key()))
+	if err == nil {
+		c.inboundGroupSessions[groupSessionKey(roomID, c.Curve25519, string(session.ID()))] = inbound
+	}
+	return session
+}
+
+// MustSendMegolm encrypts the event with the client's Megolm session for the room and sends it, waiting for
+// it to come down /sync. Returns the event ID. Share the session with MustShareRoomKey so that other devices
+// can decrypt it.
+func (c *E2EEClient) MustSendMegolm(t *testing.T, roomID string, evType string, content interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":    evType,
+		"content": content,
+		"room_id": roomID,
+	})
+	if err != nil {
+		t.Fatalf("MustSendMegolm: failed to marshal payload: %s", err)
+	}
+	c.mu.Lock()
+	session := c.outboundGroupSession(roomID)
+	ciphertext := session.Encrypt(payload)
+	sessionID := session.ID()
+	c.mu.Unlock()
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.encrypted",
+		Content: map[string]interface{}{
+			"algorithm":  MegolmAlgorithm,
+			"sender_key": c.Curve25519.String(),
+			"device_id":  c.DeviceID,
+			"session_id": sessionID,
+			"ciphertext": string(ciphertext),
+		},
+	})
+}
+
+// DecryptMegolm decrypts an m.room.encrypted room event sent with Megolm, using a room key received earlier
+// via DecryptToDevice.
+func (c *E2EEClient) DecryptMegolm(ev gjson.Result) (DecryptedEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ev.Get("type").Str != "m.room.encrypted" || ev.Get("content.algorithm").Str != MegolmAlgorithm {
+		return DecryptedEvent{}, fmt.Errorf("DecryptMegolm: not a Megolm encrypted event: %s", ev.Raw)
+	}
+	roomID := ev.Get("room_id").Str
+	senderKey := id.Curve25519(ev.Get("content.sender_key").Str)
+	sessionID := ev.Get("content.session_id").Str
+	session, ok := c.inboundGroupSessions[groupSessionKey(roomID, senderKey, sessionID)]
+	if !ok {
+		return DecryptedEvent{}, fmt.Errorf("DecryptMegolm: no room key for session %s from %s in %s", sessionID, senderKey, roomID)
+	}
+	plaintext, _, err := session.Decrypt([]byte(ev.Get("content.ciphertext").Str))
+	if err != nil {
+		return DecryptedEvent{}, fmt.Errorf("DecryptMegolm: failed to decrypt %s: %w", ev.Get("event_id").Str, err)
+	}
+	payload := gjson.ParseBytes(plaintext)
+	if payload.Get("room_id").Str != roomID {
+		return DecryptedEvent{}, fmt.Errorf("DecryptMegolm: payload is for room %s but the event is in %s", payload.Get("room_id").Str, roomID)
+	}
+	return DecryptedEvent{
+		EventID:   ev.Get("event_id").Str,
+		Sender:    ev.Get("sender").Str,
+		SenderKey: senderKey,
+		Type:      payload.Get("type").Str,
+		Content:   payload.Get("content"),
+	}, nil
+}
+
+// MustDecryptMegolm is DecryptMegolm which fails the test on error.
+func (c *E2EEClient) MustDecryptMegolm(t *testing.T, ev gjson.Result) DecryptedEvent {
+	t.Helper()
+	decrypted, err := c.DecryptMegolm(ev)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return decrypted
+}
+
+func groupSessionKey(roomID string, senderKey id.Curve25519, sessionID string) string {
+	return roomID + "|" + senderKey.String() + "|" + sessionID
+}
+
+// Check that the client received an Olm encrypted to-device event which passes the check function once
+// decrypted. Reports an encrypted to-device event which cannot be decrypted if none pass.
+func (c *E2EEClient) SyncToDeviceDecrypted(check func(DecryptedEvent) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var decryptErr error
+		err := loopArray(topLevelSyncJSON, "to_device.events", func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.room.encrypted" {
+				return false
+			}
+			decrypted, err := c.DecryptToDevice(ev)
+			if err != nil {
+				decryptErr = err
+				return false
+			}
+			return check(decrypted)
+		})
+		if err == nil {
+			return nil
+		}
+		if decryptErr != nil {
+			return fmt.Errorf("SyncToDeviceDecrypted: %s", decryptErr)
+		}
+		return fmt.Errorf("SyncToDeviceDecrypted: %s", err)
+	}
+}
+
+// Check that the client received a Megolm room key for `roomID` in an encrypted to-device event.
+func (c *E2EEClient) SyncRoomKeyReceived(roomID string) SyncCheckOpt {
+	return c.SyncToDeviceDecrypted(func(ev DecryptedEvent) bool {
+		return ev.Type == "m.room_key" && ev.Content.Get("room_id").Str == roomID
+	})
+}
+
+// Check that the timeline for `roomID` has a Megolm encrypted event which passes the check function once
+// decrypted. Reports an encrypted event which cannot be decrypted if none pass.
+func (c *E2EEClient) SyncTimelineHasDecrypted(roomID string, check func(DecryptedEvent) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var decryptErr error
+		err := loopArray(topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".timeline.events", func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.room.encrypted" {
+				return false
+			}
+			// sync omits the room ID from events, but it is needed to find the room key
+			decrypted, err := c.DecryptMegolm(withRoomID(ev, roomID))
+			if err != nil {
+				decryptErr = err
+				return false
+			}
+			return check(decrypted)
+		})
+		if err == nil {
+			return nil
+		}
+		if decryptErr != nil {
+			return fmt.Errorf("SyncTimelineHasDecrypted(%s): %s", roomID, decryptErr)
+		}
+		return fmt.Errorf("SyncTimelineHasDecrypted(%s): %s", roomID, err)
+	}
+}
+
+// withRoomID returns the event with its room_id set, if it isn't already.
+func withRoomID(ev gjson.Result, roomID string) gjson.Result {
+	if ev.Get("room_id").Exists() {
+		return ev
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(ev.Raw), &obj); err != nil {
+		return ev
+	}
+	obj["room_id"] = roomID
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return ev
+	}
+	return gjson.ParseBytes(data)
+}
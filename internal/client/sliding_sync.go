@@ -0,0 +1,439 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Sort orders for sliding sync lists
+const (
+	SlidingSyncSortByRecency           = "by_recency"
+	SlidingSyncSortByName              = "by_name"
+	SlidingSyncSortByNotificationLevel = "by_notification_level"
+)
+
+// SlidingSyncReq contains the request body and query parameters of a sliding sync (MSC3575) request. The empty
+// struct `SlidingSyncReq{}` is valid but returns no rooms, so include at least one list or room subscription e.g:
+//
+//	client.SlidingSyncReq{
+//	    Lists: []client.SlidingSyncList{{
+//	        Ranges:        [][2]int64{{0, 10}},
+//	        Sort:          []string{client.SlidingSyncSortByRecency},
+//	        RequiredState: [][2]string{{"m.room.member", "*"}},
+//	        TimelineLimit: 5,
+//	    }},
+//	    RoomSubscriptions: map[string]client.RoomSubscription{
+//	        roomID: {TimelineLimit: 10},
+//	    },
+//	    Extensions: &client.SlidingSyncExtensions{
+//	        ToDevice: &client.SlidingSyncToDeviceExtension{Enabled: true},
+//	    },
+//	}
+type SlidingSyncReq struct {
+	// The position in the stream to continue from, returned as `pos` in an earlier response. This is a query
+	// parameter rather than part of the body.
+	Pos string `json:"-"`
+	// How long to wait for new data, in milliseconds. By default, this is 1000 for Complement testing.
+	TimeoutMillis string `json:"-"`
+	// The sliding windows of rooms to return, which are referred to by their index in responses.
+	Lists []SlidingSyncList `json:"lists,omitempty"`
+	// Rooms to return regardless of whether they are in a list, keyed by room ID.
+	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions,omitempty"`
+	// Room IDs to stop returning as room subscriptions.
+	UnsubscribeRooms []string `json:"unsubscribe_rooms,omitempty"`
+	// Additional data to return, which are omitted by default.
+	Extensions *SlidingSyncExtensions `json:"extensions,omitempty"`
+}
+
+// SlidingSyncList is a sorted list of rooms, of which only the rooms in `Ranges` are returned.
+type SlidingSyncList struct {
+	// Inclusive ranges of list positions to return e.g [[0, 9]] for the first 10 rooms.
+	Ranges [][2]int64 `json:"ranges"`
+	// How to order the list, falling back to later sort orders if rooms are equal.
+	Sort []string `json:"sort,omitempty"`
+	// The state events to return for each room, as [event type, state key] pairs. "*" matches anything.
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	// The number of timeline events to return for each room. 0 returns none.
+	TimelineLimit int `json:"timeline_limit"`
+	// Which rooms to include in the list. All rooms are included if nil.
+	Filters *SlidingSyncFilters `json:"filters,omitempty"`
+	// Return every room in the list, ignoring Ranges.
+	SlowGetAllRooms bool `json:"slow_get_all_rooms,omitempty"`
+}
+
+// SlidingSyncFilters restricts the rooms in a sliding sync list. Nil fields do not filter.
+type SlidingSyncFilters struct {
+	IsDM         *bool    `json:"is_dm,omitempty"`
+	Spaces       []string `json:"spaces,omitempty"`
+	IsEncrypted  *bool    `json:"is_encrypted,omitempty"`
+	IsInvite     *bool    `json:"is_invite,omitempty"`
+	IsTombstoned *bool    `json:"is_tombstoned,omitempty"`
+	RoomTypes    []string `json:"room_types,omitempty"`
+	NotRoomTypes []string `json:"not_room_types,omitempty"`
+	RoomNameLike string   `json:"room_name_like,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	NotTags      []string `json:"not_tags,omitempty"`
+}
+
+// RoomSubscription requests a room regardless of the lists it is in.
+type RoomSubscription struct {
+	// The state events to return, as [event type, state key] pairs. "*" matches anything.
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	// The number of timeline events to return. 0 returns none.
+	TimelineLimit int `json:"timeline_limit"`
+}
+
+// SlidingSyncExtensions enables additional data in sliding sync responses.
+type SlidingSyncExtensions struct {
+	ToDevice    *SlidingSyncToDeviceExtension `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncExtension         `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncExtension         `json:"account_data,omitempty"`
+	Typing      *SlidingSyncExtension         `json:"typing,omitempty"`
+	Receipts    *SlidingSyncExtension         `json:"receipts,omitempty"`
+}
+
+// SlidingSyncExtension enables an extension which has no other options.
+type SlidingSyncExtension struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SlidingSyncToDeviceExtension enables to-device events, which are acknowledged separately from the rest of the
+// response. MustSlidingSyncUntil advances Since automatically.
+type SlidingSyncToDeviceExtension struct {
+	Enabled bool `json:"enabled"`
+	// The `next_batch` from the last to_device extension response.
+	Since string `json:"since,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// SlidingSyncResult is a sliding sync response, along with the room lists as the client sees them after
+// applying all the list operations received so far.
+type SlidingSyncResult struct {
+	// The top-level response JSON
+	Response gjson.Result
+	// The room IDs in each list, in list order. Positions which the client has not been told about are "".
+	Lists [][]string
+}
+
+// SlidingSyncCheckOpt is a functional option for use with MustSlidingSyncUntil which should return <nil> if
+// the response satisfies the check, else return a human friendly error.
+type SlidingSyncCheckOpt func(clientUserID string, res SlidingSyncResult) error
+
+// MustSlidingSync performs a single sliding sync request. To sync until something happens, see
+// `MustSlidingSyncUntil`.
+//
+// Fails the test if the request does not return 200 OK.
+// Returns the top-level parsed response JSON as well as the `pos` token from the response.
+func (c *CSAPI) MustSlidingSync(t *testing.T, req SlidingSyncReq) (gjson.Result, string) {
+	t.Helper()
+	query := url.Values{
+		"timeout": []string{"1000"},
+	}
+	if req.TimeoutMillis != "" {
+		query["timeout"] = []string{req.TimeoutMillis}
+	}
+	if req.Pos != "" {
+		query["pos"] = []string{req.Pos}
+	}
+	res := c.MustDoFunc(
+		t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc3575", "sync"},
+		WithQueries(query), WithJSONBody(t, req),
+	)
+	body := ParseJSON(t, res)
+	result := gjson.ParseBytes(body)
+	pos := GetJSONFieldStr(t, body, "pos")
+	return result, pos
+}
+
+// MustSlidingSyncUntil blocks and continually calls sliding sync (advancing the pos and to-device since
+// tokens) until all the check functions return no error. Returns the final pos token. Checks behave as they do
+// for MustSyncUntil, and there is a check function for each /sync one so the same scenario can be asserted
+// over both APIs e.g:
+//
+//	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, roomID))
+//	alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+//	    RoomSubscriptions: map[string]client.RoomSubscription{roomID: {TimelineLimit: 10}},
+//	}, client.SlidingSyncJoinedTo(alice.UserID, roomID))
+//
+// List checks see the lists built up over all the responses in this call, so if `req` has a pos token the
+// lists only contain the rooms which changed since then.
+//
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSlidingSyncUntil(t *testing.T, req SlidingSyncReq, checks ...SlidingSyncCheckOpt) string {
+	t.Helper()
+	start := time.Now()
+	numResponsesReturned := 0
+	checkers := make([]struct {
+		check SlidingSyncCheckOpt
+		errs  []string
+	}, len(checks))
+	for i := range checks {
+		checkers[i].check = checks[i]
+	}
+	printErrors := func() string {
+		err := "Checkers:\n"
+		for _, c := range checkers {
+			err += strings.Join(c.errs, "\n")
+			err += ", \n"
+		}
+		return err
+	}
+	var lists [][]string
+	for {
+		if time.Since(start) > c.SyncUntilTimeout {
+			t.Fatalf("%s MustSlidingSyncUntil: timed out after %v. Seen %d sliding sync responses. %s", c.UserID, time.Since(start), numResponsesReturned, printErrors())
+		}
+		response, pos := c.MustSlidingSync(t, req)
+		req.Pos = pos
+		if req.Extensions != nil && req.Extensions.ToDevice != nil {
+			if nextBatch := response.Get("extensions.to_device.next_batch"); nextBatch.Exists() {
+				toDevice := *req.Extensions.ToDevice
+				toDevice.Since = nextBatch.Str
+				extensions := *req.Extensions
+				extensions.ToDevice = &toDevice
+				req.Extensions = &extensions
+			}
+		}
+		numResponsesReturned += 1
+		var err error
+		lists, err = applyListOps(lists, response.Get("lists"))
+		if err != nil {
+			t.Fatalf("%s MustSlidingSyncUntil: response #%d has invalid list operations: %s", c.UserID, numResponsesReturned, err)
+		}
+		res := SlidingSyncResult{
+			Response: response,
+			Lists:    lists,
+		}
+
+		for i := 0; i < len(checkers); i++ {
+			err := checkers[i].check(c.UserID, res)
+			if err == nil {
+				// check passed, removed from checkers
+				checkers = append(checkers[:i], checkers[i+1:]...)
+				i--
+			} else {
+				checkers[i].errs = append(checkers[i].errs, fmt.Sprintf("[t=%v] Response #%d: %s", time.Since(start), numResponsesReturned, err))
+			}
+		}
+		if len(checkers) == 0 {
+			// every checker has passed!
+			return req.Pos
+		}
+	}
+}
+
+// applyListOps applies the SYNC, INSERT, DELETE and INVALIDATE operations in the response lists to the room IDs
+// in each list, returning the new lists.
+func applyListOps(lists [][]string, responseLists gjson.Result) ([][]string, error) {
+	for i, list := range responseLists.Array() {
+		for len(lists) <= i {
+			lists = append(lists, nil)
+		}
+		rooms := lists[i]
+		for _, op := range list.Get("ops").Array() {
+			switch op.Get("op").Str {
+			case "SYNC", "INVALIDATE":
+				start, end := op.Get("range.0").Int(), op.Get("range.1").Int()
+				if start < 0 || end < start {
+					return nil, fmt.Errorf("list %d: %s has invalid range %s", i, op.Get("op").Str, op.Get("range").Raw)
+				}
+				for int64(len(rooms)) <= end {
+					rooms = append(rooms, "")
+				}
+				roomIDs := op.Get("room_ids").Array()
+				for j := start; j <= end; j++ {
+					rooms[j] = ""
+					if op.Get("op").Str == "SYNC" && j-start < int64(len(roomIDs)) {
+						rooms[j] = roomIDs[j-start].Str
+					}
+				}
+			case "DELETE":
+				index := op.Get("index").Int()
+				if index < 0 {
+					return nil, fmt.Errorf("list %d: DELETE has invalid index %d", i, index)
+				}
+				// the position may not be known if the request continued from an earlier pos
+				for int64(len(rooms)) <= index {
+					rooms = append(rooms, "")
+				}
+				rooms = append(rooms[:index], rooms[index+1:]...)
+			case "INSERT":
+				index := op.Get("index").Int()
+				if index < 0 {
+					return nil, fmt.Errorf("list %d: INSERT has invalid index %d", i, index)
+				}
+				for int64(len(rooms)) < index {
+					rooms = append(rooms, "")
+				}
+				rooms = append(rooms[:index], append([]string{op.Get("room_id").Str}, rooms[index:]...)...)
+			default:
+				return nil, fmt.Errorf("list %d: unknown op %s", i, op.Raw)
+			}
+		}
+		// the list never has more rooms than the count
+		if count := list.Get("count"); count.Exists() && int64(len(rooms)) > count.Int() {
+			rooms = rooms[:count.Int()]
+		}
+		lists[i] = rooms
+	}
+	return lists, nil
+}
+
+// Check that list `listIndex` contains exactly the room IDs `roomIDs` in that order, ignoring positions the
+// client has not been told about.
+func SlidingSyncListHasRooms(listIndex int, roomIDs []string) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		if listIndex >= len(res.Lists) {
+			return fmt.Errorf("SlidingSyncListHasRooms: no list %d", listIndex)
+		}
+		var got []string
+		for _, roomID := range res.Lists[listIndex] {
+			if roomID != "" {
+				got = append(got, roomID)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(roomIDs, ",") {
+			return fmt.Errorf("SlidingSyncListHasRooms: list %d has rooms %v, want %v", listIndex, got, roomIDs)
+		}
+		return nil
+	}
+}
+
+// Check that the count of rooms in list `listIndex` is `count`.
+func SlidingSyncListCount(listIndex int, count int64) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		got := res.Response.Get(fmt.Sprintf("lists.%d.count", listIndex))
+		if !got.Exists() {
+			return fmt.Errorf("SlidingSyncListCount: no count for list %d", listIndex)
+		}
+		if got.Int() != count {
+			return fmt.Errorf("SlidingSyncListCount: list %d has count %d, want %d", listIndex, got.Int(), count)
+		}
+		return nil
+	}
+}
+
+// Check that the timeline for `roomID` has an event which passes the check function.
+func SlidingSyncTimelineHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		err := loopArray(res.Response, "rooms."+GjsonEscape(roomID)+".timeline", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncTimelineHas(%s): %s", roomID, err)
+	}
+}
+
+// Check that the timeline for `roomID` has an event which matches the event ID.
+func SlidingSyncTimelineHasEventID(roomID string, eventID string) SlidingSyncCheckOpt {
+	return SlidingSyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == eventID
+	})
+}
+
+// Check that the required state for `roomID` has an event which passes the check function. Only the state
+// events matching the list or subscription's RequiredState are returned.
+func SlidingSyncStateHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		err := loopArray(res.Response, "rooms."+GjsonEscape(roomID)+".required_state", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncStateHas(%s): %s", roomID, err)
+	}
+}
+
+// Checks that `userID` gets invited to `roomID`.
+//
+// As with SyncInvitedTo, if the client is the person being invited the invite_state is inspected, otherwise
+// the timeline is inspected for the invite.
+func SlidingSyncInvitedTo(userID, roomID string) SlidingSyncCheckOpt {
+	isInvite := func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "invite"
+	}
+	return func(clientUserID string, res SlidingSyncResult) error {
+		if clientUserID == userID {
+			err := loopArray(res.Response, "rooms."+GjsonEscape(roomID)+".invite_state", isInvite)
+			if err != nil {
+				return fmt.Errorf("SlidingSyncInvitedTo(%s): %s", roomID, err)
+			}
+			return nil
+		}
+		return SlidingSyncTimelineHas(roomID, isInvite)(clientUserID, res)
+	}
+}
+
+// Check that `userID` gets joined to `roomID` by inspecting the timeline and required state for a membership
+// event. Request `m.room.member` state or a non-zero timeline limit for the room so the event is returned.
+//
+// Additional checks can be passed to narrow down the check, all must pass.
+func SlidingSyncJoinedTo(userID, roomID string, checks ...func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return membershipCheck("SlidingSyncJoinedTo", userID, roomID, "join", checks)
+}
+
+// Check that `userID` left `roomID` by inspecting the timeline and required state for a membership event.
+func SlidingSyncLeftFrom(userID, roomID string) SlidingSyncCheckOpt {
+	return membershipCheck("SlidingSyncLeftFrom", userID, roomID, "leave", nil)
+}
+
+func membershipCheck(name, userID, roomID, membership string, checks []func(gjson.Result) bool) SlidingSyncCheckOpt {
+	checkMembership := func(ev gjson.Result) bool {
+		if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != userID || ev.Get("content.membership").Str != membership {
+			return false
+		}
+		for _, check := range checks {
+			if !check(ev) {
+				return false
+			}
+		}
+		return true
+	}
+	return func(clientUserID string, res SlidingSyncResult) error {
+		firstErr := loopArray(res.Response, "rooms."+GjsonEscape(roomID)+".timeline", checkMembership)
+		if firstErr == nil {
+			return nil
+		}
+		secondErr := loopArray(res.Response, "rooms."+GjsonEscape(roomID)+".required_state", checkMembership)
+		if secondErr == nil {
+			return nil
+		}
+		return fmt.Errorf("%s(%s): %s & %s", name, roomID, firstErr, secondErr)
+	}
+}
+
+// Check that the response has a to-device event which passes the check function. Requires the to_device
+// extension.
+func SlidingSyncToDeviceHas(check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		err := loopArray(res.Response, "extensions.to_device.events", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncToDeviceHas: %s", err)
+	}
+}
+
+// Calls the `check` function for each global account data event, and returns with success if the
+// `check` function returns true for at least one event. Requires the account_data extension.
+func SlidingSyncGlobalAccountDataHas(check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		return loopArray(res.Response, "extensions.account_data.global", check)
+	}
+}
+
+// Calls the `check` function for each account data event for the given room, and returns with success if
+// the `check` function returns true for at least one event. Requires the account_data extension.
+func SlidingSyncRoomAccountDataHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResult) error {
+		err := loopArray(res.Response, "extensions.account_data.rooms."+GjsonEscape(roomID), check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SlidingSyncRoomAccountDataHas(%s): %s", roomID, err)
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestApplyListOps(t *testing.T) {
+	testCases := []struct {
+		name      string
+		lists     [][]string
+		responses []string
+		want      [][]string
+	}{
+		{
+			name: "SYNC fills the range",
+			responses: []string{
+				`[{"count":3,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a","!b","!c"]}]}]`,
+			},
+			want: [][]string{{"!a", "!b", "!c"}},
+		},
+		{
+			name: "DELETE then INSERT moves a room",
+			responses: []string{
+				`[{"count":3,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a","!b","!c"]}]}]`,
+				`[{"count":3,"ops":[{"op":"DELETE","index":2},{"op":"INSERT","index":0,"room_id":"!c"}]}]`,
+			},
+			want: [][]string{{"!c", "!a", "!b"}},
+		},
+		{
+			name: "INVALIDATE forgets the range",
+			responses: []string{
+				`[{"count":3,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a","!b","!c"]}]}]`,
+				`[{"count":3,"ops":[{"op":"INVALIDATE","range":[1,2]}]}]`,
+			},
+			want: [][]string{{"!a", "", ""}},
+		},
+		{
+			name: "lists are truncated to the count",
+			responses: []string{
+				`[{"count":2,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a","!b"]}]}]`,
+			},
+			want: [][]string{{"!a", "!b"}},
+		},
+		{
+			name: "multiple lists",
+			responses: []string{
+				`[{"count":1,"ops":[{"op":"SYNC","range":[0,0],"room_ids":["!a"]}]},{"count":1,"ops":[{"op":"SYNC","range":[0,0],"room_ids":["!b"]}]}]`,
+				`[{"count":1},{"count":2,"ops":[{"op":"INSERT","index":0,"room_id":"!c"}]}]`,
+			},
+			want: [][]string{{"!a"}, {"!c", "!b"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lists := tc.lists
+			for _, res := range tc.responses {
+				var err error
+				lists, err = applyListOps(lists, gjson.Parse(res))
+				if err != nil {
+					t.Fatalf("applyListOps returned error: %s", err)
+				}
+			}
+			if !reflect.DeepEqual(lists, tc.want) {
+				t.Errorf("applyListOps: got %v want %v", lists, tc.want)
+			}
+		})
+	}
+	if _, err := applyListOps(nil, gjson.Parse(`[{"ops":[{"op":"UNKNOWN"}]}]`)); err == nil {
+		t.Errorf("applyListOps: expected an error for an unknown op")
+	}
+}
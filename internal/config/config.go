@@ -6,8 +6,10 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"regexp"
@@ -16,6 +18,16 @@ import (
 	"time"
 )
 
+// ExternalHomeserver is a homeserver which is already running outside of a container.
+type ExternalHomeserver struct {
+	// The client-server API URL e.g http://localhost:8008
+	BaseURL string `json:"base_url"`
+	// The federation API URL e.g https://localhost:8448
+	FedBaseURL string `json:"fed_base_url"`
+	// The registration shared secret, used to register blueprint users via the admin API.
+	RegistrationSharedSecret string `json:"registration_shared_secret"`
+}
+
 type HostMount struct {
 	HostPath      string
 	ContainerPath string
@@ -38,6 +50,18 @@ type Complement struct {
 	// Default: 0
 	// Description: If 1, always prints the Homeserver container logs even on success.
 	AlwaysPrintServerLogs bool
+	// Name: COMPLEMENT_REPORT_DIR
+	// Description: If set, writes a report of the test run to this directory as JUnit XML and JSON, in
+	// `complement-$pkg.xml` and `complement-$pkg.json`. Each test which deploys a blueprint has an entry with
+	// its result, duration, blueprint names, deploy timings, the logs of every homeserver container and a
+	// transcript of the CS API requests made by its clients. Run `go test -json` and merge its output into the
+	// report with `cmd/complement-report` to add every other test and subtest, and the output of failed tests.
+	ReportDir string
+	// Name: COMPLEMENT_HAR_DIR
+	// Description: If set, records all CS API and federation traffic of each test which deploys a blueprint,
+	// and writes it to this directory as a HAR-like JSON file named after the test. These files can be
+	// replayed against another homeserver with `cmd/har-replay`.
+	HARDir string
 	// Name: COMPLEMENT_SHARE_ENV_PREFIX
 	// Description: If set, all environment variables on the host with this prefix will be shared with
 	// every homeserver, with the prefix removed. For example, if the prefix was `FOO_` then setting
@@ -54,9 +78,14 @@ type Complement struct {
 	// Description: A list of space separated blueprint names to not clean up after running. For example,
 	// `one_to_one_room alice` would not delete the homeserver images for the blueprints `alice` and
 	// `one_to_one_room`. This can speed up homeserver runs if you frequently run the same base image
-	// over and over again. If the base image changes, this should not be set as it means an older version
-	// of the base image will be used for the named blueprints.
+	// over and over again. Images are labelled with a hash of the blueprint and the base image they were
+	// built from, so if either changes the kept images are rebuilt automatically.
 	KeepBlueprints []string
+	// Name: COMPLEMENT_BLUEPRINT_DIR
+	// Description: A directory of blueprints written as JSON or YAML files, which are loaded in addition to
+	// the blueprints in `internal/b`. Field names match the Go `b.Blueprint` struct and are case-insensitive.
+	// Blueprints can be checked and built ahead of time with `cmd/blueprint`.
+	BlueprintDir string
 	// Name: COMPLEMENT_HOST_MOUNTS
 	// Description: A list of semicolon separated host mounts to mount on every container. The structure
 	// of the mount is `host-path:container-path:[ro]` for example `/path/on/host:/path/on/container` - you
@@ -69,6 +98,14 @@ type Complement struct {
 	// for the `hs1` homeserver in blueprints, but not any other homeserver (e.g `hs2`). This matching
 	// is case-insensitive. This allows Complement to test how different homeserver implementations work with each other.
 	BaseImageURIs map[string]string
+	// Name: COMPLEMENT_DEPLOYMENT_POOL_SIZE
+	// Default: 0
+	// Description: The number of warm, already running deployments to keep for each blueprint which tests
+	// deploy. When a test deploys a blueprint with a warm deployment, it gets it straight away rather than
+	// waiting for containers to start, which speeds up tests which run in parallel. Deployments are discarded
+	// when the test ends and replaced in the background. If 0, deployments are not pooled. Deployments with
+	// application services are never pooled, as they are configured by the test.
+	DeploymentPoolSize int
 
 	// The namespace for all complement created blueprints and deployments
 	PackageNamespace string
@@ -80,11 +117,39 @@ type Complement struct {
 	BestEffort bool
 
 	// Name: COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT
-	// Default: host.docker.internal
+	// Default: host.docker.internal, or host.containers.internal if using Podman, or localhost if using COMPLEMENT_EXTERNAL_HOMESERVERS
 	// Description: The hostname of Complement from the perspective of a Homeserver running inside a container.
 	// This can be useful for container runtimes using another hostname to access the host from a container,
-	// like Podman that uses `host.containers.internal` instead.
+	// like Podman that uses `host.containers.internal` instead. External homeservers are assumed to run on the
+	// same host as Complement, so set this if they run elsewhere, e.g in a container or on another machine.
 	HostnameRunningComplement string
+
+	// Name: COMPLEMENT_EXTERNAL_HOMESERVERS
+	// Description: The path to a JSON file of homeservers which are already running, e.g under a debugger, to use
+	// instead of running homeservers in containers. The file maps HS names in blueprints to their URLs and
+	// registration shared secret, for example
+	// `{"hs1": {"base_url": "http://localhost:8008", "fed_base_url": "https://localhost:8448", "registration_shared_secret": "secret"}}`.
+	// The homeserver's server name must be the HS name. Blueprints are applied to the running homeserver every
+	// time a test deploys them, so users are reused between tests. COMPLEMENT_BASE_IMAGE is not required when this is set.
+	ExternalHomeservers map[string]ExternalHomeserver
+
+	// Name: COMPLEMENT_CONTAINER_RUNTIME
+	// Default: docker
+	// Description: The container runtime to run homeservers with, either `docker` or `podman`. Docker is
+	// configured via the usual `DOCKER_*` environment variables. Podman is used via its Docker-compatible
+	// API service (`podman system service`), which works rootless. The socket is taken from `CONTAINER_HOST`,
+	// or defaults to the rootless socket in `$XDG_RUNTIME_DIR`, or `/run/podman/podman.sock` when running as root.
+	ContainerRuntime string
+
+	// Name: COMPLEMENT_NETWORK_TOOLS_IMAGE
+	// Default: nicolaka/netshoot:v0.11
+	// Description: The Docker image used to partition homeservers from each other and degrade the links
+	// between them, via `Deployment.Partition` and `Deployment.DegradeLink`. It is run in the network namespace
+	// of each homeserver container, so the homeserver image doesn't need any tools installed. It must contain
+	// `sh`, `ip`, `iptables` and `tc`, and is pulled the first time it is needed, so tests which partition
+	// homeservers need access to the registry unless the image is pulled in advance. To run the same image on
+	// every run, set this to a digest e.g. `nicolaka/netshoot@sha256:...`.
+	NetworkToolsImage string
 }
 
 var hsRegex = regexp.MustCompile(`COMPLEMENT_BASE_IMAGE_(.+)=(.+)$`)
@@ -98,13 +163,17 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	cfg.DebugLoggingEnabled = os.Getenv("COMPLEMENT_DEBUG") == "1"
 	cfg.AlwaysPrintServerLogs = os.Getenv("COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS") == "1"
 	cfg.EnvVarsPropagatePrefix = os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
+	cfg.ReportDir = os.Getenv("COMPLEMENT_REPORT_DIR")
+	cfg.HARDir = os.Getenv("COMPLEMENT_HAR_DIR")
 	cfg.SpawnHSTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_SPAWN_HS_TIMEOUT_SECS", 30)) * time.Second
 	if os.Getenv("COMPLEMENT_VERSION_CHECK_ITERATIONS") != "" {
 		fmt.Fprintln(os.Stderr, "Deprecated: COMPLEMENT_VERSION_CHECK_ITERATIONS will be removed in a later version. Use COMPLEMENT_SPAWN_HS_TIMEOUT_SECS instead which does the same thing and is clearer.")
 		// each iteration had a 50ms sleep between tries so the timeout is 50 * iteration ms
 		cfg.SpawnHSTimeout = time.Duration(50*parseEnvWithDefault("COMPLEMENT_VERSION_CHECK_ITERATIONS", 100)) * time.Millisecond
 	}
+	cfg.DeploymentPoolSize = parseEnvWithDefault("COMPLEMENT_DEPLOYMENT_POOL_SIZE", 0)
 	cfg.KeepBlueprints = strings.Split(os.Getenv("COMPLEMENT_KEEP_BLUEPRINTS"), " ")
+	cfg.BlueprintDir = os.Getenv("COMPLEMENT_BLUEPRINT_DIR")
 	var err error
 	hostMounts := os.Getenv("COMPLEMENT_HOST_MOUNTS")
 	if hostMounts != "" {
@@ -113,7 +182,13 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 			panic("COMPLEMENT_HOST_MOUNTS parse error: " + err.Error())
 		}
 	}
-	if cfg.BaseImageURI == "" {
+	if path := os.Getenv("COMPLEMENT_EXTERNAL_HOMESERVERS"); path != "" {
+		cfg.ExternalHomeservers, err = newExternalHomeservers(path)
+		if err != nil {
+			panic("COMPLEMENT_EXTERNAL_HOMESERVERS parse error: " + err.Error())
+		}
+	}
+	if cfg.BaseImageURI == "" && len(cfg.ExternalHomeservers) == 0 {
 		panic("COMPLEMENT_BASE_IMAGE must be set")
 	}
 	// Parse HS specific base images
@@ -136,9 +211,23 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 		panic("package namespace must be set")
 	}
 
+	cfg.ContainerRuntime = os.Getenv("COMPLEMENT_CONTAINER_RUNTIME")
+	if cfg.ContainerRuntime == "" {
+		cfg.ContainerRuntime = "docker"
+	}
+
+	cfg.NetworkToolsImage = os.Getenv("COMPLEMENT_NETWORK_TOOLS_IMAGE")
+	if cfg.NetworkToolsImage == "" {
+		cfg.NetworkToolsImage = "nicolaka/netshoot:v0.11"
+	}
+
 	HostnameRunningComplement := os.Getenv("COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT")
 	if HostnameRunningComplement != "" {
 		cfg.HostnameRunningComplement = HostnameRunningComplement
+	} else if len(cfg.ExternalHomeservers) > 0 {
+		cfg.HostnameRunningComplement = "localhost"
+	} else if cfg.ContainerRuntime == "podman" {
+		cfg.HostnameRunningComplement = "host.containers.internal"
 	} else {
 		cfg.HostnameRunningComplement = "host.docker.internal"
 	}
@@ -184,6 +273,23 @@ func parseEnvWithDefault(key string, def int) int {
 	return def
 }
 
+func newExternalHomeservers(path string) (map[string]ExternalHomeserver, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hses map[string]ExternalHomeserver
+	if err = json.Unmarshal(data, &hses); err != nil {
+		return nil, err
+	}
+	for hsName, hs := range hses {
+		if hs.BaseURL == "" {
+			return nil, fmt.Errorf("homeserver '%s' has no base_url", hsName)
+		}
+	}
+	return hses, nil
+}
+
 func newHostMounts(mounts []string) ([]HostMount, error) {
 	var hostMounts []HostMount
 	for _, m := range mounts {
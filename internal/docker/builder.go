@@ -14,6 +14,7 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
@@ -21,7 +22,6 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 
@@ -38,18 +38,18 @@ var (
 const complementLabel = "complement_context"
 
 type Builder struct {
-	Config *config.Complement
-	Docker *client.Client
+	Config  *config.Complement
+	Runtime Runtime
 }
 
 func NewBuilder(cfg *config.Complement) (*Builder, error) {
-	cli, err := client.NewEnvClient()
+	rt, err := NewRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &Builder{
-		Docker: cli,
-		Config: cfg,
+		Runtime: rt,
+		Config:  cfg,
 	}, nil
 }
 
@@ -77,7 +77,7 @@ func (d *Builder) Cleanup() {
 
 // removeImages removes all images with `complementLabel`.
 func (d *Builder) removeNetworks() error {
-	networks, err := d.Docker.NetworkList(context.Background(), types.NetworkListOptions{
+	networks, err := d.Runtime.NetworkList(context.Background(), types.NetworkListOptions{
 		Filters: label(
 			complementLabel,
 			"complement_pkg="+d.Config.PackageNamespace,
@@ -87,7 +87,7 @@ func (d *Builder) removeNetworks() error {
 		return err
 	}
 	for _, nw := range networks {
-		err = d.Docker.NetworkRemove(context.Background(), nw.ID)
+		err = d.Runtime.NetworkRemove(context.Background(), nw.ID)
 		if err != nil {
 			return err
 		}
@@ -97,7 +97,7 @@ func (d *Builder) removeNetworks() error {
 
 // removeImages removes all images with `complementLabel`.
 func (d *Builder) removeImages() error {
-	images, err := d.Docker.ImageList(context.Background(), types.ImageListOptions{
+	images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
 		Filters: label(
 			complementLabel,
 			"complement_pkg="+d.Config.PackageNamespace,
@@ -106,6 +106,7 @@ func (d *Builder) removeImages() error {
 	if err != nil {
 		return err
 	}
+	var failed []types.ImageSummary
 	for _, img := range images {
 		// we only clean up localhost/complement images else if someone docker pulls
 		// an anonymous snapshot we might incorrectly nuke it :( any non-localhost
@@ -133,11 +134,22 @@ func (d *Builder) removeImages() error {
 			d.log("Keeping image created from blueprint %s", bprintName)
 			continue
 		}
-		_, err = d.Docker.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
+		_, err = d.Runtime.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
 			Force: true,
 		})
 		if err != nil {
-			return err
+			failed = append(failed, img)
+		}
+	}
+	// images of blueprints with a parent depend on the parent's images, so the parent can't be removed
+	// until the child has been. Try again now the children have gone.
+	for _, img := range failed {
+		_, err = d.Runtime.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			// a kept blueprint may extend this one
+			d.log("Not cleaning up image created from blueprint %s: %s", img.Labels["complement_blueprint"], err)
 		}
 	}
 
@@ -146,7 +158,7 @@ func (d *Builder) removeImages() error {
 
 // removeContainers removes all containers with `complementLabel`.
 func (d *Builder) removeContainers() error {
-	containers, err := d.Docker.ContainerList(context.Background(), types.ContainerListOptions{
+	containers, err := d.Runtime.ContainerList(context.Background(), types.ContainerListOptions{
 		All: true,
 		Filters: label(
 			complementLabel,
@@ -157,7 +169,7 @@ func (d *Builder) removeContainers() error {
 		return err
 	}
 	for _, c := range containers {
-		err = d.Docker.ContainerRemove(context.Background(), c.ID, types.ContainerRemoveOptions{
+		err = d.Runtime.ContainerRemove(context.Background(), c.ID, types.ContainerRemoveOptions{
 			Force: true,
 		})
 		if err != nil {
@@ -167,8 +179,11 @@ func (d *Builder) removeContainers() error {
 	return nil
 }
 
+// ConstructBlueprintIfNotExist constructs the blueprint unless there are already images for it which were built
+// from the same blueprint definition and base images. Stale images, e.g from COMPLEMENT_KEEP_BLUEPRINTS, are
+// removed and built again.
 func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
-	images, err := d.Docker.ImageList(context.Background(), types.ImageListOptions{
+	images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
 		Filters: label(
 			"complement_blueprint="+bprint.Name,
 			"complement_pkg="+d.Config.PackageNamespace,
@@ -177,17 +192,48 @@ func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
 	if err != nil {
 		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ImageList: %w", bprint.Name, err)
 	}
-	if len(images) == 0 {
-		err = d.ConstructBlueprint(bprint)
+	if len(images) > 0 {
+		if len(b.Flatten(bprint).Homeservers) == 0 {
+			// the blueprint only names pre-built images, e.g from account-snapshot, so they can't be rebuilt
+			return nil
+		}
+		hash, err := d.BlueprintHash(bprint)
 		if err != nil {
-			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ConstructBlueprint: %w", bprint.Name, err)
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): %w", bprint.Name, err)
+		}
+		stale := len(images) < len(b.Flatten(bprint).Homeservers)
+		for _, img := range images {
+			if img.Labels[hashLabel] != hash {
+				stale = true
+			}
+		}
+		if !stale {
+			return nil
 		}
+		log.Printf("Images for blueprint %s are stale as the blueprint or base image has changed, rebuilding", bprint.Name)
+		if err = d.RemoveBlueprintImages(d.Config.PackageNamespace, bprint.Name, false); err != nil {
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to remove stale images: %w", bprint.Name, err)
+		}
+	}
+	err = d.ConstructBlueprint(bprint)
+	if err != nil {
+		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ConstructBlueprint: %w", bprint.Name, err)
 	}
 	return nil
 }
 
 func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
-	errs := d.construct(bprint)
+	if bprint.Parent != nil {
+		// the homeservers in the parent are built on top of its images, so they must exist first
+		if err := d.ConstructBlueprintIfNotExist(*bprint.Parent); err != nil {
+			return fmt.Errorf("failed to construct parent blueprint: %w", err)
+		}
+	}
+	hash, err := d.BlueprintHash(bprint)
+	if err != nil {
+		return err
+	}
+	errs := d.construct(bprint, hash)
 	if len(errs) > 0 {
 		for _, err := range errs {
 			d.log("could not construct blueprint: %s", err)
@@ -198,11 +244,11 @@ func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
 	// wait a bit for images/containers to show up in 'image ls'
 	foundImages := false
 	var images []types.ImageSummary
-	var err error
+	numHomeservers := len(b.Flatten(bprint).Homeservers)
 	waitTime := 5 * time.Second
 	startTime := time.Now()
 	for time.Since(startTime) < waitTime {
-		images, err = d.Docker.ImageList(context.Background(), types.ImageListOptions{
+		images, err = d.Runtime.ImageList(context.Background(), types.ImageListOptions{
 			Filters: label(
 				complementLabel,
 				"complement_blueprint="+bprint.Name,
@@ -212,7 +258,7 @@ func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
 		if err != nil {
 			return err
 		}
-		if len(images) < len(bprint.Homeservers) {
+		if len(images) < numHomeservers {
 			time.Sleep(100 * time.Millisecond)
 		} else {
 			foundImages = true
@@ -233,26 +279,31 @@ func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
 	return nil
 }
 
-// construct all Homeservers sequentially then commits them
-func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
+// construct all Homeservers sequentially then commits them, labelled with the blueprint hash
+func (d *Builder) construct(bprint b.Blueprint, hash string) (errs []error) {
 	d.log("Constructing blueprint '%s'", bprint.Name)
 
-	networkName, err := createNetworkIfNotExists(d.Docker, d.Config.PackageNamespace, bprint.Name)
+	networkName, err := createNetworkIfNotExists(d.Runtime, d.Config.PackageNamespace, bprint.Name)
 	if err != nil {
 		return []error{err}
 	}
 
 	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
-	results := make([]result, len(bprint.Homeservers))
-	for i, hs := range bprint.Homeservers {
-		res := d.constructHomeserver(bprint.Name, runner, hs, networkName)
+	parentImageIDs, err := d.parentImages(bprint, runner)
+	if err != nil {
+		return []error{err}
+	}
+	homeservers := homeserversToConstruct(bprint)
+	results := make([]result, len(homeservers))
+	for i, hs := range homeservers {
+		res := d.constructHomeserver(bprint.Name, runner, hs, networkName, parentImageIDs[hs.Name])
 		if res.err != nil {
 			errs = append(errs, res.err)
 			if res.containerID != "" {
 				// something went wrong, but we have a container which may have interesting logs
-				printLogs(d.Docker, res.containerID, res.contextStr)
+				printLogs(d.Runtime, res.containerID, res.contextStr)
 			}
-			if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, types.ContainerRemoveOptions{
+			if delErr := d.Runtime.ContainerRemove(context.Background(), res.containerID, types.ContainerRemoveOptions{
 				Force: true,
 			}); delErr != nil {
 				d.log("%s: failed to remove container which failed to deploy: %s", res.contextStr, delErr)
@@ -262,7 +313,7 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		}
 		// kill the container
 		defer func(r result) {
-			containerInfo, err := d.Docker.ContainerInspect(context.Background(), r.containerID)
+			containerInfo, err := d.Runtime.ContainerInspect(context.Background(), r.containerID)
 
 			if err != nil {
 				d.log("%s : Can't get status of %s", r.contextStr, r.containerID)
@@ -274,7 +325,7 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 				return
 			}
 
-			killErr := d.Docker.ContainerKill(context.Background(), r.containerID, "KILL")
+			killErr := d.Runtime.ContainerKill(context.Background(), r.containerID, "KILL")
 			if killErr != nil {
 				d.log("%s : Failed to kill container %s: %s\n", r.contextStr, r.containerID, killErr)
 			}
@@ -317,19 +368,30 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			labels[k] = v
 		}
 
+		// Store room refs so blueprints which extend this one can use the rooms
+		for k, v := range labelsForRoomRefs(runner.RoomRefs()) {
+			labels[k] = v
+		}
+
+		// Store what the image was built from, so stale images can be detected
+		labels[hashLabel] = hash
+		if bprint.Parent != nil {
+			labels[parentLabel] = bprint.Parent.Name
+		}
+
 		// Stop the container before we commit it.
 		// This gives it chance to shut down gracefully.
 		// If we don't do this, then e.g. Postgres databases can become corrupt, which
 		// then incurs a slow recovery process when we use the blueprint later.
 		d.log("%s: Stopping container: %s", res.contextStr, res.containerID)
 		timeout := 10 * time.Second
-		d.Docker.ContainerStop(context.Background(), res.containerID, &timeout)
+		d.Runtime.ContainerStop(context.Background(), res.containerID, &timeout)
 
 		// Log again so we can see the timings.
 		d.log("%s: Stopped container: %s", res.contextStr, res.containerID)
 
 		// commit the container
-		commit, err := d.Docker.ContainerCommit(context.Background(), res.containerID, types.ContainerCommitOptions{
+		commit, err := d.Runtime.ContainerCommit(context.Background(), res.containerID, types.ContainerCommitOptions{
 			Author:    "Complement",
 			Pause:     true,
 			Reference: "localhost/complement:" + res.contextStr,
@@ -357,11 +419,69 @@ func toChanges(labels map[string]string) []string {
 	return changes
 }
 
-// construct this homeserver and execute its instructions, keeping the container alive.
-func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName string) result {
+// parentImages returns the image ID of each homeserver in the blueprint's parent, keyed by HS name, and adds the
+// users and rooms in those images to the runner. Returns an empty map if the blueprint has no parent.
+func (d *Builder) parentImages(bprint b.Blueprint, runner *instruction.Runner) (map[string]string, error) {
+	imageIDs := make(map[string]string)
+	if bprint.Parent == nil {
+		return imageIDs, nil
+	}
+	images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(
+			"complement_blueprint="+bprint.Parent.Name,
+			"complement_pkg="+d.Config.PackageNamespace,
+		),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to ImageList parent blueprint %s: %w", bprint.Name, bprint.Parent.Name, err)
+	}
+	for _, img := range images {
+		imageIDs[img.Labels["complement_hs_name"]] = img.ID
+		deviceIDs := deviceIDsFromLabels(img.Labels)
+		for userID, token := range tokensFromLabels(img.Labels) {
+			runner.AddUser(userID, token, deviceIDs[userID])
+		}
+		roomIDs, hsNames := roomRefsFromLabels(img.Labels)
+		for ref, roomID := range roomIDs {
+			runner.AddRoomRef(ref, roomID, hsNames[ref])
+		}
+	}
+	for _, hs := range b.Flatten(*bprint.Parent).Homeservers {
+		if _, ok := imageIDs[hs.Name]; !ok {
+			return nil, fmt.Errorf("%s: parent blueprint %s has no image for %s", bprint.Name, bprint.Parent.Name, hs.Name)
+		}
+	}
+	return imageIDs, nil
+}
+
+// homeserversToConstruct returns the homeservers to run instructions for. For blueprints with a parent, this
+// includes every homeserver in the parent, with only the users, rooms and application services this blueprint adds.
+func homeserversToConstruct(bprint b.Blueprint) []b.Homeserver {
+	if bprint.Parent == nil {
+		return bprint.Homeservers
+	}
+	var homeservers []b.Homeserver
+	for _, flatHS := range b.Flatten(bprint).Homeservers {
+		hs := b.Homeserver{
+			Name:         flatHS.Name,
+			BaseImageURI: flatHS.BaseImageURI,
+		}
+		for _, ownHS := range bprint.Homeservers {
+			if ownHS.Name == hs.Name {
+				hs = ownHS
+			}
+		}
+		homeservers = append(homeservers, hs)
+	}
+	return homeservers
+}
+
+// construct this homeserver and execute its instructions, keeping the container alive. If parentImageID is set,
+// the homeserver is started from that image instead of the base image.
+func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName, parentImageID string) result {
 	contextStr := fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hs.Name)
 	d.log("%s : constructing homeserver...\n", contextStr)
-	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkName)
+	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkName, parentImageID)
 	if err != nil {
 		log.Printf("%s : failed to deployBaseImage: %s\n", contextStr, err)
 		containerID := ""
@@ -389,26 +509,32 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 }
 
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
-func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkName string) (*HomeserverDeployment, error) {
+func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkName, parentImageID string) (*HomeserverDeployment, error) {
 	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
-	var baseImageURI string
-	if hs.BaseImageURI == nil {
-		baseImageURI = d.Config.BaseImageURI
-		// Use HS specific base image if defined
-		if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
-			baseImageURI = uri
-		}
-	} else {
-		baseImageURI = *hs.BaseImageURI
+	baseImageURI := d.baseImageURI(hs)
+	if parentImageID != "" {
+		baseImageURI = parentImageID
 	}
 
 	return deployImage(
-		d.Docker, baseImageURI, fmt.Sprintf("complement_%s", contextStr),
+		d.Runtime, baseImageURI, fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
 		networkName, d.Config,
 	)
 }
 
+// baseImageURI returns the image to build the homeserver from.
+func (d *Builder) baseImageURI(hs b.Homeserver) string {
+	if hs.BaseImageURI != nil {
+		return *hs.BaseImageURI
+	}
+	// Use HS specific base image if defined
+	if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
+		return uri
+	}
+	return d.Config.BaseImageURI
+}
+
 // Multilines label using Dockerfile syntax is unsupported, let's inline \n instead
 func generateASRegistrationYaml(as b.ApplicationService) string {
 	return fmt.Sprintf("id: %s\\n", as.ID) +
@@ -427,7 +553,7 @@ func generateASRegistrationYaml(as b.ApplicationService) string {
 
 // createNetworkIfNotExists creates a docker network and returns its name.
 // Name is guaranteed not to be empty when err == nil
-func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName string) (networkName string, err error) {
+func createNetworkIfNotExists(docker Runtime, pkgNamespace, blueprintName string) (networkName string, err error) {
 	// check if a network already exists for this blueprint
 	nws, err := docker.NetworkList(context.Background(), types.NetworkListOptions{
 		Filters: label(
@@ -469,7 +595,7 @@ func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName
 	return networkName, nil
 }
 
-func printLogs(docker *client.Client, containerID, contextStr string) {
+func printLogs(docker Runtime, containerID, contextStr string) {
 	reader, err := docker.ContainerLogs(context.Background(), containerID, types.ContainerLogsOptions{
 		ShowStderr: true,
 		ShowStdout: true,
@@ -485,6 +611,22 @@ func printLogs(docker *client.Client, containerID, contextStr string) {
 	log.Printf("============== %s : END LOGS ==============\n\n\n", contextStr)
 }
 
+// containerLogs returns the stdout and stderr logs of a container.
+func containerLogs(docker Runtime, containerID string) (string, error) {
+	reader, err := docker.ContainerLogs(context.Background(), containerID, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     false,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	_, err = stdcopy.StdCopy(&buf, &buf, reader)
+	return buf.String(), err
+}
+
 func endpoints(p nat.PortMap, csPort, ssPort int) (baseURL, fedBaseURL string, err error) {
 	csapiPort := fmt.Sprintf("%d/tcp", csPort)
 	csapiPortInfo, ok := p[nat.Port(csapiPort)]
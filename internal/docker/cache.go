@@ -0,0 +1,266 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+const (
+	// The label on blueprint images with the hash of the blueprint and base images they were built from
+	hashLabel = "complement_blueprint_hash"
+	// The label on blueprint images with the name of the blueprint they extend, if any
+	parentLabel = "complement_blueprint_parent"
+)
+
+// BlueprintImage is a committed image of a homeserver in a blueprint.
+type BlueprintImage struct {
+	ID        string
+	Tags      []string
+	Pkg       string
+	Blueprint string
+	// The blueprint this one extends, if any
+	Parent  string
+	HSName  string
+	Hash    string
+	Created time.Time
+	Size    int64
+}
+
+// BlueprintHash returns a hash of the blueprint, including its parents, and the IDs of the base images it is
+// built from. If either changes, images built from the blueprint are stale and need to be built again.
+func (d *Builder) BlueprintHash(bprint b.Blueprint) (string, error) {
+	baseImageIDs := make(map[string]string)
+	for _, hs := range b.Flatten(bprint).Homeservers {
+		uri := d.baseImageURI(hs)
+		img, _, err := d.Runtime.ImageInspectWithRaw(context.Background(), uri)
+		if err != nil {
+			return "", fmt.Errorf("BlueprintHash(%s): failed to inspect base image %s: %w", bprint.Name, uri, err)
+		}
+		baseImageIDs[hs.Name] = img.ID
+	}
+	normalised, err := normaliseForHash(bprint)
+	if err != nil {
+		return "", fmt.Errorf("BlueprintHash(%s): %w", bprint.Name, err)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"blueprint":   normalised,
+		"base_images": baseImageIDs,
+	})
+	if err != nil {
+		return "", fmt.Errorf("BlueprintHash(%s): %w", bprint.Name, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// normaliseForHash returns the blueprint as generic JSON without the application service tokens, which are
+// randomly generated each time a blueprint is validated. JSON objects are marshalled with sorted keys, so this
+// is stable.
+func normaliseForHash(bprint b.Blueprint) (interface{}, error) {
+	data, err := json.Marshal(bprint)
+	if err != nil {
+		return nil, err
+	}
+	var val interface{}
+	if err = json.Unmarshal(data, &val); err != nil {
+		return nil, err
+	}
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			delete(vv, "HSToken")
+			delete(vv, "ASToken")
+			for _, child := range vv {
+				strip(child)
+			}
+		case []interface{}:
+			for _, child := range vv {
+				strip(child)
+			}
+		}
+	}
+	strip(val)
+	return val, nil
+}
+
+// BlueprintImages returns all blueprint images in this builder's package namespace, or every package if allPkgs
+// is true, sorted by package, blueprint and HS name.
+func (d *Builder) BlueprintImages(allPkgs bool) ([]BlueprintImage, error) {
+	filters := []string{complementLabel, "complement_blueprint"}
+	if !allPkgs {
+		filters = append(filters, "complement_pkg="+d.Config.PackageNamespace)
+	}
+	images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(filters...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BlueprintImages: failed to ImageList: %w", err)
+	}
+	result := make([]BlueprintImage, len(images))
+	for i, img := range images {
+		result[i] = BlueprintImage{
+			ID:        img.ID,
+			Tags:      img.RepoTags,
+			Pkg:       img.Labels["complement_pkg"],
+			Blueprint: img.Labels["complement_blueprint"],
+			Parent:    img.Labels[parentLabel],
+			HSName:    img.Labels["complement_hs_name"],
+			Hash:      img.Labels[hashLabel],
+			Created:   time.Unix(img.Created, 0),
+			Size:      img.Size,
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Pkg != result[j].Pkg {
+			return result[i].Pkg < result[j].Pkg
+		}
+		if result[i].Blueprint != result[j].Blueprint {
+			return result[i].Blueprint < result[j].Blueprint
+		}
+		return result[i].HSName < result[j].HSName
+	})
+	return result, nil
+}
+
+// RemoveBlueprintImages removes the images of the blueprint in the package namespace, along with the images of
+// any blueprints which extend it as they are built on top of them. Images without a blueprint hash, such as
+// snapshots of deployments, can't be rebuilt so are only removed with their parent if removeSnapshots is true.
+// Otherwise nothing is removed and an error is returned.
+func (d *Builder) RemoveBlueprintImages(pkg, blueprintName string, removeSnapshots bool) error {
+	if !removeSnapshots {
+		snapshots, err := d.snapshotDescendants(pkg, blueprintName, make(map[string]bool))
+		if err != nil {
+			return err
+		}
+		if len(snapshots) > 0 {
+			return fmt.Errorf(
+				"RemoveBlueprintImages(%s): refusing to remove blueprints %v which extend it, as they can't be rebuilt",
+				blueprintName, snapshots,
+			)
+		}
+	}
+	return d.removeBlueprintImages(pkg, blueprintName)
+}
+
+// snapshotDescendants returns the names of the blueprints which extend the blueprint, directly or indirectly,
+// and have images without a blueprint hash.
+func (d *Builder) snapshotDescendants(pkg, blueprintName string, seen map[string]bool) ([]string, error) {
+	children, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(
+			parentLabel+"="+blueprintName,
+			"complement_pkg="+pkg,
+		),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("RemoveBlueprintImages(%s): failed to ImageList: %w", blueprintName, err)
+	}
+	var snapshots []string
+	for _, img := range children {
+		child := img.Labels["complement_blueprint"]
+		if child == blueprintName || seen[child] {
+			continue
+		}
+		seen[child] = true
+		if img.Labels[hashLabel] == "" {
+			snapshots = append(snapshots, child)
+		}
+		descendants, err := d.snapshotDescendants(pkg, child, seen)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, descendants...)
+	}
+	return snapshots, nil
+}
+
+func (d *Builder) removeBlueprintImages(pkg, blueprintName string) error {
+	children, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(
+			parentLabel+"="+blueprintName,
+			"complement_pkg="+pkg,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("RemoveBlueprintImages(%s): failed to ImageList: %w", blueprintName, err)
+	}
+	removedChildren := make(map[string]bool)
+	for _, img := range children {
+		child := img.Labels["complement_blueprint"]
+		if child == blueprintName || removedChildren[child] {
+			continue
+		}
+		removedChildren[child] = true
+		if err = d.removeBlueprintImages(pkg, child); err != nil {
+			return err
+		}
+	}
+	images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(
+			"complement_blueprint="+blueprintName,
+			"complement_pkg="+pkg,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("RemoveBlueprintImages(%s): failed to ImageList: %w", blueprintName, err)
+	}
+	for _, img := range images {
+		d.log("Removing image %s of blueprint %s (%s)", img.ID, blueprintName, img.Labels["complement_hs_name"])
+		_, err = d.Runtime.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return fmt.Errorf("RemoveBlueprintImages(%s): failed to ImageRemove %s: %w", blueprintName, img.ID, err)
+		}
+	}
+	return nil
+}
+
+// ExportBlueprintImages writes the images of the blueprint in this builder's package namespace, and the images
+// of its parents, to w as a tar archive which can be loaded with `docker load`.
+func (d *Builder) ExportBlueprintImages(bprint b.Blueprint, w io.Writer) error {
+	var refs []string
+	for _, bp := range b.Lineage(bprint) {
+		images, err := d.Runtime.ImageList(context.Background(), types.ImageListOptions{
+			Filters: label(
+				"complement_blueprint="+bp.Name,
+				"complement_pkg="+d.Config.PackageNamespace,
+			),
+		})
+		if err != nil {
+			return fmt.Errorf("ExportBlueprintImages(%s): failed to ImageList: %w", bp.Name, err)
+		}
+		if len(images) == 0 {
+			return fmt.Errorf("ExportBlueprintImages(%s): no images have been built for blueprint %s", bprint.Name, bp.Name)
+		}
+		for _, img := range images {
+			// save by tag where possible so the tag is loaded too
+			ref := img.ID
+			for _, tag := range img.RepoTags {
+				if strings.HasPrefix(tag, "localhost/complement:") {
+					ref = tag
+					break
+				}
+			}
+			refs = append(refs, ref)
+		}
+	}
+	rc, err := d.Runtime.ImageSave(context.Background(), refs)
+	if err != nil {
+		return fmt.Errorf("ExportBlueprintImages(%s): failed to ImageSave: %w", bprint.Name, err)
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
@@ -23,12 +23,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 
 	"github.com/docker/docker/api/types"
@@ -37,6 +35,7 @@ import (
 	"github.com/docker/docker/api/types/network"
 
 	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/har"
 )
 
 const (
@@ -47,20 +46,24 @@ const (
 
 type Deployer struct {
 	DeployNamespace string
-	Docker          *client.Client
+	Runtime         Runtime
 	Counter         int
-	debugLogging    bool
-	config          *config.Complement
+	// Optional map of application service ID to the URL the homeserver should use to contact it.
+	// This replaces the URL in the blueprint, which is useful when the application service is
+	// listening on a port chosen at runtime e.g appservice.Server.
+	ApplicationServiceURLs map[string]string
+	debugLogging           bool
+	config                 *config.Complement
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
-	cli, err := client.NewEnvClient()
+	rt, err := NewRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &Deployer{
 		DeployNamespace: deployNamespace,
-		Docker:          cli,
+		Runtime:         rt,
 		debugLogging:    cfg.DebugLoggingEnabled,
 		config:          cfg,
 	}, nil
@@ -80,7 +83,7 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		HS:            make(map[string]*HomeserverDeployment),
 		Config:        d.config,
 	}
-	images, err := d.Docker.ImageList(ctx, types.ImageListOptions{
+	images, err := d.Runtime.ImageList(ctx, types.ImageListOptions{
 		Filters: label(
 			"complement_pkg="+d.config.PackageNamespace,
 			"complement_blueprint="+blueprintName,
@@ -92,7 +95,7 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if len(images) == 0 {
 		return nil, fmt.Errorf("Deploy: No images have been built for blueprint %s", blueprintName)
 	}
-	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName)
+	networkName, err := createNetworkIfNotExists(d.Runtime, d.config.PackageNamespace, blueprintName)
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
@@ -110,19 +113,26 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		contextStr := img.Labels["complement_context"]
 		hsName := img.Labels["complement_hs_name"]
 		asIDToRegistrationMap := asIDToRegistrationFromLabels(img.Labels)
+		for asID, asURL := range d.ApplicationServiceURLs {
+			if registration, ok := asIDToRegistrationMap[asID]; ok {
+				asIDToRegistrationMap[asID] = registrationWithURL(registration, asURL)
+			}
+		}
 
 		// TODO: Make CSAPI port configurable
 		deployment, err := deployImage(
-			d.Docker, img.ID, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter),
+			d.Runtime, img.ID, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter),
 			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkName, d.config,
 		)
 		if err != nil {
 			if deployment != nil && deployment.ContainerID != "" {
 				// print logs to help debug
-				printLogs(d.Docker, deployment.ContainerID, contextStr)
+				printLogs(d.Runtime, deployment.ContainerID, contextStr)
 			}
 			return fmt.Errorf("Deploy: Failed to deploy image %+v : %w", img, err)
 		}
+		// the labels on the container still have the blueprint URLs, so use the registrations we wrote
+		deployment.ApplicationServices = asIDToRegistrationMap
 		mu.Lock()
 		d.log("%s -> %s (%s)\n", contextStr, deployment.BaseURL, deployment.ContainerID)
 		dep.HS[hsName] = deployment
@@ -148,24 +158,28 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
 	for _, hsDep := range dep.HS {
+		if hsDep.ContainerID == "" {
+			// external homeservers are left running
+			continue
+		}
 		if printServerLogs {
 			// If we want the logs we gracefully stop the containers to allow
 			// the logs to be flushed.
 			timeout := 1 * time.Second
-			err := d.Docker.ContainerStop(context.Background(), hsDep.ContainerID, &timeout)
+			err := d.Runtime.ContainerStop(context.Background(), hsDep.ContainerID, &timeout)
 			if err != nil {
 				log.Printf("Destroy: Failed to destroy container %s : %s\n", hsDep.ContainerID, err)
 			}
 
-			printLogs(d.Docker, hsDep.ContainerID, hsDep.ContainerID)
+			printLogs(d.Runtime, hsDep.ContainerID, hsDep.ContainerID)
 		} else {
-			err := d.Docker.ContainerKill(context.Background(), hsDep.ContainerID, "KILL")
+			err := d.Runtime.ContainerKill(context.Background(), hsDep.ContainerID, "KILL")
 			if err != nil {
 				log.Printf("Destroy: Failed to destroy container %s : %s\n", hsDep.ContainerID, err)
 			}
 		}
 
-		err := d.Docker.ContainerRemove(context.Background(), hsDep.ContainerID, types.ContainerRemoveOptions{
+		err := d.Runtime.ContainerRemove(context.Background(), hsDep.ContainerID, types.ContainerRemoveOptions{
 			Force: true,
 		})
 		if err != nil {
@@ -176,51 +190,192 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
 
 // Restart a homeserver deployment.
 func (d *Deployer) Restart(hsDep *HomeserverDeployment, cfg *config.Complement) error {
-	ctx := context.Background()
-	err := d.Docker.ContainerStop(ctx, hsDep.ContainerID, &cfg.SpawnHSTimeout)
+	if err := d.Stop(hsDep, cfg); err != nil {
+		return fmt.Errorf("Restart: %w", err)
+	}
+	if err := d.Start(hsDep, cfg); err != nil {
+		return fmt.Errorf("Restart: %w", err)
+	}
+	return nil
+}
+
+// Stop a homeserver deployment gracefully, waiting up to SpawnHSTimeout before killing it. The container is
+// kept so it can be started again with Start.
+func (d *Deployer) Stop(hsDep *HomeserverDeployment, cfg *config.Complement) error {
+	if hsDep.ContainerID == "" {
+		return fmt.Errorf("Stop: cannot stop external homeserver at %s", hsDep.BaseURL)
+	}
+	err := d.Runtime.ContainerStop(context.Background(), hsDep.ContainerID, &cfg.SpawnHSTimeout)
+	if err != nil {
+		return fmt.Errorf("Stop: Failed to stop container %s: %s", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// Kill a homeserver deployment with SIGKILL, as if it crashed, and wait for the container to exit. The
+// container is kept so it can be started again with Start.
+func (d *Deployer) Kill(hsDep *HomeserverDeployment, cfg *config.Complement) error {
+	if hsDep.ContainerID == "" {
+		return fmt.Errorf("Kill: cannot kill external homeserver at %s", hsDep.BaseURL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SpawnHSTimeout)
+	defer cancel()
+	// register the wait before killing the container, as the kill returns before the container exits
+	waitCh, errCh := d.Runtime.ContainerWait(ctx, hsDep.ContainerID, container.WaitConditionNotRunning)
+	err := d.Runtime.ContainerKill(ctx, hsDep.ContainerID, "KILL")
+	if err != nil {
+		return fmt.Errorf("Kill: Failed to kill container %s: %s", hsDep.ContainerID, err)
+	}
+	select {
+	case <-waitCh:
+	case err = <-errCh:
+		return fmt.Errorf("Kill: Failed to wait for container %s to exit: %s", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// Pause a homeserver deployment by freezing all of its processes. Its ports stay open, but nothing responds.
+func (d *Deployer) Pause(hsDep *HomeserverDeployment) error {
+	if hsDep.ContainerID == "" {
+		return fmt.Errorf("Pause: cannot pause external homeserver at %s", hsDep.BaseURL)
+	}
+	err := d.Runtime.ContainerPause(context.Background(), hsDep.ContainerID)
+	if err != nil {
+		return fmt.Errorf("Pause: Failed to pause container %s: %s", hsDep.ContainerID, err)
+	}
+	return nil
+}
+
+// Unpause a paused homeserver deployment.
+func (d *Deployer) Unpause(hsDep *HomeserverDeployment) error {
+	if hsDep.ContainerID == "" {
+		return fmt.Errorf("Unpause: cannot unpause external homeserver at %s", hsDep.BaseURL)
+	}
+	err := d.Runtime.ContainerUnpause(context.Background(), hsDep.ContainerID)
 	if err != nil {
-		return fmt.Errorf("Restart: Failed to stop container %s: %s", hsDep.ContainerID, err)
+		return fmt.Errorf("Unpause: Failed to unpause container %s: %s", hsDep.ContainerID, err)
 	}
+	return nil
+}
 
-	err = d.Docker.ContainerStart(ctx, hsDep.ContainerID, types.ContainerStartOptions{})
+// Start a stopped homeserver deployment and wait for it to be ready. The ports of the container may change,
+// so the endpoints of the deployment and its clients are updated.
+func (d *Deployer) Start(hsDep *HomeserverDeployment, cfg *config.Complement) error {
+	if hsDep.ContainerID == "" {
+		return fmt.Errorf("Start: cannot start external homeserver at %s", hsDep.BaseURL)
+	}
+	ctx := context.Background()
+	err := d.Runtime.ContainerStart(ctx, hsDep.ContainerID, types.ContainerStartOptions{})
 	if err != nil {
-		return fmt.Errorf("Restart: Failed to start container %s: %s", hsDep.ContainerID, err)
+		return fmt.Errorf("Start: Failed to start container %s: %s", hsDep.ContainerID, err)
 	}
 
 	// Wait for the container to be ready.
-	baseURL, fedBaseURL, err := waitForPorts(ctx, d.Docker, hsDep.ContainerID)
+	baseURL, fedBaseURL, err := waitForPorts(ctx, d.Runtime, hsDep.ContainerID)
 	if err != nil {
-		return fmt.Errorf("Restart: Failed to get ports for container %s: %s", hsDep.ContainerID, err)
+		return fmt.Errorf("Start: Failed to get ports for container %s: %s", hsDep.ContainerID, err)
 	}
 	hsDep.SetEndpoints(baseURL, fedBaseURL)
 
 	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
-	_, err = waitForContainer(ctx, d.Docker, hsDep, stopTime)
+	_, err = waitForContainer(ctx, d.Runtime, hsDep, stopTime)
 	if err != nil {
-		return fmt.Errorf("Restart: Failed to restart container %s: %s", hsDep.ContainerID, err)
+		return fmt.Errorf("Start: Failed to start container %s: %s", hsDep.ContainerID, err)
 	}
 
 	return nil
 }
 
+// Snapshot stops the containers of a deployment and commits them as images of a new blueprint, which can then
+// be deployed like any other. The access tokens and device IDs of the deployment are stored as labels, as
+// they are when constructing a blueprint. Other labels, such as application service registrations and room
+// refs, are inherited from the images the deployment was made from.
+func (d *Deployer) Snapshot(dep *Deployment, blueprintName string) error {
+	ctx := context.Background()
+	images, err := d.Runtime.ImageList(ctx, types.ImageListOptions{
+		Filters: label(
+			"complement_pkg="+d.config.PackageNamespace,
+			"complement_blueprint="+blueprintName,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("Snapshot: failed to ImageList: %w", err)
+	}
+	if len(images) > 0 {
+		return fmt.Errorf("Snapshot: images already exist for blueprint %s", blueprintName)
+	}
+	for _, hsDep := range dep.HS {
+		if hsDep.ContainerID == "" {
+			return fmt.Errorf("Snapshot: cannot snapshot external homeserver at %s", hsDep.BaseURL)
+		}
+	}
+	// a snapshot with only some of the homeservers can't be deployed, so remove the images made so far on error
+	var imageIDs []string
+	removeImages := func() {
+		for _, imageID := range imageIDs {
+			_, err := d.Runtime.ImageRemove(ctx, imageID, types.ImageRemoveOptions{Force: true})
+			if err != nil {
+				d.log("Snapshot: failed to remove image %s: %s", imageID, err)
+			}
+		}
+	}
+	for hsName, hsDep := range dep.HS {
+		contextStr := fmt.Sprintf("%s.%s.%s", d.config.PackageNamespace, blueprintName, hsName)
+		labels := map[string]string{
+			complementLabel:        contextStr,
+			"complement_blueprint": blueprintName,
+			"complement_hs_name":   hsName,
+			// the images are built on top of the deployed blueprint's images, so must be removed first
+			parentLabel: dep.BlueprintName,
+			// the images can't be rebuilt from a blueprint so must never be considered stale
+			hashLabel: "",
+		}
+		for userID, token := range hsDep.AccessTokens {
+			labels["access_token_"+userID] = token
+		}
+		for userID, deviceID := range hsDep.DeviceIDs {
+			labels["device_id"+userID] = deviceID
+		}
+
+		// Stop the container gracefully before we commit it so databases aren't corrupted.
+		d.log("%s: Stopping container: %s", contextStr, hsDep.ContainerID)
+		err := d.Runtime.ContainerStop(ctx, hsDep.ContainerID, &dep.Config.SpawnHSTimeout)
+		if err != nil {
+			removeImages()
+			return fmt.Errorf("Snapshot: Failed to stop container %s: %s", hsDep.ContainerID, err)
+		}
+		commit, err := d.Runtime.ContainerCommit(ctx, hsDep.ContainerID, types.ContainerCommitOptions{
+			Author:    "Complement",
+			Reference: "localhost/complement:" + contextStr,
+			Changes:   toChanges(labels),
+		})
+		if err != nil {
+			removeImages()
+			return fmt.Errorf("Snapshot: Failed to commit container %s: %s", hsDep.ContainerID, err)
+		}
+		imageIDs = append(imageIDs, commit.ID)
+		d.log("%s: Created docker image %s\n", contextStr, strings.Replace(commit.ID, "sha256:", "", 1))
+	}
+	return nil
+}
+
+// Logs returns the stdout and stderr of a homeserver deployment's container.
+func (d *Deployer) Logs(hsDep *HomeserverDeployment) (string, error) {
+	if hsDep.ContainerID == "" {
+		return "", fmt.Errorf("Logs: cannot get logs of external homeserver at %s", hsDep.BaseURL)
+	}
+	return containerLogs(d.Runtime, hsDep.ContainerID)
+}
+
 // nolint
 func deployImage(
-	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
+	docker Runtime, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
 	asIDToRegistrationMap map[string]string, contextStr, networkName string, cfg *config.Complement,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
-	var extraHosts []string
 	var mounts []mount.Mount
 	var err error
 
-	if runtime.GOOS == "linux" {
-		// Ensure that the homeservers under test can contact the host, so they can
-		// interact with a complement-controlled test server.
-		// Note: this feature of docker landed in Docker 20.10,
-		// see https://github.com/moby/moby/pull/40007
-		extraHosts = []string{"host.docker.internal:host-gateway"}
-	}
-
 	for _, m := range cfg.HostMounts {
 		mounts = append(mounts, mount.Mount{
 			Source:   m.HostPath,
@@ -269,7 +424,7 @@ func deployImage(
 				},
 			},
 		},
-		ExtraHosts: extraHosts,
+		ExtraHosts: docker.ExtraHosts(),
 		Mounts:     mounts,
 	}, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
@@ -363,7 +518,7 @@ func deployImage(
 	return d, nil
 }
 
-func copyToContainer(docker *client.Client, containerID, path string, data []byte) error {
+func copyToContainer(docker Runtime, containerID, path string, data []byte) error {
 	// Create a fake/virtual file in memory that we can copy to the container
 	// via https://stackoverflow.com/a/52131297/796832
 	var buf bytes.Buffer
@@ -390,7 +545,7 @@ func copyToContainer(docker *client.Client, containerID, path string, data []byt
 }
 
 // Waits until a homeserver container has NAT ports assigned and returns its clientside API URL and federation API URL.
-func waitForPorts(ctx context.Context, docker *client.Client, containerID string) (baseURL string, fedBaseURL string, err error) {
+func waitForPorts(ctx context.Context, docker Runtime, containerID string) (baseURL string, fedBaseURL string, err error) {
 	// We need to hammer the inspect endpoint until the ports show up, they don't appear immediately.
 	var inspect types.ContainerJSON
 	inspectStartTime := time.Now()
@@ -412,7 +567,7 @@ func waitForPorts(ctx context.Context, docker *client.Client, containerID string
 }
 
 // Waits until a homeserver deployment is ready to serve requests.
-func waitForContainer(ctx context.Context, docker *client.Client, hsDep *HomeserverDeployment, stopTime time.Time) (iterCount int, lastErr error) {
+func waitForContainer(ctx context.Context, docker Runtime, hsDep *HomeserverDeployment, stopTime time.Time) (iterCount int, lastErr error) {
 	iterCount = 0
 
 	// If the container has a healthcheck, wait for it first
@@ -486,11 +641,14 @@ func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	req.URL.Host = newURL.Host
 	req.URL.Scheme = "https"
-	transport := &http.Transport{
+	var transport http.RoundTripper = &http.Transport{
 		TLSClientConfig: &tls.Config{
 			ServerName:         hsName,
 			InsecureSkipVerify: true,
 		},
 	}
+	if t.Deployment.HAR != nil {
+		transport = t.Deployment.HAR.Wrap(hsName, har.KindFederationOutbound, transport)
+	}
 	return transport.RoundTrip(req)
 }
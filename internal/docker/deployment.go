@@ -1,11 +1,18 @@
 package docker
 
 import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/har"
+	"github.com/matrix-org/complement/internal/report"
+	"github.com/matrix-org/complement/runtime"
 )
 
 // Deployment is the complete instantiation of a Blueprint, with running containers
@@ -18,6 +25,22 @@ type Deployment struct {
 	// A map of HS name to a HomeserverDeployment
 	HS     map[string]*HomeserverDeployment
 	Config *config.Complement
+	// The report entry for the test using this deployment, if reporting is enabled. Clients made from
+	// this deployment add their requests to the transcript, and the homeserver logs are added on Destroy.
+	Report *report.Test
+	// Records the CS API and federation traffic of the test using this deployment, if enabled.
+	// Clients made from this deployment, docker.RoundTripper and federation servers record to it.
+	HAR *har.Recorder
+	// The pool this deployment was acquired from, if any
+	pool *DeploymentPool
+
+	capsOnce sync.Once
+	caps     map[string]*runtime.Capabilities
+	capsErr  error
+
+	// The state of links between homeservers changed by Partition and DegradeLink
+	networkMu sync.Mutex
+	links     map[link]*linkState
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
@@ -41,11 +64,56 @@ func (hsDep *HomeserverDeployment) SetEndpoints(baseURL string, fedBaseURL strin
 	}
 }
 
+// Capabilities returns what each homeserver in the deployment supports, keyed by HS name. The homeservers
+// are only probed the first time this is called.
+func (d *Deployment) Capabilities() (map[string]*runtime.Capabilities, error) {
+	d.capsOnce.Do(func() {
+		caps := make(map[string]*runtime.Capabilities, len(d.HS))
+		for hsName, hsDep := range d.HS {
+			// any user will do to read /capabilities, but pick the same one each time
+			userIDs := make([]string, 0, len(hsDep.AccessTokens))
+			for userID := range hsDep.AccessTokens {
+				userIDs = append(userIDs, userID)
+			}
+			sort.Strings(userIDs)
+			var accessToken string
+			if len(userIDs) > 0 {
+				accessToken = hsDep.AccessTokens[userIDs[0]]
+			}
+			c, err := runtime.Probe(hsDep.BaseURL, hsDep.FedBaseURL, accessToken)
+			if err != nil {
+				d.capsErr = fmt.Errorf("%s: %w", hsName, err)
+				return
+			}
+			caps[hsName] = c
+		}
+		d.caps = caps
+	})
+	return d.caps, d.capsErr
+}
+
 // Destroy the entire deployment. Destroys all running containers. If `printServerLogs` is true,
 // will print container logs before killing the container.
 func (d *Deployment) Destroy(t *testing.T) {
 	t.Helper()
-	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed())
+	printServerLogs := d.Deployer.config.AlwaysPrintServerLogs || t.Failed()
+	if d.Report != nil {
+		for hsName, hsDep := range d.HS {
+			if hsDep.ContainerID == "" {
+				continue
+			}
+			logs, err := containerLogs(d.Deployer.Runtime, hsDep.ContainerID)
+			if err != nil {
+				t.Logf("Deployment.Destroy: failed to get logs for %s: %s", hsName, err)
+			}
+			d.Report.AddHomeserverLogs(d.BlueprintName, hsName, logs)
+		}
+	}
+	if d.pool != nil {
+		d.pool.release(d, printServerLogs)
+		return
+	}
+	d.Deployer.Destroy(d, printServerLogs)
 }
 
 // Client returns a CSAPI client targeting the given hsName, using the access token for the given userID.
@@ -72,7 +140,7 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 		AccessToken:      token,
 		DeviceID:         deviceID,
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           client.NewLoggedClientWithTranscript(t, hsName, d.httpClient(hsName), d.transcript()),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -80,6 +148,25 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 	return client
 }
 
+// httpClient returns the HTTP client to use for CS API requests to the given HS, or nil to use the default.
+func (d *Deployment) httpClient(hsName string) *http.Client {
+	if d.HAR == nil {
+		return nil
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: d.HAR.Wrap(hsName, har.KindCSAPI, http.DefaultTransport),
+	}
+}
+
+// transcript returns the function to pass CS API log lines to for the report, if any.
+func (d *Deployment) transcript() func(string) {
+	if d.Report == nil {
+		return nil
+	}
+	return d.Report.AddTranscript
+}
+
 // RegisterUser within a homeserver and return an authenticatedClient, Fails the test if the hsName is not found.
 func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password string, isAdmin bool) *client.CSAPI {
 	t.Helper()
@@ -90,7 +177,7 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 	}
 	client := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           client.NewLoggedClientWithTranscript(t, hsName, d.httpClient(hsName), d.transcript()),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -121,6 +208,81 @@ func (dep *Deployment) Restart(t *testing.T) error {
 			return err
 		}
 	}
+	hsNames := make([]string, 0, len(dep.HS))
+	for hsName := range dep.HS {
+		hsNames = append(hsNames, hsName)
+	}
+	if err := dep.reapplyNetwork(hsNames...); err != nil {
+		t.Errorf("Deployment.Restart: %s", err)
+		return err
+	}
 
 	return nil
 }
+
+// Stop gracefully stops a single homeserver in the deployment, waiting up to COMPLEMENT_SPAWN_HS_TIMEOUT_SECS
+// before killing it. Start it again with Start. Fails the test if the homeserver could not be stopped.
+func (d *Deployment) Stop(t *testing.T, hsName string) {
+	t.Helper()
+	hsDep := d.containerHS(t, "Deployment.Stop", hsName)
+	if err := d.Deployer.Stop(hsDep, d.Config); err != nil {
+		t.Fatalf("Deployment.Stop: %s", err)
+	}
+}
+
+// Kill sends SIGKILL to a single homeserver in the deployment, to simulate it crashing. Start it again
+// with Start. Fails the test if the homeserver could not be killed.
+func (d *Deployment) Kill(t *testing.T, hsName string) {
+	t.Helper()
+	hsDep := d.containerHS(t, "Deployment.Kill", hsName)
+	if err := d.Deployer.Kill(hsDep, d.Config); err != nil {
+		t.Fatalf("Deployment.Kill: %s", err)
+	}
+}
+
+// Pause freezes a single homeserver in the deployment, so connections to it are accepted but never
+// answered. Resume it with Unpause. Fails the test if the homeserver could not be paused.
+func (d *Deployment) Pause(t *testing.T, hsName string) {
+	t.Helper()
+	hsDep := d.containerHS(t, "Deployment.Pause", hsName)
+	if err := d.Deployer.Pause(hsDep); err != nil {
+		t.Fatalf("Deployment.Pause: %s", err)
+	}
+}
+
+// Unpause resumes a homeserver paused with Pause. Fails the test if the homeserver could not be unpaused.
+func (d *Deployment) Unpause(t *testing.T, hsName string) {
+	t.Helper()
+	hsDep := d.containerHS(t, "Deployment.Unpause", hsName)
+	if err := d.Deployer.Unpause(hsDep); err != nil {
+		t.Fatalf("Deployment.Unpause: %s", err)
+	}
+}
+
+// Start a homeserver stopped with Stop or Kill, and wait for it to be ready. The ports of the homeserver may
+// change, so the base URLs of the homeserver and clients made from this deployment are updated. Links changed
+// with Partition or DegradeLink are applied again. Fails the test if the homeserver could not be started.
+func (d *Deployment) Start(t *testing.T, hsName string) {
+	t.Helper()
+	hsDep := d.containerHS(t, "Deployment.Start", hsName)
+	if err := d.Deployer.Start(hsDep, d.Config); err != nil {
+		t.Fatalf("Deployment.Start: %s", err)
+	}
+	if err := d.reapplyNetwork(hsName); err != nil {
+		t.Fatalf("Deployment.Start: %s", err)
+	}
+}
+
+// containerHS returns the homeserver with the given name, failing the test if it doesn't exist or isn't
+// running in a container.
+func (d *Deployment) containerHS(t *testing.T, funcName, hsName string) *HomeserverDeployment {
+	t.Helper()
+	hsDep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("%s - HS name '%s' not found", funcName, hsName)
+	}
+	if hsDep.ContainerID == "" {
+		t.Fatalf("%s - HS name '%s' is an external homeserver so can't be controlled", funcName, hsName)
+	}
+	return hsDep
+}
@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/runtime"
+)
+
+// DetectCapabilities deploys a clean homeserver and probes what it supports, including the lowercased server
+// implementation name it reports over federation e.g "synapse". This lets tests call runtime.Require and
+// runtime.SkipIf before they make a deployment. The homeserver is destroyed before returning.
+func DetectCapabilities(cfg *config.Complement) (*runtime.Capabilities, error) {
+	bprint := b.BlueprintCleanHS
+	var dep *Deployment
+	if len(cfg.ExternalHomeservers) > 0 {
+		var err error
+		dep, err = DeployExternal(cfg, bprint)
+		if err != nil {
+			return nil, fmt.Errorf("DetectCapabilities: %w", err)
+		}
+	} else {
+		builder, err := NewBuilder(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("DetectCapabilities: %w", err)
+		}
+		if err = builder.ConstructBlueprintIfNotExist(bprint); err != nil {
+			return nil, fmt.Errorf("DetectCapabilities: %w", err)
+		}
+		deployer, err := NewDeployer("detect", cfg)
+		if err != nil {
+			return nil, fmt.Errorf("DetectCapabilities: %w", err)
+		}
+		dep, err = deployer.Deploy(context.Background(), bprint.Name)
+		if err != nil {
+			return nil, fmt.Errorf("DetectCapabilities: %w", err)
+		}
+		defer deployer.Destroy(dep, false)
+	}
+	caps, err := dep.Capabilities()
+	if err != nil {
+		return nil, fmt.Errorf("DetectCapabilities: %w", err)
+	}
+	for _, c := range caps {
+		return c, nil
+	}
+	return nil, fmt.Errorf("DetectCapabilities: blueprint %s has no homeservers", bprint.Name)
+}
@@ -0,0 +1,60 @@
+package docker
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+// DeployExternal makes a Deployment of the blueprint using the homeservers in cfg.ExternalHomeservers instead of
+// containers. The blueprint is applied by running its instructions against the live homeservers, so there is
+// nothing to build first. The deployment has no containers, so destroying it does nothing to the homeservers.
+func DeployExternal(cfg *config.Complement, bprint b.Blueprint) (*Deployment, error) {
+	dep := &Deployment{
+		Deployer: &Deployer{
+			DeployNamespace: "external",
+			debugLogging:    cfg.DebugLoggingEnabled,
+			config:          cfg,
+		},
+		BlueprintName: bprint.Name,
+		HS:            make(map[string]*HomeserverDeployment),
+		Config:        cfg,
+	}
+	runner := instruction.NewRunner(bprint.Name, cfg.BestEffort, cfg.DebugLoggingEnabled)
+	runner.RegistrationSharedSecrets = make(map[string]string)
+	for hsName, ext := range cfg.ExternalHomeservers {
+		runner.RegistrationSharedSecrets[hsName] = ext.RegistrationSharedSecret
+	}
+	// run the instructions of each parent first, as the blueprint may use their users and rooms
+	for _, bp := range b.Lineage(bprint) {
+		for _, hs := range bp.Homeservers {
+			ext, ok := cfg.ExternalHomeservers[hs.Name]
+			if !ok {
+				return nil, fmt.Errorf("DeployExternal: blueprint %s needs homeserver %s which is not in COMPLEMENT_EXTERNAL_HOMESERVERS", bp.Name, hs.Name)
+			}
+			if len(hs.ApplicationServices) > 0 {
+				return nil, fmt.Errorf("DeployExternal: %s.%s: application services cannot be added to external homeservers", bp.Name, hs.Name)
+			}
+			if cfg.DebugLoggingEnabled {
+				log.Printf("%s.%s : running instructions against %s", bp.Name, hs.Name, ext.BaseURL)
+			}
+			if err := runner.Run(hs, ext.BaseURL); err != nil {
+				return nil, fmt.Errorf("DeployExternal: %s.%s: failed to run instructions: %w", bp.Name, hs.Name, err)
+			}
+		}
+	}
+	for _, hs := range b.Flatten(bprint).Homeservers {
+		ext := cfg.ExternalHomeservers[hs.Name]
+		dep.HS[hs.Name] = &HomeserverDeployment{
+			BaseURL:             ext.BaseURL,
+			FedBaseURL:          ext.FedBaseURL,
+			AccessTokens:        runner.AccessTokens(hs.Name),
+			ApplicationServices: make(map[string]string),
+			DeviceIDs:           runner.DeviceIDs(hs.Name),
+		}
+	}
+	return dep, nil
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/docker/docker/api/types/filters"
@@ -40,6 +41,17 @@ func asIDToRegistrationFromLabels(labels map[string]string) map[string]string {
 	return asMap
 }
 
+// registrationWithURL returns the registration yaml with the url: line replaced with the given URL.
+func registrationWithURL(registration, asURL string) string {
+	lines := strings.Split(registration, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "url: ") {
+			lines[i] = fmt.Sprintf("url: '%s'", asURL)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 func labelsForApplicationServices(hs b.Homeserver) map[string]string {
 	labels := make(map[string]string)
 	// collect and store app service registrations as labels 'application_service_$as_id: $registration'
@@ -61,3 +73,29 @@ func deviceIDsFromLabels(labels map[string]string) map[string]string {
 	}
 	return userIDToToken
 }
+
+// labelsForRoomRefs stores the room IDs of rooms with a Ref as labels 'room_ref_$ref: $room_id', and the HS name
+// which created them as 'room_server_$ref: $hs_name', so blueprints which extend this one can use the rooms.
+func labelsForRoomRefs(roomIDs, hsNames map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for ref, roomID := range roomIDs {
+		labels["room_ref_"+ref] = roomID
+		if hsName, ok := hsNames[ref]; ok {
+			labels["room_server_"+ref] = hsName
+		}
+	}
+	return labels
+}
+
+func roomRefsFromLabels(labels map[string]string) (roomIDs, hsNames map[string]string) {
+	roomIDs = make(map[string]string)
+	hsNames = make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, "room_ref_") {
+			roomIDs[strings.TrimPrefix(k, "room_ref_")] = v
+		} else if strings.HasPrefix(k, "room_server_") {
+			hsNames[strings.TrimPrefix(k, "room_server_")] = v
+		}
+	}
+	return roomIDs, hsNames
+}
@@ -0,0 +1,305 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// The iptables chain which holds the rules for partitions, so they can be flushed without touching other rules.
+const partitionChain = "COMPLEMENT_PARTITION"
+
+// LinkConditions degrade the link between two homeservers. They are applied to packets in each direction,
+// so a Latency of 100ms adds 200ms to the round trip time.
+type LinkConditions struct {
+	// The delay added to each packet
+	Latency time.Duration
+	// The percentage of packets to drop, from 0 to 100
+	PacketLoss float64
+}
+
+// linkState is the state of the link between two homeservers in a deployment.
+type linkState struct {
+	partitioned bool
+	conditions  LinkConditions
+}
+
+// link identifies the link between two homeservers, with the HS names in sorted order.
+type link [2]string
+
+func newLink(hsName1, hsName2 string) link {
+	if hsName1 > hsName2 {
+		return link{hsName2, hsName1}
+	}
+	return link{hsName1, hsName2}
+}
+
+// Partition cuts the link between two homeservers in the deployment, so packets between them are dropped.
+// Other links are unaffected, including the links to Complement. Fails the test if the link could not be cut.
+func (d *Deployment) Partition(t *testing.T, hsName1, hsName2 string) {
+	t.Helper()
+	d.setLink(t, "Deployment.Partition", hsName1, hsName2, func(ls *linkState) {
+		ls.partitioned = true
+	})
+}
+
+// DegradeLink adds latency and packet loss to the link between two homeservers in the deployment, replacing
+// any conditions set previously. Fails the test if the conditions could not be applied.
+func (d *Deployment) DegradeLink(t *testing.T, hsName1, hsName2 string, conditions LinkConditions) {
+	t.Helper()
+	if conditions.PacketLoss < 0 || conditions.PacketLoss > 100 {
+		t.Fatalf("Deployment.DegradeLink: packet loss must be between 0 and 100, got %v", conditions.PacketLoss)
+	}
+	d.setLink(t, "Deployment.DegradeLink", hsName1, hsName2, func(ls *linkState) {
+		ls.conditions = conditions
+	})
+}
+
+// Heal restores the link between two homeservers in the deployment, undoing Partition and DegradeLink.
+// Fails the test if the link could not be restored.
+func (d *Deployment) Heal(t *testing.T, hsName1, hsName2 string) {
+	t.Helper()
+	d.setLink(t, "Deployment.Heal", hsName1, hsName2, func(ls *linkState) {
+		*ls = linkState{}
+	})
+}
+
+func (d *Deployment) setLink(t *testing.T, funcName, hsName1, hsName2 string, update func(ls *linkState)) {
+	t.Helper()
+	if hsName1 == hsName2 {
+		t.Fatalf("%s: cannot change the link from %s to itself", funcName, hsName1)
+	}
+	d.containerHS(t, funcName, hsName1)
+	d.containerHS(t, funcName, hsName2)
+	d.networkMu.Lock()
+	defer d.networkMu.Unlock()
+	if d.links == nil {
+		d.links = make(map[link]*linkState)
+	}
+	l := newLink(hsName1, hsName2)
+	ls, ok := d.links[l]
+	if !ok {
+		ls = &linkState{}
+		d.links[l] = ls
+	}
+	update(ls)
+	if err := d.applyNetwork(hsName1, hsName2); err != nil {
+		t.Fatalf("%s: %s", funcName, err)
+	}
+	if *ls == (linkState{}) {
+		// the link is healed so doesn't need to be applied again
+		delete(d.links, l)
+	}
+}
+
+// reapplyNetwork applies the link state of homeservers again, along with the homeservers they have links to,
+// as the rules are lost when a container stops and its IP address may change when it starts.
+func (d *Deployment) reapplyNetwork(hsNames ...string) error {
+	d.networkMu.Lock()
+	defer d.networkMu.Unlock()
+	toApply := make(map[string]bool)
+	for _, hsName := range hsNames {
+		for l := range d.links {
+			if l[0] == hsName || l[1] == hsName {
+				toApply[l[0]] = true
+				toApply[l[1]] = true
+			}
+		}
+	}
+	if len(toApply) == 0 {
+		// the homeservers have never had their links changed
+		return nil
+	}
+	names := make([]string, 0, len(toApply))
+	for hsName := range toApply {
+		names = append(names, hsName)
+	}
+	sort.Strings(names)
+	return d.applyNetwork(names...)
+}
+
+// applyNetwork replaces the partition and traffic shaping rules in each of the given homeservers with the
+// ones for their current link state. Stopped homeservers are skipped, as their rules are applied when they
+// start. The caller must hold networkMu.
+func (d *Deployment) applyNetwork(hsNames ...string) error {
+	ctx := context.Background()
+	ips := make(map[string]string)
+	for hsName, hsDep := range d.HS {
+		if hsDep.ContainerID == "" {
+			continue
+		}
+		ip, err := containerIP(ctx, d.Deployer.Runtime, hsDep.ContainerID)
+		if err != nil {
+			return fmt.Errorf("failed to get IP address of %s: %w", hsName, err)
+		}
+		if ip != "" {
+			ips[hsName] = ip
+		}
+	}
+	for _, hsName := range hsNames {
+		if ips[hsName] == "" {
+			continue
+		}
+		var partitioned []string
+		degraded := make(map[string]LinkConditions)
+		for l, ls := range d.links {
+			peer := l[0]
+			if peer == hsName {
+				peer = l[1]
+			} else if l[1] != hsName {
+				continue
+			}
+			peerIP := ips[peer]
+			if peerIP == "" {
+				continue
+			}
+			if ls.partitioned {
+				partitioned = append(partitioned, peerIP)
+			}
+			if ls.conditions != (LinkConditions{}) {
+				degraded[peerIP] = ls.conditions
+			}
+		}
+		script, err := networkScript(partitioned, degraded)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hsName, err)
+		}
+		if err = d.Deployer.runNetworkTool(ctx, d.HS[hsName].ContainerID, script); err != nil {
+			return fmt.Errorf("failed to apply network rules to %s: %w", hsName, err)
+		}
+	}
+	return nil
+}
+
+// networkScript returns a shell script which replaces the partition and traffic shaping rules of a container
+// with rules dropping all packets to and from the `partitioned` IPs, and degrading the links to the `degraded`
+// IPs. The script is idempotent so it can be run whenever the rules change.
+func networkScript(partitioned []string, degraded map[string]LinkConditions) (string, error) {
+	sort.Strings(partitioned)
+	degradedIPs := make([]string, 0, len(degraded))
+	for ip := range degraded {
+		degradedIPs = append(degradedIPs, ip)
+	}
+	sort.Strings(degradedIPs)
+	// the prio qdisc has 3 bands for normal traffic, and at most 16 bands
+	if len(degradedIPs) > 13 {
+		return "", fmt.Errorf("cannot degrade more than 13 links from one homeserver, got %d", len(degradedIPs))
+	}
+
+	lines := []string{
+		"set -e",
+		fmt.Sprintf("iptables -N %s 2>/dev/null || iptables -F %s", partitionChain, partitionChain),
+		fmt.Sprintf("iptables -C INPUT -j %s 2>/dev/null || iptables -I INPUT -j %s", partitionChain, partitionChain),
+		fmt.Sprintf("iptables -C OUTPUT -j %s 2>/dev/null || iptables -I OUTPUT -j %s", partitionChain, partitionChain),
+	}
+	for _, ip := range partitioned {
+		lines = append(lines,
+			fmt.Sprintf("iptables -A %s -s %s -j DROP", partitionChain, ip),
+			fmt.Sprintf("iptables -A %s -d %s -j DROP", partitionChain, ip),
+		)
+	}
+
+	// shape traffic on the interface of the container's default route
+	lines = append(lines,
+		"DEV=$(ip route show default | awk '{for (i = 1; i < NF; i++) if ($i == \"dev\") print $(i+1)}' | head -n 1)",
+		"DEV=${DEV:-eth0}",
+		"tc qdisc del dev $DEV root 2>/dev/null || true",
+	)
+	if len(degradedIPs) > 0 {
+		// Send packets to degraded IPs through a netem qdisc each, and everything else through the usual bands.
+		lines = append(lines, fmt.Sprintf(
+			"tc qdisc add dev $DEV root handle 1: prio bands %d priomap 1 2 2 2 1 2 0 0 1 1 1 1 1 1 1 1", 3+len(degradedIPs),
+		))
+		for i, ip := range degradedIPs {
+			band := 4 + i
+			cond := degraded[ip]
+			lines = append(lines,
+				fmt.Sprintf(
+					"tc qdisc add dev $DEV parent 1:%d handle %d: netem delay %dus loss %.4f%%",
+					band, 10+i, cond.Latency.Microseconds(), cond.PacketLoss,
+				),
+				fmt.Sprintf("tc filter add dev $DEV parent 1: protocol ip prio 1 u32 match ip dst %s/32 flowid 1:%d", ip, band),
+			)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// containerIP returns the IP address of a container on its complement network, or "" if it isn't running.
+func containerIP(ctx context.Context, docker Runtime, containerID string) (string, error) {
+	inspect, err := docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	if inspect.State == nil || !inspect.State.Running || inspect.NetworkSettings == nil {
+		return "", nil
+	}
+	for _, settings := range inspect.NetworkSettings.Networks {
+		if settings.IPAddress != "" {
+			return settings.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("container %s has no IP address", containerID)
+}
+
+// runNetworkTool runs the script in a container made from the network tools image which shares the network
+// namespace of the given container, so it can change the container's firewall and traffic shaping rules.
+func (d *Deployer) runNetworkTool(ctx context.Context, containerID, script string) error {
+	image := d.config.NetworkToolsImage
+	if _, _, err := d.Runtime.ImageInspectWithRaw(ctx, image); err != nil {
+		d.log("Pulling network tools image %s", image)
+		reader, err := d.Runtime.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to pull network tools image %s: %w", image, err)
+		}
+		// the pull is complete when the progress stream ends
+		_, err = io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to pull network tools image %s: %w", image, err)
+		}
+	}
+	body, err := d.Runtime.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Entrypoint: []string{"sh", "-c", script},
+		Labels: map[string]string{
+			complementLabel:  "network_tools",
+			"complement_pkg": d.config.PackageNamespace,
+		},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode("container:" + containerID),
+		CapAdd:      []string{"NET_ADMIN"},
+	}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create network tools container: %w", err)
+	}
+	defer func() {
+		err := d.Runtime.ContainerRemove(context.Background(), body.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			d.log("Failed to remove network tools container %s: %s", body.ID, err)
+		}
+	}()
+	// wait for the container to exit, registering the wait before it starts so the exit can't be missed
+	waitCh, errCh := d.Runtime.ContainerWait(ctx, body.ID, container.WaitConditionNextExit)
+	if err = d.Runtime.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start network tools container: %w", err)
+	}
+	select {
+	case res := <-waitCh:
+		if res.StatusCode != 0 {
+			logs, _ := containerLogs(d.Runtime, body.ID)
+			return fmt.Errorf("network tools exited with code %d: %s", res.StatusCode, logs)
+		}
+	case err = <-errCh:
+		return fmt.Errorf("failed to wait for network tools container: %w", err)
+	}
+	return nil
+}
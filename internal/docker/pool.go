@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// PoolStats are counters for how well a DeploymentPool is doing.
+type PoolStats struct {
+	// The number of deployments which were handed out warm.
+	Hits int
+	// The number of deployments which had to be deployed whilst the caller waited.
+	Misses int
+	// The total time callers spent waiting for warm deployments.
+	HitWait time.Duration
+	// The total time callers spent waiting for deployments which were not warm.
+	MissWait time.Duration
+}
+
+func (s PoolStats) String() string {
+	avg := func(total time.Duration, n int) time.Duration {
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+	return fmt.Sprintf(
+		"%d hits (avg %v), %d misses (avg %v)", s.Hits, avg(s.HitWait, s.Hits), s.Misses, avg(s.MissWait, s.Misses),
+	)
+}
+
+// DeploymentPool keeps warm, already running deployments of blueprints which can be handed out to tests,
+// so tests running in parallel don't each have to wait for their containers to start.
+//
+// A blueprint is only kept warm once it has been asked for, either via Warm or Acquire. A deployment is
+// never handed out twice: tests modify the state of the homeservers, so when a deployment is destroyed it
+// is discarded and a fresh one is started in the background to replace it.
+//
+// Pooled deployments are started before any test asks for them, so they can't be configured per test. Tests
+// which need application services (Deployment.ApplicationServiceURLs) must bypass the pool and deploy directly.
+type DeploymentPool struct {
+	config  *config.Complement
+	size    int
+	counter uint64
+	// Makes and destroys the deployments in the pool. Replaced in tests so they don't need Docker.
+	deployer poolDeployer
+
+	mu      sync.Mutex
+	warm    map[string][]*Deployment // blueprint name => ready deployments
+	pending map[string]int           // blueprint name => number of deployments being started
+	closed  bool
+	stats   PoolStats
+	// Tracks the deployments being started in the background, so Close can wait for them.
+	wg sync.WaitGroup
+}
+
+// poolDeployer makes and destroys the deployments in a DeploymentPool.
+type poolDeployer interface {
+	deploy(ctx context.Context, namespace, blueprintName string) (*Deployment, error)
+	destroy(dep *Deployment, printServerLogs bool)
+}
+
+// dockerPoolDeployer deploys blueprints as Docker containers.
+type dockerPoolDeployer struct {
+	config *config.Complement
+}
+
+func (d *dockerPoolDeployer) deploy(ctx context.Context, namespace, blueprintName string) (*Deployment, error) {
+	deployer, err := NewDeployer(namespace, d.config)
+	if err != nil {
+		return nil, fmt.Errorf("DeploymentPool: NewDeployer returned error %s", err)
+	}
+	return deployer.Deploy(ctx, blueprintName)
+}
+
+func (d *dockerPoolDeployer) destroy(dep *Deployment, printServerLogs bool) {
+	dep.Deployer.Destroy(dep, printServerLogs)
+}
+
+// NewDeploymentPool makes a pool which keeps `size` deployments of each blueprint warm. The blueprints must
+// already have been constructed before they are requested from the pool.
+func NewDeploymentPool(cfg *config.Complement, size int) *DeploymentPool {
+	return &DeploymentPool{
+		config:   cfg,
+		size:     size,
+		deployer: &dockerPoolDeployer{config: cfg},
+		warm:     make(map[string][]*Deployment),
+		pending:  make(map[string]int),
+	}
+}
+
+// Warm starts deploying the given blueprint in the background until the pool has `size` deployments of it ready.
+func (p *DeploymentPool) Warm(blueprintName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fill(blueprintName)
+}
+
+// Acquire returns a running deployment of the given blueprint, and whether it was already warm. If there are no
+// warm deployments, one is deployed whilst the caller waits. Either way, the pool is topped back up in the
+// background. Destroying the returned deployment returns it to the pool, which discards it.
+//
+// Callers which set Deployment.ApplicationServiceURLs must not use the pool, as pooled deployments are
+// already running without them.
+func (p *DeploymentPool) Acquire(ctx context.Context, blueprintName string) (dep *Deployment, hit bool, err error) {
+	start := time.Now()
+	p.mu.Lock()
+	if warm := p.warm[blueprintName]; len(warm) > 0 {
+		dep = warm[0]
+		p.warm[blueprintName] = warm[1:]
+		p.stats.Hits++
+		p.stats.HitWait += time.Since(start)
+		p.fill(blueprintName)
+		p.mu.Unlock()
+		return dep, true, nil
+	}
+	p.mu.Unlock()
+
+	dep, err = p.deploy(ctx, blueprintName)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	p.stats.Misses++
+	p.stats.MissWait += time.Since(start)
+	p.fill(blueprintName)
+	return dep, false, nil
+}
+
+// Stats returns the hit/miss counters for the pool so far.
+func (p *DeploymentPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Close destroys all warm deployments and stops the pool from starting any more. Deployments which are
+// currently being started in the background are destroyed when they are ready, and Close waits for them,
+// so no containers are left running when it returns.
+func (p *DeploymentPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	warm := p.warm
+	p.warm = make(map[string][]*Deployment)
+	p.mu.Unlock()
+	for _, deps := range warm {
+		for _, dep := range deps {
+			p.deployer.destroy(dep, false)
+		}
+	}
+	p.wg.Wait()
+}
+
+// release discards a deployment which was handed out by the pool.
+func (p *DeploymentPool) release(dep *Deployment, printServerLogs bool) {
+	p.deployer.destroy(dep, printServerLogs)
+}
+
+// deploy makes a new deployment of the blueprint, using a new namespace so container names don't clash.
+func (p *DeploymentPool) deploy(ctx context.Context, blueprintName string) (*Deployment, error) {
+	namespace := fmt.Sprintf("pool%d", atomic.AddUint64(&p.counter, 1))
+	dep, err := p.deployer.deploy(ctx, namespace, blueprintName)
+	if err != nil {
+		return nil, err
+	}
+	dep.pool = p
+	return dep, nil
+}
+
+// fill starts enough deployments in the background to top the pool back up to `size` deployments
+// of the blueprint. The lock must be held.
+func (p *DeploymentPool) fill(blueprintName string) {
+	if p.closed {
+		return
+	}
+	need := p.size - len(p.warm[blueprintName]) - p.pending[blueprintName]
+	for i := 0; i < need; i++ {
+		p.pending[blueprintName]++
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			dep, err := p.deploy(context.Background(), blueprintName)
+			p.mu.Lock()
+			p.pending[blueprintName]--
+			if err != nil {
+				p.mu.Unlock()
+				log.Printf("DeploymentPool: failed to warm up blueprint %s: %s", blueprintName, err)
+				return
+			}
+			if p.closed {
+				p.mu.Unlock()
+				// Close is waiting for this deployment, so destroy it before returning
+				p.deployer.destroy(dep, false)
+				return
+			}
+			p.warm[blueprintName] = append(p.warm[blueprintName], dep)
+			p.mu.Unlock()
+		}()
+	}
+}
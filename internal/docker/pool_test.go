@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// fakePoolDeployer makes deployments without any containers. Deploys block until `unblock` is closed.
+type fakePoolDeployer struct {
+	cfg     *config.Complement
+	unblock chan struct{}
+
+	mu        sync.Mutex
+	deployed  int
+	destroyed map[*Deployment]bool
+}
+
+func (f *fakePoolDeployer) deploy(ctx context.Context, namespace, blueprintName string) (*Deployment, error) {
+	<-f.unblock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deployed++
+	return &Deployment{
+		Deployer:      &Deployer{DeployNamespace: namespace, config: f.cfg},
+		BlueprintName: blueprintName,
+		HS:            make(map[string]*HomeserverDeployment),
+		Config:        f.cfg,
+	}, nil
+}
+
+func (f *fakePoolDeployer) destroy(dep *Deployment, printServerLogs bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.destroyed[dep] = true
+}
+
+func (f *fakePoolDeployer) counts() (deployed, destroyed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deployed, len(f.destroyed)
+}
+
+func newFakePool(size int) (*DeploymentPool, *fakePoolDeployer) {
+	cfg := &config.Complement{}
+	fake := &fakePoolDeployer{
+		cfg:       cfg,
+		unblock:   make(chan struct{}),
+		destroyed: make(map[*Deployment]bool),
+	}
+	pool := NewDeploymentPool(cfg, size)
+	pool.deployer = fake
+	return pool, fake
+}
+
+// waitForWarm waits until the pool has `n` warm deployments of the blueprint.
+func waitForWarm(t *testing.T, pool *DeploymentPool, blueprintName string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		got := len(pool.warm[blueprintName])
+		pool.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d warm deployments of %s, got %d", n, blueprintName, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeploymentPoolAcquire(t *testing.T) {
+	pool, fake := newFakePool(2)
+	close(fake.unblock)
+
+	// nothing is warm yet, so the first deployment is a miss and the pool is filled in the background
+	dep, hit, err := pool.Acquire(context.Background(), "blueprint")
+	if err != nil {
+		t.Fatalf("Acquire returned error %s", err)
+	}
+	if hit {
+		t.Errorf("Acquire: got a hit from an empty pool")
+	}
+	if dep.pool != pool {
+		t.Errorf("Acquire: deployment is not from the pool")
+	}
+	waitForWarm(t, pool, "blueprint", 2)
+
+	// the next deployment is warm, and is replaced in the background
+	warmDep, hit, err := pool.Acquire(context.Background(), "blueprint")
+	if err != nil {
+		t.Fatalf("Acquire returned error %s", err)
+	}
+	if !hit {
+		t.Errorf("Acquire: got a miss from a warm pool")
+	}
+	if warmDep == dep {
+		t.Errorf("Acquire: handed out the same deployment twice")
+	}
+	waitForWarm(t, pool, "blueprint", 2)
+	if deployed, _ := fake.counts(); deployed != 4 {
+		t.Errorf("got %d deployments, want 4", deployed)
+	}
+	stats := pool.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Stats: got %d hits and %d misses, want 1 of each", stats.Hits, stats.Misses)
+	}
+
+	// destroying a deployment discards it rather than putting it back in the pool
+	warmDep.Destroy(t)
+	if !fake.destroyed[warmDep] {
+		t.Errorf("Destroy: deployment was not destroyed")
+	}
+	waitForWarm(t, pool, "blueprint", 2)
+
+	pool.Close()
+	if _, destroyed := fake.counts(); destroyed != 3 {
+		t.Errorf("Close: got %d destroyed deployments, want 3", destroyed)
+	}
+}
+
+func TestDeploymentPoolCloseWaitsForPendingDeploys(t *testing.T) {
+	pool, fake := newFakePool(3)
+	pool.Warm("blueprint")
+
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Close returned whilst deployments were still being started")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(fake.unblock)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close did not return after the pending deployments finished")
+	}
+	deployed, destroyed := fake.counts()
+	if deployed != 3 || destroyed != 3 {
+		t.Errorf("Close: got %d deployed and %d destroyed, want all 3 to be destroyed", deployed, destroyed)
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.warm["blueprint"]) != 0 {
+		t.Errorf("Close: left %d warm deployments in the pool", len(pool.warm["blueprint"]))
+	}
+}
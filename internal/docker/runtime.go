@@ -0,0 +1,141 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// Runtime is the container runtime which runs homeservers. The methods mirror the Docker Engine API so a
+// *client.Client is almost a Runtime by itself; implementations add anything which is runtime specific.
+type Runtime interface {
+	// Name returns the name of the runtime e.g "docker".
+	Name() string
+	// ExtraHosts returns the extra /etc/hosts entries needed for a container to be able to contact
+	// Complement on HostnameRunningComplement.
+	ExtraHosts() []string
+
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	ContainerPause(ctx context.Context, containerID string) error
+	ContainerUnpause(ctx context.Context, containerID string) error
+	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error)
+	CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error
+
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error)
+	ImagePull(ctx context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+
+	NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+}
+
+// NewRuntime connects to the container runtime named by COMPLEMENT_CONTAINER_RUNTIME.
+func NewRuntime(cfg *config.Complement) (Runtime, error) {
+	switch cfg.ContainerRuntime {
+	case RuntimeDocker, "":
+		cli, err := client.NewEnvClient()
+		if err != nil {
+			return nil, err
+		}
+		return &dockerRuntime{cli}, nil
+	case RuntimePodman:
+		return newPodmanRuntime()
+	default:
+		return nil, fmt.Errorf("NewRuntime: unknown container runtime '%s'", cfg.ContainerRuntime)
+	}
+}
+
+// dockerRuntime talks to the Docker Engine API, configured via the usual DOCKER_* environment variables.
+type dockerRuntime struct {
+	*client.Client
+}
+
+func (r *dockerRuntime) Name() string {
+	return RuntimeDocker
+}
+
+func (r *dockerRuntime) ExtraHosts() []string {
+	if runtime.GOOS != "linux" {
+		// Docker Desktop resolves host.docker.internal by itself
+		return nil
+	}
+	// Ensure that the homeservers under test can contact the host, so they can
+	// interact with a complement-controlled test server.
+	// Note: this feature of docker landed in Docker 20.10,
+	// see https://github.com/moby/moby/pull/40007
+	return []string{"host.docker.internal:host-gateway"}
+}
+
+// podmanRuntime talks to the Docker-compatible API of `podman system service`, which works rootless.
+type podmanRuntime struct {
+	*client.Client
+}
+
+// newPodmanRuntime connects to the Podman socket in CONTAINER_HOST, falling back to the default rootless
+// socket then the default rootful socket.
+func newPodmanRuntime() (*podmanRuntime, error) {
+	host := os.Getenv("CONTAINER_HOST")
+	if host == "" {
+		host = "unix:///run/podman/podman.sock"
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+			host = "unix://" + dir + "/podman/podman.sock"
+		}
+	}
+	cli, err := client.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("newPodmanRuntime: failed to connect to %s: %w", host, err)
+	}
+	return &podmanRuntime{cli}, nil
+}
+
+func (r *podmanRuntime) Name() string {
+	return RuntimePodman
+}
+
+func (r *podmanRuntime) ExtraHosts() []string {
+	// Podman adds host.containers.internal to every container
+	return nil
+}
+
+// ContainerInspect hides health checks which have never run. Podman runs health checks via systemd timers,
+// which aren't available on many rootless machines, so the health status would otherwise never leave "starting".
+// We still check that the homeserver responds to /versions before using it.
+func (r *podmanRuntime) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	inspect, err := r.Client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return inspect, err
+	}
+	if inspect.ContainerJSONBase != nil && inspect.State != nil && inspect.State.Health != nil &&
+		inspect.State.Health.Status == types.Starting && len(inspect.State.Health.Log) == 0 {
+		inspect.State.Health = nil
+	}
+	return inspect, nil
+}
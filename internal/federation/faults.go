@@ -0,0 +1,153 @@
+package federation
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fault describes how requests matching a FaultRule should misbehave. Latency is applied to every matching
+// request. At most one of StatusCode, ResetConnection and TruncateBody should be set, and it is applied to
+// the first FailFirst matching requests, or every matching request if FailFirst is 0.
+type Fault struct {
+	// Delay the response by this long.
+	Latency time.Duration
+	// If set, delay the response by a random duration between Latency and MaxLatency instead.
+	MaxLatency time.Duration
+	// Respond with this status code (e.g 502) instead of calling the handler.
+	StatusCode int
+	// Abort the connection without sending a response.
+	ResetConnection bool
+	// Call the handler, but only send the first half of the response body before aborting the connection.
+	TruncateBody bool
+	// Only fail the first N matching requests, then let requests through.
+	FailFirst int
+}
+
+// FaultRule is a Fault which is being applied to requests whose path matches a pattern. It counts the requests
+// it has seen so tests can assert on them.
+type FaultRule struct {
+	route *mux.Route
+	fault Fault
+
+	mu       sync.Mutex
+	matched  int
+	failed   int
+	disabled bool
+}
+
+// Matched returns the number of requests which matched this rule.
+func (r *FaultRule) Matched() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.matched
+}
+
+// Failed returns the number of requests which were failed by this rule, not including requests which were only delayed.
+func (r *FaultRule) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// Remove stops this rule from applying to any more requests. Counters are kept.
+func (r *FaultRule) Remove() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = true
+}
+
+// apply returns the latency to add and whether this request should be failed, or ok=false if the rule
+// does not apply to this request.
+func (r *FaultRule) apply(req *http.Request) (latency time.Duration, fail bool, ok bool) {
+	var match mux.RouteMatch
+	if !r.route.Match(req, &match) {
+		return 0, false, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return 0, false, false
+	}
+	r.matched++
+	latency = r.fault.Latency
+	if r.fault.MaxLatency > r.fault.Latency {
+		latency += time.Duration(rand.Int63n(int64(r.fault.MaxLatency - r.fault.Latency)))
+	}
+	failure := r.fault.StatusCode != 0 || r.fault.ResetConnection || r.fault.TruncateBody
+	fail = failure && (r.fault.FailFirst == 0 || r.matched <= r.fault.FailFirst)
+	if fail {
+		r.failed++
+	}
+	return latency, fail, true
+}
+
+// InjectFault makes requests whose path matches the pattern misbehave as described by the fault. The pattern
+// uses the same syntax as Mux() routes e.g "/_matrix/federation/v1/send/{txnID}". If more than one rule
+// matches a request, the first rule injected wins.
+func (s *Server) InjectFault(pathPattern string, fault Fault) *FaultRule {
+	rule := &FaultRule{
+		route: new(mux.Router).NewRoute().Path(pathPattern),
+		fault: fault,
+	}
+	if err := rule.route.GetError(); err != nil {
+		s.t.Fatalf("InjectFault: invalid path pattern %s: %s", pathPattern, err)
+	}
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	s.faults = append(s.faults, rule)
+	return rule
+}
+
+// faultMiddleware applies the first matching fault rule to each request.
+func (s *Server) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.faultsMu.Lock()
+		rules := append([]*FaultRule{}, s.faults...)
+		s.faultsMu.Unlock()
+		for _, rule := range rules {
+			latency, fail, ok := rule.apply(req)
+			if !ok {
+				continue
+			}
+			if latency > 0 {
+				time.Sleep(latency)
+			}
+			if !fail {
+				break
+			}
+			switch {
+			case rule.fault.ResetConnection:
+				s.t.Logf("InjectFault: resetting connection for %s %s", req.Method, req.URL.Path)
+				// aborts the connection (HTTP/1.1) or resets the stream (HTTP/2) without a response
+				panic(http.ErrAbortHandler)
+			case rule.fault.TruncateBody:
+				s.t.Logf("InjectFault: truncating response body for %s %s", req.Method, req.URL.Path)
+				rec := httptest.NewRecorder()
+				next.ServeHTTP(rec, req)
+				for k, v := range rec.Header() {
+					w.Header()[k] = v
+				}
+				body := rec.Body.Bytes()
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.WriteHeader(rec.Code)
+				w.Write(body[:len(body)/2])
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				panic(http.ErrAbortHandler)
+			default:
+				s.t.Logf("InjectFault: responding with %d for %s %s", rule.fault.StatusCode, req.Method, req.URL.Path)
+				w.WriteHeader(rule.fault.StatusCode)
+				w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"complement: injected fault"}`))
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,136 @@
+package federation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/har"
+)
+
+func TestServerInjectFault(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	}, HandleKeyRequests())
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: caCertPool,
+		},
+		DisableKeepAlives: true,
+	}}
+	keysURL := "https://" + srv.ServerName() + "/_matrix/key/v2/server"
+
+	t.Run("fail first N", func(t *testing.T) {
+		rule := srv.InjectFault("/_matrix/key/v2/server", Fault{
+			StatusCode: 502,
+			FailFirst:  2,
+		})
+		defer rule.Remove()
+		wantCodes := []int{502, 502, 200}
+		for i, wantCode := range wantCodes {
+			resp, err := client.Get(keysURL)
+			if err != nil {
+				t.Fatalf("request %d: failed to GET: %s", i, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != wantCode {
+				t.Errorf("request %d: got %d want %d", i, resp.StatusCode, wantCode)
+			}
+		}
+		if rule.Matched() != 3 || rule.Failed() != 2 {
+			t.Errorf("got matched=%d failed=%d, want matched=3 failed=2", rule.Matched(), rule.Failed())
+		}
+	})
+
+	t.Run("connection reset", func(t *testing.T) {
+		rule := srv.InjectFault("/_matrix/key/v2/{path:.*}", Fault{
+			ResetConnection: true,
+		})
+		defer rule.Remove()
+		resp, err := client.Get(keysURL)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("expected request to fail, got %d", resp.StatusCode)
+		}
+		if rule.Failed() == 0 {
+			t.Errorf("expected rule to have failed a request")
+		}
+	})
+
+	t.Run("truncated body", func(t *testing.T) {
+		rule := srv.InjectFault("/_matrix/key/v2/server", Fault{
+			TruncateBody: true,
+		})
+		defer rule.Remove()
+		resp, err := client.Get(keysURL)
+		if err != nil {
+			t.Fatalf("failed to GET: %s", err)
+		}
+		defer resp.Body.Close()
+		if _, err = ioutil.ReadAll(resp.Body); err == nil {
+			t.Errorf("expected reading the truncated body to fail")
+		}
+	})
+}
+
+// Test that faults behave the same when federation traffic is recorded, as the recorder sits between the
+// faults and the connection.
+func TestServerInjectFaultWithHAR(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	recorder := har.NewRecorder("test", nil)
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+		HAR:    recorder,
+	}, HandleKeyRequests())
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: caCertPool,
+		},
+		DisableKeepAlives: true,
+	}}
+	rule := srv.InjectFault("/_matrix/key/v2/server", Fault{
+		TruncateBody: true,
+	})
+	defer rule.Remove()
+	resp, err := client.Get("https://" + srv.ServerName() + "/_matrix/key/v2/server")
+	if err != nil {
+		t.Fatalf("failed to GET, the truncated response should have been sent: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Errorf("expected reading the truncated body to fail")
+	}
+	if len(body) == 0 {
+		t.Errorf("expected half of the body to be received")
+	}
+
+	entries := recorder.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d HAR entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Error == "" {
+		t.Errorf("expected the aborted request to be recorded with an error")
+	}
+	if entry.Response.Status != 200 || entry.Response.Content.Text != string(body) {
+		t.Errorf("got recorded response %d %q, want 200 %q", entry.Response.Status, entry.Response.Content.Text, string(body))
+	}
+}
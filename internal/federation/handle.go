@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -182,8 +185,18 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 	}
 
 	// insert the join event into the room state
-	room.AddEvent(event)
+	if err = room.AddEvent(event); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: HandleMakeSendJoinRequests send_join cannot add event: " + err.Error()))
+		return
+	}
 	log.Printf("Received send-join of event %s", event.EventID())
+	if s.network != nil {
+		// let the other servers in the network know about the join, as a resident server would
+		if err = s.network.propagate(s, room.RoomID, event); err != nil {
+			s.t.Errorf("HandleMakeSendJoinRequests: failed to send join event around the network: %s", err)
+		}
+	}
 
 	// return state and auth chain
 	b, err := json.Marshal(gomatrixserverlib.RespSendJoin{
@@ -405,6 +418,261 @@ func HandleEventAuthRequests() func(*Server) {
 	}
 }
 
+// StateRequestHook is called when a /state or /state_ids request arrives for an event in a room known to the
+// server, before the response is sent. It may block in order to delay the response. If it returns false, the
+// request is refused with a 404 as if the event was unknown.
+type StateRequestHook func(room *ServerRoom, eventID string) bool
+
+// HandleStateRequests is an option which will process GET /_matrix/federation/v1/state/{roomId} requests
+// universally when requested. The state returned is the state before the requested event, along with its
+// auth chain. Hooks are called in order and can delay or refuse the response.
+//
+// This option can be applied to a server which is already running to add more hooks e.g
+// `federation.HandleStateRequests(hook)(srv)`. The handler itself is only registered once.
+func HandleStateRequests(hooks ...StateRequestHook) func(*Server) {
+	return func(srv *Server) {
+		if !srv.addStateRequestHooks("state", hooks) {
+			return
+		}
+		srv.mux.Handle("/_matrix/federation/v1/state/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, state, ok := stateForRequest(srv, w, req, "state")
+			if !ok {
+				return
+			}
+			resp := gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.NewEventJSONsFromEvents(room.AuthChainForEvents(state)),
+				StateEvents: gomatrixserverlib.NewEventJSONsFromEvents(state),
+			}
+			respJSON, err := json.Marshal(resp)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(fmt.Sprintf(`complement: failed to marshal JSON response: %s`, err)))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(respJSON)
+		})).Methods("GET")
+	}
+}
+
+// HandleStateIdsRequests is an option which will process GET /_matrix/federation/v1/state_ids/{roomId} requests
+// universally when requested. The state returned is the state before the requested event, along with its
+// auth chain. Hooks are called in order and can delay or refuse the response.
+//
+// This option can be applied to a server which is already running to add more hooks e.g
+// `federation.HandleStateIdsRequests(hook)(srv)`. The handler itself is only registered once.
+func HandleStateIdsRequests(hooks ...StateRequestHook) func(*Server) {
+	return func(srv *Server) {
+		if !srv.addStateRequestHooks("state_ids", hooks) {
+			return
+		}
+		srv.mux.Handle("/_matrix/federation/v1/state_ids/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, state, ok := stateForRequest(srv, w, req, "state_ids")
+			if !ok {
+				return
+			}
+			resp := gomatrixserverlib.RespStateIDs{
+				AuthEventIDs:  eventIDs(room.AuthChainForEvents(state)),
+				StateEventIDs: eventIDs(state),
+			}
+			respJSON, err := json.Marshal(resp)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(fmt.Sprintf(`complement: failed to marshal JSON response: %s`, err)))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(respJSON)
+		})).Methods("GET")
+	}
+}
+
+// stateForRequest works out the room and state for a /state or /state_ids request, running the hooks.
+// Writes an error response and returns false if the request cannot be answered.
+func stateForRequest(srv *Server, w http.ResponseWriter, req *http.Request, endpoint string) (*ServerRoom, []*gomatrixserverlib.Event, bool) {
+	roomID := mux.Vars(req)["roomID"]
+	eventID := req.URL.Query().Get("event_id")
+
+	room, ok := srv.rooms[roomID]
+	if !ok {
+		srv.t.Logf("/%s request for unknown room ID %s", endpoint, roomID)
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("complement: /%s unknown room ID: %s", endpoint, roomID)))
+		return nil, nil, false
+	}
+	state, err := room.StateAtEvent(eventID)
+	if err != nil {
+		srv.t.Logf("/%s request for unknown event ID %s in room %s", endpoint, eventID, roomID)
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("complement: /%s %s", endpoint, err)))
+		return nil, nil, false
+	}
+	srv.hooksMu.Lock()
+	hooks := append([]StateRequestHook{}, srv.stateHooks[endpoint]...)
+	srv.hooksMu.Unlock()
+	for _, hook := range hooks {
+		if !hook(room, eventID) {
+			srv.t.Logf("/%s request for event ID %s in room %s refused by hook", endpoint, eventID, roomID)
+			w.WriteHeader(404)
+			w.Write([]byte(fmt.Sprintf("complement: /%s refused for event ID: %s", endpoint, eventID)))
+			return nil, nil, false
+		}
+	}
+	return room, state, true
+}
+
+// addStateRequestHooks adds hooks for the given endpoint, returning true if this is the first time the
+// endpoint has been set up, in which case the caller should register the handler.
+func (srv *Server) addStateRequestHooks(endpoint string, hooks []StateRequestHook) bool {
+	srv.hooksMu.Lock()
+	defer srv.hooksMu.Unlock()
+	existing, setup := srv.stateHooks[endpoint]
+	srv.stateHooks[endpoint] = append(existing, hooks...)
+	return !setup
+}
+
+// MissingEventsHook is called with the events which are about to be returned for a /get_missing_events request,
+// along with the request itself. It returns the events to send, so it can withhold or reorder events to simulate
+// an unreliable server. It may block in order to delay the response.
+type MissingEventsHook func(room *ServerRoom, req gomatrixserverlib.MissingEvents, events []*gomatrixserverlib.Event) []*gomatrixserverlib.Event
+
+// HandleGetMissingEventsRequests is an option which will process POST /_matrix/federation/v1/get_missing_events/{roomId}
+// requests universally when requested. Fails the test if the request signature is invalid. The room DAG is walked
+// backwards from the prev_events of latest_events, stopping at earliest_events, min_depth or limit. Events are
+// returned in depth order, after being passed through the hooks in order.
+//
+// This option can be applied to a server which is already running to add more hooks e.g
+// `federation.HandleGetMissingEventsRequests(hook)(srv)`. The handler itself is only registered once.
+func HandleGetMissingEventsRequests(hooks ...MissingEventsHook) func(*Server) {
+	return func(srv *Server) {
+		srv.hooksMu.Lock()
+		setup := srv.missingEventsHooks != nil
+		srv.missingEventsHooks = append(srv.missingEventsHooks, hooks...)
+		if srv.missingEventsHooks == nil {
+			srv.missingEventsHooks = make([]MissingEventsHook, 0)
+		}
+		srv.hooksMu.Unlock()
+		if setup {
+			return
+		}
+		srv.mux.Handle("/_matrix/federation/v1/get_missing_events/{roomID}", srv.ValidFederationRequest(srv.t, func(
+			fr *gomatrixserverlib.FederationRequest, pathParams map[string]string,
+		) util.JSONResponse {
+			roomID := pathParams["roomID"]
+			room, ok := srv.rooms[roomID]
+			if !ok {
+				srv.t.Logf("/get_missing_events request for unknown room ID %s", roomID)
+				return util.MessageResponse(404, "complement: HandleGetMissingEventsRequests unknown room ID: "+roomID)
+			}
+			var missingEventsReq gomatrixserverlib.MissingEvents
+			if err := json.Unmarshal(fr.Content(), &missingEventsReq); err != nil {
+				return util.MessageResponse(400, fmt.Sprintf("complement: HandleGetMissingEventsRequests failed to parse request body: %s", err))
+			}
+			limit := missingEventsReq.Limit
+			if limit <= 0 {
+				limit = 10 // the default in the spec
+			}
+			events := room.walkBackwards(
+				missingEventsReq.LatestEvents, missingEventsReq.EarliestEvents, int64(missingEventsReq.MinDepth), limit, false,
+			)
+			sort.SliceStable(events, func(i, j int) bool {
+				return events[i].Depth() < events[j].Depth()
+			})
+
+			srv.hooksMu.Lock()
+			hooks := append([]MissingEventsHook{}, srv.missingEventsHooks...)
+			srv.hooksMu.Unlock()
+			for _, hook := range hooks {
+				events = hook(room, missingEventsReq, events)
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: gomatrixserverlib.RespMissingEvents{
+					Events: gomatrixserverlib.NewEventJSONsFromEvents(events),
+				},
+			}
+		})).Methods("POST")
+	}
+}
+
+// BackfillHook is called with the events which are about to be returned for a /backfill request, along with
+// the event IDs and limit in the request. It returns the events to send, so it can withhold or reorder events
+// to simulate an unreliable server. It may block in order to delay the response.
+type BackfillHook func(room *ServerRoom, fromEventIDs []string, limit int, events []*gomatrixserverlib.Event) []*gomatrixserverlib.Event
+
+// HandleBackfillRequests is an option which will process GET /_matrix/federation/v1/backfill/{roomId}
+// requests universally when requested. Fails the test if the request signature is invalid. The room DAG is walked
+// backwards from (and including) the `v` events until `limit` events have been found. Events are returned newest
+// first, after being passed through the hooks in order.
+//
+// This option can be applied to a server which is already running to add more hooks e.g
+// `federation.HandleBackfillRequests(hook)(srv)`. The handler itself is only registered once.
+func HandleBackfillRequests(hooks ...BackfillHook) func(*Server) {
+	return func(srv *Server) {
+		srv.hooksMu.Lock()
+		setup := srv.backfillHooks != nil
+		srv.backfillHooks = append(srv.backfillHooks, hooks...)
+		if srv.backfillHooks == nil {
+			srv.backfillHooks = make([]BackfillHook, 0)
+		}
+		srv.hooksMu.Unlock()
+		if setup {
+			return
+		}
+		srv.mux.Handle("/_matrix/federation/v1/backfill/{roomID}", srv.ValidFederationRequest(srv.t, func(
+			fr *gomatrixserverlib.FederationRequest, pathParams map[string]string,
+		) util.JSONResponse {
+			roomID := pathParams["roomID"]
+			room, ok := srv.rooms[roomID]
+			if !ok {
+				srv.t.Logf("/backfill request for unknown room ID %s", roomID)
+				return util.MessageResponse(404, "complement: HandleBackfillRequests unknown room ID: "+roomID)
+			}
+			reqURL, err := url.Parse(fr.RequestURI())
+			if err != nil {
+				return util.MessageResponse(400, fmt.Sprintf("complement: HandleBackfillRequests invalid request URI: %s", err))
+			}
+			fromEventIDs := reqURL.Query()["v"]
+			limit, err := strconv.Atoi(reqURL.Query().Get("limit"))
+			if err != nil || limit <= 0 {
+				return util.MessageResponse(400, "complement: HandleBackfillRequests missing or invalid limit")
+			}
+			events := room.walkBackwards(fromEventIDs, nil, 0, limit, true)
+			sort.SliceStable(events, func(i, j int) bool {
+				return events[i].Depth() > events[j].Depth()
+			})
+
+			srv.hooksMu.Lock()
+			hooks := append([]BackfillHook{}, srv.backfillHooks...)
+			srv.hooksMu.Unlock()
+			for _, hook := range hooks {
+				events = hook(room, fromEventIDs, limit, events)
+			}
+
+			pdus := make([]json.RawMessage, len(events))
+			for i := range events {
+				pdus[i] = events[i].JSON()
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: gomatrixserverlib.Transaction{
+					Origin:         gomatrixserverlib.ServerName(srv.serverName),
+					OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+					PDUs:           pdus,
+				},
+			}
+		})).Methods("GET")
+	}
+}
+
+func eventIDs(events []*gomatrixserverlib.Event) []string {
+	ids := make([]string, len(events))
+	for i := range events {
+		ids[i] = events[i].EventID()
+	}
+	return ids
+}
+
 // HandleKeyRequests is an option which will process GET /_matrix/key/v2/server requests universally when requested.
 func HandleKeyRequests() func(*Server) {
 	return func(srv *Server) {
@@ -575,7 +843,21 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 				}
 
 				// Store this PDU in the room's timeline
-				room.AddEvent(event)
+				if err = room.AddEvent(event); err != nil {
+					log.Printf(
+						"complement: Transaction '%s': Failed to add event '%s': %s",
+						transaction.TransactionID, event.EventID(), err.Error(),
+					)
+					response.PDUs[event.EventID()] = gomatrixserverlib.PDUResult{Error: err.Error()}
+					continue
+				}
+
+				if srv.network != nil {
+					// pass the event on to the other servers in the network, as a resident server would
+					if err = srv.network.propagate(srv, room.RoomID, event); err != nil {
+						srv.t.Errorf("HandleTransactionRequests: failed to send event around the network: %s", err)
+					}
+				}
 
 				// Add this PDU as a success to the response
 				response.PDUs[event.EventID()] = gomatrixserverlib.PDUResult{}
@@ -0,0 +1,233 @@
+package federation
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Network is a group of Complement servers which federate with each other, so a room can be spread across
+// several servers with the homeserver under test in the middle.
+//
+// Every server in the network keeps its own copy of each shared room, signs the events it creates and answers
+// /make_join, /send_join, /state_ids and friends from its own copy. Events created via the network are sent
+// to every other server in the network, unless the two servers have been partitioned, in which case their
+// copies of the room diverge until the partition is healed. This makes it possible to script mesh and
+// split-brain scenarios. Events which the homeserver sends to a server in the network via /send are passed
+// on in the same way, as a resident server would.
+//
+// Servers in the network handle one request at a time, so their rooms are not modified whilst the test is
+// using a Network method. Rooms returned by the network are not locked, so only read them when the
+// homeserver is not sending requests to the network, e.g after waiting for the homeserver to send an event.
+type Network struct {
+	t          *testing.T
+	deployment *docker.Deployment
+
+	// Held whilst a server in the network handles a request and by Network methods, as both modify the
+	// copies of rooms held by each server.
+	mu         sync.Mutex
+	servers    []*Server
+	partitions map[[2]*Server]bool
+}
+
+// NewNetwork creates an empty network of Complement servers. Add servers with Network.NewServer.
+func NewNetwork(t *testing.T, deployment *docker.Deployment) *Network {
+	return &Network{
+		t:          t,
+		deployment: deployment,
+		partitions: make(map[[2]*Server]bool),
+	}
+}
+
+// NewServer creates a new Complement server in this network. The server handles key requests, joins, state,
+// events, missing events, backfill and transactions by default. Additional options go first so they can
+// override these handlers. The server must still Listen(). Handlers, including callbacks such as those given to
+// HandleTransactionRequests, run with the network locked so must not call Network methods.
+func (n *Network) NewServer(opts ...func(*Server)) *Server {
+	srv := NewServer(n.t, n.deployment,
+		append(
+			opts,
+			HandleKeyRequests(),
+			HandleMakeSendJoinRequests(),
+			HandleStateRequests(),
+			HandleStateIdsRequests(),
+			HandleEventRequests(),
+			HandleEventAuthRequests(),
+			HandleGetMissingEventsRequests(),
+			HandleBackfillRequests(),
+			HandleTransactionRequests(nil, nil),
+			func(srv *Server) {
+				srv.mux.Use(n.lockMiddleware)
+			},
+		)...,
+	)
+	srv.network = n
+	n.mu.Lock()
+	n.servers = append(n.servers, srv)
+	n.mu.Unlock()
+	return srv
+}
+
+// lockMiddleware holds the network lock whilst a server in the network handles a request.
+func (n *Network) lockMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Listen makes every server in the network listen. Call the returned function to close them all.
+func (n *Network) Listen() (cancel func()) {
+	n.mu.Lock()
+	servers := append([]*Server{}, n.servers...)
+	n.mu.Unlock()
+	var cancels []func()
+	for _, srv := range servers {
+		if c := srv.Listen(); c != nil {
+			cancels = append(cancels, c)
+		}
+	}
+	return func() {
+		for _, c := range cancels {
+			c()
+		}
+	}
+}
+
+// MustMakeRoom creates a room on the `creator` server and gives every other server in the network a copy of it.
+// Returns the creator's copy. Other servers' copies can be accessed via Network.Room.
+func (n *Network) MustMakeRoom(t *testing.T, creator *Server, roomVer gomatrixserverlib.RoomVersion, events []b.Event) *ServerRoom {
+	t.Helper()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	room := creator.MustMakeRoom(t, roomVer, events)
+	for _, srv := range n.servers {
+		if srv == creator {
+			continue
+		}
+		roomCopy := newRoom(room.Version, room.RoomID)
+		for _, ev := range room.Timeline {
+			if err := roomCopy.AddEvent(ev); err != nil {
+				t.Fatalf("Network.MustMakeRoom: %s", err)
+			}
+		}
+		srv.rooms[room.RoomID] = roomCopy
+	}
+	return room
+}
+
+// Room returns the server's copy of the room, or fails the test if the server doesn't have the room.
+func (n *Network) Room(t *testing.T, srv *Server, roomID string) *ServerRoom {
+	t.Helper()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.room(t, srv, roomID)
+}
+
+func (n *Network) room(t *testing.T, srv *Server, roomID string) *ServerRoom {
+	t.Helper()
+	room, ok := srv.rooms[roomID]
+	if !ok {
+		t.Fatalf("Network.Room: server %s does not have room %s", srv.serverName, roomID)
+	}
+	return room
+}
+
+// MustCreateEvent creates an event signed by `srv` on its copy of the room, then sends it to every other server
+// in the network which is not partitioned from `srv`.
+func (n *Network) MustCreateEvent(t *testing.T, srv *Server, roomID string, ev b.Event) *gomatrixserverlib.Event {
+	t.Helper()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	room := n.room(t, srv, roomID)
+	signedEvent := srv.MustCreateEvent(t, room, ev)
+	if err := room.AddEvent(signedEvent); err != nil {
+		t.Fatalf("Network.MustCreateEvent: %s", err)
+	}
+	if err := n.propagate(srv, roomID, signedEvent); err != nil {
+		t.Fatalf("Network.MustCreateEvent: %s", err)
+	}
+	return signedEvent
+}
+
+// MustJoin creates a join event for the user with the given localpart on `srv` and sends it around the network.
+func (n *Network) MustJoin(t *testing.T, srv *Server, roomID, localpart string) *gomatrixserverlib.Event {
+	t.Helper()
+	userID := srv.UserID(localpart)
+	return n.MustCreateEvent(t, srv, roomID, b.Event{
+		Type:     "m.room.member",
+		StateKey: &userID,
+		Sender:   userID,
+		Content: map[string]interface{}{
+			"membership": "join",
+		},
+	})
+}
+
+// Partition stops events created on one of the servers from reaching the other, in both directions.
+func (n *Network) Partition(srv1, srv2 *Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions[[2]*Server{srv1, srv2}] = true
+	n.partitions[[2]*Server{srv2, srv1}] = true
+}
+
+// Heal removes a partition between two servers. Each server is sent the events in shared rooms which it missed
+// from the other, in the order the other server saw them. If the rooms diverged, they will have more than one
+// forward extremity afterwards. Fails the test if a server could not resolve the state of a room.
+func (n *Network) Heal(srv1, srv2 *Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitions, [2]*Server{srv1, srv2})
+	delete(n.partitions, [2]*Server{srv2, srv1})
+	if err := syncRooms(srv1, srv2); err != nil {
+		n.t.Errorf("Network.Heal: %s", err)
+	}
+	if err := syncRooms(srv2, srv1); err != nil {
+		n.t.Errorf("Network.Heal: %s", err)
+	}
+}
+
+// propagate sends an event which was added to `origin`'s copy of the room to every other server which has
+// the room and is not partitioned from `origin`. The caller must hold the network lock.
+func (n *Network) propagate(origin *Server, roomID string, ev *gomatrixserverlib.Event) error {
+	for _, srv := range n.servers {
+		if srv == origin || n.partitions[[2]*Server{origin, srv}] {
+			continue
+		}
+		room, ok := srv.rooms[roomID]
+		if !ok || room.hasEvent(ev.EventID()) {
+			continue
+		}
+		if err := room.AddEvent(ev); err != nil {
+			return fmt.Errorf("server %s: %w", srv.serverName, err)
+		}
+	}
+	return nil
+}
+
+// syncRooms adds any events in rooms shared between `from` and `to` which `to` has not seen.
+func syncRooms(from, to *Server) error {
+	for roomID, fromRoom := range from.rooms {
+		toRoom, ok := to.rooms[roomID]
+		if !ok {
+			continue
+		}
+		for _, ev := range fromRoom.Timeline {
+			if toRoom.hasEvent(ev.EventID()) {
+				continue
+			}
+			if err := toRoom.AddEvent(ev); err != nil {
+				return fmt.Errorf("server %s: %w", to.serverName, err)
+			}
+		}
+	}
+	return nil
+}
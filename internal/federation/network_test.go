@@ -0,0 +1,60 @@
+package federation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestNetworkSplitBrain(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	network := NewNetwork(t, &docker.Deployment{
+		Config: cfg,
+	})
+	srv1 := network.NewServer()
+	srv2 := network.NewServer()
+	cancel := network.Listen()
+	defer cancel()
+
+	alice := srv1.UserID("alice")
+	room := network.MustMakeRoom(t, srv1, gomatrixserverlib.RoomVersionV9, InitialRoomEvents(gomatrixserverlib.RoomVersionV9, alice))
+	bobJoin := network.MustJoin(t, srv2, room.RoomID, "bob")
+	if network.Room(t, srv1, room.RoomID).CurrentState("m.room.member", bobJoin.Sender()) == nil {
+		t.Fatalf("srv1 did not receive bob's join")
+	}
+
+	network.Partition(srv1, srv2)
+	setName := func(srv *Server, sender, name string) *gomatrixserverlib.Event {
+		return network.MustCreateEvent(t, srv, room.RoomID, b.Event{
+			Type:     "m.room.name",
+			StateKey: b.Ptr(""),
+			Sender:   sender,
+			Content:  map[string]interface{}{"name": name},
+		})
+	}
+	name1 := setName(srv1, alice, "srv1")
+	name2 := setName(srv2, bobJoin.Sender(), "srv2")
+	room1 := network.Room(t, srv1, room.RoomID)
+	room2 := network.Room(t, srv2, room.RoomID)
+	if room1.CurrentState("m.room.name", "").EventID() != name1.EventID() {
+		t.Errorf("srv1 should only see its own name event while partitioned")
+	}
+	if room2.CurrentState("m.room.name", "").EventID() != name2.EventID() {
+		t.Errorf("srv2 should only see its own name event while partitioned")
+	}
+
+	network.Heal(srv1, srv2)
+	if len(room1.ForwardExtremities) != 2 || len(room2.ForwardExtremities) != 2 {
+		t.Fatalf("expected both servers to have 2 forward extremities, got %v and %v", room1.ForwardExtremities, room2.ForwardExtremities)
+	}
+	resolved1 := room1.CurrentState("m.room.name", "").EventID()
+	resolved2 := room2.CurrentState("m.room.name", "").EventID()
+	if resolved1 != resolved2 {
+		t.Errorf("servers resolved state differently: %s and %s", resolved1, resolved2)
+	}
+}
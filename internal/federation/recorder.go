@@ -0,0 +1,255 @@
+package federation
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// RecordedRequest is an inbound request which was made to the Complement server.
+type RecordedRequest struct {
+	// When the request was received
+	Time   time.Time
+	Method string
+	// The path of the request, without the query string
+	Path  string
+	Query string
+	// The server which made the request, taken from the X-Matrix Authorization header. Empty if the
+	// request was not signed. Use Verified to check the signature.
+	Origin string
+	Header http.Header
+	Body   []byte
+
+	// the request to verify the signature of, which is only done when asked for as it may fetch keys
+	verification *requestVerification
+}
+
+type requestVerification struct {
+	once     sync.Once
+	srv      *Server
+	req      *http.Request
+	verified bool
+}
+
+// Verified returns true if the request signature can be verified against the keys of the Origin. The
+// signature is verified the first time this is called.
+func (r RecordedRequest) Verified() bool {
+	if r.verification == nil {
+		return false
+	}
+	v := r.verification
+	v.once.Do(func() {
+		fedReq, _ := gomatrixserverlib.VerifyHTTPRequest(
+			v.req, time.Now(), gomatrixserverlib.ServerName(v.srv.serverName), v.srv.keyRing,
+		)
+		v.verified = fedReq != nil
+		v.req = nil
+	})
+	return v.verified
+}
+
+// RequestMatcher returns true if the recorded request is one the test is interested in.
+type RequestMatcher func(req RecordedRequest) bool
+
+// MatchMethod matches requests with the given HTTP method.
+func MatchMethod(method string) RequestMatcher {
+	return func(req RecordedRequest) bool {
+		return req.Method == method
+	}
+}
+
+// MatchPathPrefix matches requests whose path starts with the given prefix e.g "/_matrix/federation/v1/make_join/".
+func MatchPathPrefix(prefix string) RequestMatcher {
+	return func(req RecordedRequest) bool {
+		return strings.HasPrefix(req.Path, prefix)
+	}
+}
+
+// MatchPathRegexp matches requests whose path matches the given regular expression. Panics if the regexp is invalid.
+func MatchPathRegexp(expr string) RequestMatcher {
+	re := regexp.MustCompile(expr)
+	return func(req RecordedRequest) bool {
+		return re.MatchString(req.Path)
+	}
+}
+
+// MatchOrigin matches requests which were signed by the given server, regardless of whether the signature
+// could be verified.
+func MatchOrigin(origin string) RequestMatcher {
+	return func(req RecordedRequest) bool {
+		return req.Origin == origin
+	}
+}
+
+// MatchVerified matches requests whose signature can be verified. Verification may fetch the keys of the
+// origin, so put this after cheaper matchers.
+func MatchVerified() RequestMatcher {
+	return func(req RecordedRequest) bool {
+		return req.Verified()
+	}
+}
+
+// Recorder keeps a record of every inbound request to a Complement server, in the order they were received.
+// Use Server.Recorder() to access it.
+type Recorder struct {
+	mu       sync.Mutex
+	requests []RecordedRequest
+	// closed and replaced whenever a new request is recorded, to wake up waiters
+	notify chan struct{}
+}
+
+func newRecorder() *Recorder {
+	return &Recorder{
+		notify: make(chan struct{}),
+	}
+}
+
+// Requests returns all the recorded requests which match all of the matchers, in the order they were received.
+func (r *Recorder) Requests(matchers ...RequestMatcher) []RecordedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return filterRequests(r.requests, matchers)
+}
+
+// MustWaitForRequests blocks until at least `count` recorded requests match all of the matchers, and returns
+// the matching requests. Requests received before this function was called are included. Fails the test if
+// there are not enough matching requests before the timeout.
+func (r *Recorder) MustWaitForRequests(t *testing.T, timeout time.Duration, count int, matchers ...RequestMatcher) []RecordedRequest {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		matching := filterRequests(r.requests, matchers)
+		notify := r.notify
+		r.mu.Unlock()
+		if len(matching) >= count {
+			return matching
+		}
+		select {
+		case <-notify:
+			continue
+		case <-deadline:
+			t.Fatalf("Recorder.MustWaitForRequests: timed out after %v waiting for %d requests, got %d", timeout, count, len(matching))
+			return nil
+		}
+	}
+}
+
+// MustReceiveExactly waits for the whole timeout then fails the test unless exactly `count` recorded requests
+// match all of the matchers, e.g to check that the homeserver made exactly one /make_join request. It fails
+// as soon as there are more than `count` matching requests, without waiting for the timeout.
+func (r *Recorder) MustReceiveExactly(t *testing.T, timeout time.Duration, count int, matchers ...RequestMatcher) []RecordedRequest {
+	t.Helper()
+	tooMany := func(matching []RecordedRequest) {
+		t.Helper()
+		paths := make([]string, len(matching))
+		for i := range matching {
+			paths[i] = matching[i].Method + " " + matching[i].Path
+		}
+		t.Fatalf("Recorder.MustReceiveExactly: wanted %d requests, got %d: %v", count, len(matching), paths)
+	}
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		matching := filterRequests(r.requests, matchers)
+		notify := r.notify
+		r.mu.Unlock()
+		if len(matching) > count {
+			tooMany(matching)
+			return nil
+		}
+		select {
+		case <-notify:
+			continue
+		case <-deadline:
+		}
+		// requests may have been recorded since the last check, so check them all again
+		r.mu.Lock()
+		matching = filterRequests(r.requests, matchers)
+		r.mu.Unlock()
+		if len(matching) > count {
+			tooMany(matching)
+			return nil
+		}
+		if len(matching) < count {
+			t.Fatalf("Recorder.MustReceiveExactly: wanted %d requests after %v, got %d", count, timeout, len(matching))
+			return nil
+		}
+		return matching
+	}
+}
+
+// Reset forgets all recorded requests.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = nil
+}
+
+func (r *Recorder) record(req RecordedRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// handler returns an http.Handler which records every request to the server before passing it to `next`.
+// This wraps the entire router, so it also records requests which no handler is registered for.
+func (r *Recorder) handler(srv *Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorded := RecordedRequest{
+			Time:   time.Now(),
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  req.URL.RawQuery,
+			Header: req.Header.Clone(),
+		}
+		if req.Body != nil {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				srv.t.Logf("Recorder: failed to read body of %s %s: %s", req.Method, req.URL.Path, err)
+			}
+			recorded.Body = body
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if authHeader := req.Header.Get("Authorization"); authHeader != "" {
+			_, origin, _, _, _ := gomatrixserverlib.ParseAuthorization(authHeader)
+			recorded.Origin = string(origin)
+			// keep a copy of the request to verify later, as verification consumes the body
+			verifyReq := req.Clone(context.Background())
+			verifyReq.Body = ioutil.NopCloser(bytes.NewReader(recorded.Body))
+			recorded.verification = &requestVerification{
+				srv: srv,
+				req: verifyReq,
+			}
+		}
+		r.record(recorded)
+		next.ServeHTTP(w, req)
+	})
+}
+
+func filterRequests(requests []RecordedRequest, matchers []RequestMatcher) []RecordedRequest {
+	var result []RecordedRequest
+	for _, req := range requests {
+		matches := true
+		for _, m := range matchers {
+			if !m(req) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			result = append(result, req)
+		}
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package federation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestRecorderRecordsAllRequests(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	}, HandleKeyRequests())
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: caCertPool,
+	}}}
+
+	resp, err := client.Get("https://" + srv.ServerName() + "/_matrix/key/v2/server")
+	if err != nil {
+		t.Fatalf("Failed to GET: %s", err)
+	}
+	resp.Body.Close()
+	resp, err = client.Post("https://"+srv.ServerName()+"/_matrix/federation/v1/unknown?foo=bar", "application/json", bytes.NewBufferString(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatalf("Failed to POST: %s", err)
+	}
+	resp.Body.Close()
+
+	recorder := srv.Recorder()
+	if got := len(recorder.Requests()); got != 2 {
+		t.Fatalf("expected 2 recorded requests, got %d", got)
+	}
+	reqs := recorder.MustReceiveExactly(t, time.Second, 1, MatchMethod("POST"), MatchPathPrefix("/_matrix/federation/v1/"))
+	if string(reqs[0].Body) != `{"hello":"world"}` {
+		t.Errorf("recorded wrong body: %s", string(reqs[0].Body))
+	}
+	if reqs[0].Query != "foo=bar" {
+		t.Errorf("recorded wrong query: %s", reqs[0].Query)
+	}
+	if reqs[0].Origin != "" || reqs[0].Verified() {
+		t.Errorf("unsigned request was recorded with origin '%s' verified=%v", reqs[0].Origin, reqs[0].Verified())
+	}
+	if got := recorder.Requests(MatchVerified()); len(got) != 0 {
+		t.Errorf("expected no verified requests, got %d", len(got))
+	}
+}
+
+func TestRecorderMustReceiveExactlyCountsLateRequests(t *testing.T) {
+	recorder := newRecorder()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		recorder.record(RecordedRequest{Method: "PUT", Path: "/_matrix/federation/v1/send/1"})
+	}()
+	start := time.Now()
+	reqs := recorder.MustReceiveExactly(t, 300*time.Millisecond, 1, MatchMethod("PUT"))
+	if len(reqs) != 1 || reqs[0].Path != "/_matrix/federation/v1/send/1" {
+		t.Errorf("got requests %v, want the request recorded during the wait", reqs)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("returned after %v, want it to wait for the whole timeout", elapsed)
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/har"
+	"github.com/matrix-org/complement/runtime"
 )
 
 // Server represents a federation server
@@ -52,6 +54,19 @@ type Server struct {
 	aliases               map[string]string
 	rooms                 map[string]*ServerRoom
 	keyRing               *gomatrixserverlib.KeyRing
+
+	hooksMu            sync.Mutex
+	stateHooks         map[string][]StateRequestHook // endpoint ("state" or "state_ids") -> hooks
+	missingEventsHooks []MissingEventsHook           // nil until HandleGetMissingEventsRequests is applied
+	backfillHooks      []BackfillHook                // nil until HandleBackfillRequests is applied
+
+	recorder *Recorder
+
+	faultsMu sync.Mutex
+	faults   []*FaultRule
+
+	// the network this server belongs to, if any
+	network *Network
 }
 
 // NewServer creates a new federation server with configured options.
@@ -72,6 +87,8 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 		serverName:                  deployment.Config.HostnameRunningComplement,
 		rooms:                       make(map[string]*ServerRoom),
 		aliases:                     make(map[string]string),
+		stateHooks:                  make(map[string][]StateRequestHook),
+		recorder:                    newRecorder(),
 		UnexpectedRequestsAreErrors: true,
 	}
 	fetcher := &basicKeyFetcher{
@@ -95,6 +112,7 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 			h.ServeHTTP(w, r)
 		})
 	})
+	srv.mux.Use(srv.faultMiddleware)
 	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if srv.UnexpectedRequestsAreErrors {
 			body, _ := ioutil.ReadAll(req.Body)
@@ -107,7 +125,11 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 	})
 
 	// generate certs and an http.Server
-	httpServer, certPath, keyPath, err := federationServer(deployment.Config, srv.mux)
+	handler := srv.recorder.handler(srv, srv.mux)
+	if deployment.HAR != nil {
+		handler = deployment.HAR.Handler(har.KindFederationInbound, handler)
+	}
+	httpServer, certPath, keyPath, err := federationServer(deployment.Config, handler)
 	if err != nil {
 		t.Fatalf("complement: unable to create federation server and certificates: %s", err.Error())
 	}
@@ -157,7 +179,15 @@ func (s *Server) MakeAliasMapping(aliasLocalpart, roomID string) string {
 
 // MustMakeRoom will add a room to this server so it is accessible to other servers when prompted via federation.
 // The `events` will be added to this room. Returns the created room.
+//
+// If `roomVer` is empty, the room version being tested by runtime.RunForEachRoomVersion is used.
 func (s *Server) MustMakeRoom(t *testing.T, roomVer gomatrixserverlib.RoomVersion, events []b.Event) *ServerRoom {
+	if roomVer == "" {
+		roomVer = runtime.RoomVersion(t)
+		if roomVer == "" {
+			t.Fatalf("MustMakeRoom() called without a room version outside of runtime.RunForEachRoomVersion")
+		}
+	}
 	if !s.listening {
 		s.t.Fatalf("MustMakeRoom() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room ID. Ensure you Listen() first!")
 	}
@@ -173,7 +203,9 @@ func (s *Server) MustMakeRoom(t *testing.T, roomVer gomatrixserverlib.RoomVersio
 	// sign all these events
 	for _, ev := range events {
 		signedEvent := s.MustCreateEvent(t, room, ev)
-		room.AddEvent(signedEvent)
+		if err := room.AddEvent(signedEvent); err != nil {
+			t.Fatalf("MustMakeRoom: %s", err)
+		}
 	}
 	s.rooms[roomID] = room
 	return room
@@ -292,7 +324,15 @@ func (s *Server) MustCreateEvent(t *testing.T, room *ServerRoom, ev b.Event) *go
 		if err != nil {
 			t.Fatalf("MustCreateEvent: failed to work out auth_events : %s", err)
 		}
-		eb.AuthEvents = room.AuthEvents(stateNeeded)
+		if prevEventIDs, ok := prevEvents.([]string); ok && ev.PrevEvents != nil {
+			// the event may be on a different branch of the DAG, so use the state at its prev events
+			eb.AuthEvents, err = room.AuthEventsAt(prevEventIDs, stateNeeded)
+			if err != nil {
+				t.Fatalf("MustCreateEvent: failed to work out auth_events from prev_events: %s", err)
+			}
+		} else {
+			eb.AuthEvents = room.AuthEvents(stateNeeded)
+		}
 	}
 	signedEvent, err := eb.Build(time.Now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, room.Version)
 	if err != nil {
@@ -321,10 +361,10 @@ func (s *Server) MustJoinRoom(t *testing.T, deployment *docker.Deployment, remot
 	}
 	stateEvents := sendJoinResp.StateEvents.UntrustedEvents(roomVer)
 	room := newRoom(roomVer, roomID)
-	for _, ev := range stateEvents {
-		room.replaceCurrentState(ev)
+	room.replaceCurrentState(stateEvents...)
+	if err = room.AddEvent(joinEvent); err != nil {
+		t.Fatalf("MustJoinRoom: %s", err)
 	}
-	room.AddEvent(joinEvent)
 	s.rooms[roomID] = room
 
 	t.Logf("Server.MustJoinRoom joined room ID %s", roomID)
@@ -364,7 +404,9 @@ func (s *Server) MustLeaveRoom(t *testing.T, deployment *docker.Deployment, remo
 	if err != nil {
 		t.Fatalf("MustLeaveRoom: send_leave failed: %v", err)
 	}
-	room.AddEvent(leaveEvent)
+	if err = room.AddEvent(leaveEvent); err != nil {
+		t.Fatalf("MustLeaveRoom: %s", err)
+	}
 	s.rooms[roomID] = room
 
 	t.Logf("Server.MustLeaveRoom left room ID %s", roomID)
@@ -404,6 +446,12 @@ func (s *Server) ValidFederationRequest(t *testing.T, handler func(fr *gomatrixs
 	}
 }
 
+// Recorder returns the record of every inbound request made to this server, including requests which no
+// handler was registered for.
+func (s *Server) Recorder() *Recorder {
+	return s.recorder
+}
+
 // Mux returns this server's router so you can attach additional paths.
 func (s *Server) Mux() *mux.Router {
 	return s.mux
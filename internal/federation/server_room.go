@@ -12,12 +12,19 @@ import (
 
 // ServerRoom represents a room on this test federation server
 type ServerRoom struct {
-	Version            gomatrixserverlib.RoomVersion
-	RoomID             string
-	State              map[string]*gomatrixserverlib.Event
-	Timeline           []*gomatrixserverlib.Event
+	Version  gomatrixserverlib.RoomVersion
+	RoomID   string
+	State    map[string]*gomatrixserverlib.Event
+	Timeline []*gomatrixserverlib.Event
+	// The events in the DAG which have no children. If there is more than one, the current state
+	// is the result of resolving the state after each of them.
 	ForwardExtremities []string
 	Depth              int64
+
+	// The state before and after each event in Timeline, keyed by event ID. Snapshots are never
+	// modified once stored, so events which don't change the state share them.
+	stateBefore map[string]map[string]*gomatrixserverlib.Event
+	stateAfter  map[string]map[string]*gomatrixserverlib.Event
 }
 
 // newRoom creates an empty room structure with no events
@@ -27,30 +34,156 @@ func newRoom(roomVer gomatrixserverlib.RoomVersion, roomId string) *ServerRoom {
 		Version:            roomVer,
 		State:              make(map[string]*gomatrixserverlib.Event),
 		ForwardExtremities: make([]string, 0),
+		stateBefore:        make(map[string]map[string]*gomatrixserverlib.Event),
+		stateAfter:         make(map[string]map[string]*gomatrixserverlib.Event),
 	}
 }
 
-// AddEvent adds a new event to the timeline, updating current state if it is a state event.
-// Updates depth and forward extremities.
-func (r *ServerRoom) AddEvent(ev *gomatrixserverlib.Event) {
+// AddEvent adds a new event to the timeline, recording the state before and after it in the DAG.
+// The state before the event is worked out from its prev_events, running state resolution if it has
+// more than one. Updates depth, forward extremities and current state.
+//
+// If none of the prev_events are known to the room (e.g the room was joined over federation) the
+// current state is used as the state before the event. Returns an error if state resolution fails, in
+// which case the event is not added. This can only happen when the event merges branches of the DAG.
+func (r *ServerRoom) AddEvent(ev *gomatrixserverlib.Event) error {
+	before, err := r.stateBeforeEvents(ev.PrevEventIDs())
+	if err != nil {
+		return fmt.Errorf("AddEvent: cannot work out the state before event %s: %w", ev.EventID(), err)
+	}
+	after := before
 	if ev.StateKey() != nil {
-		r.replaceCurrentState(ev)
+		after = make(map[string]*gomatrixserverlib.Event, len(before)+1)
+		for k, v := range before {
+			after[k] = v
+		}
+		after[stateTuple(ev.Type(), *ev.StateKey())] = ev
+	}
+	// update extremities
+	prevEventIDs := make(map[string]bool)
+	for _, prevEventID := range ev.PrevEventIDs() {
+		prevEventIDs[prevEventID] = true
 	}
+	extremities := []string{}
+	for _, eventID := range r.ForwardExtremities {
+		if !prevEventIDs[eventID] && eventID != ev.EventID() {
+			extremities = append(extremities, eventID)
+		}
+	}
+	forwardExtremities := append(extremities, ev.EventID())
+
+	// the current state is the state after all the forward extremities, including this event
+	oldAfter, existed := r.stateAfter[ev.EventID()]
+	r.stateAfter[ev.EventID()] = after
+	state, err := r.stateBeforeEvents(forwardExtremities)
+	if err != nil {
+		if existed {
+			r.stateAfter[ev.EventID()] = oldAfter
+		} else {
+			delete(r.stateAfter, ev.EventID())
+		}
+		return fmt.Errorf("AddEvent: cannot work out the current state after event %s: %w", ev.EventID(), err)
+	}
+	r.stateBefore[ev.EventID()] = before
 	r.Timeline = append(r.Timeline, ev)
-	// update extremities and depth
 	if ev.Depth() > r.Depth {
 		r.Depth = ev.Depth()
 	}
-	r.ForwardExtremities = []string{ev.EventID()}
+	r.ForwardExtremities = forwardExtremities
+	r.State = state
+	return nil
+}
+
+// MustAddEvent adds a new event to the timeline like AddEvent, failing the test if it cannot be added.
+func (r *ServerRoom) MustAddEvent(t *testing.T, ev *gomatrixserverlib.Event) {
+	t.Helper()
+	if err := r.AddEvent(ev); err != nil {
+		t.Fatalf("MustAddEvent: %s", err)
+	}
+}
+
+// hasEvent returns true if the event has been added to the room.
+func (r *ServerRoom) hasEvent(eventID string) bool {
+	_, ok := r.stateAfter[eventID]
+	return ok
+}
+
+// stateBeforeEvents returns the state of the room for an event whose prev_events are the given events,
+// resolving state if the events are on different branches of the DAG.
+func (r *ServerRoom) stateBeforeEvents(prevEventIDs []string) (map[string]*gomatrixserverlib.Event, error) {
+	var states []map[string]*gomatrixserverlib.Event
+	for _, prevEventID := range prevEventIDs {
+		if state, ok := r.stateAfter[prevEventID]; ok {
+			states = append(states, state)
+		}
+	}
+	switch {
+	case len(states) == 0 && len(prevEventIDs) == 0:
+		// this is the create event
+		return make(map[string]*gomatrixserverlib.Event), nil
+	case len(states) == 0:
+		return r.State, nil
+	case len(states) == 1:
+		return states[0], nil
+	}
+	return r.resolveState(states)
+}
+
+// resolveState merges the given state snapshots, running state resolution for any (type, state_key)
+// which has a different event in different snapshots.
+func (r *ServerRoom) resolveState(states []map[string]*gomatrixserverlib.Event) (map[string]*gomatrixserverlib.Event, error) {
+	merged := make(map[string]*gomatrixserverlib.Event)
+	conflicted := false
+	var allEvents []*gomatrixserverlib.Event
+	seen := make(map[string]bool)
+	for _, state := range states {
+		for k, ev := range state {
+			if existing, ok := merged[k]; ok && existing.EventID() != ev.EventID() {
+				conflicted = true
+			}
+			merged[k] = ev
+			if !seen[ev.EventID()] {
+				seen[ev.EventID()] = true
+				allEvents = append(allEvents, ev)
+			}
+		}
+	}
+	if !conflicted {
+		return merged, nil
+	}
+	resolved, err := gomatrixserverlib.ResolveConflicts(r.Version, allEvents, r.AuthChainForEvents(allEvents))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve state in room %s: %w", r.RoomID, err)
+	}
+	result := make(map[string]*gomatrixserverlib.Event, len(resolved))
+	for _, ev := range resolved {
+		result[stateTuple(ev.Type(), *ev.StateKey())] = ev
+	}
+	return result, nil
 }
 
 // AuthEvents returns the state event IDs of the auth events which authenticate this event
 func (r *ServerRoom) AuthEvents(sn gomatrixserverlib.StateNeeded) (eventIDs []string) {
+	return authEventsFromState(r.State, sn)
+}
+
+// AuthEventsAt returns the state event IDs of the auth events which authenticate an event with the
+// given prev_events, based on the state at those events rather than the current state. Returns an error
+// if the prev_events are on different branches of the DAG and state resolution fails.
+func (r *ServerRoom) AuthEventsAt(prevEventIDs []string, sn gomatrixserverlib.StateNeeded) (eventIDs []string, err error) {
+	state, err := r.stateBeforeEvents(prevEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	return authEventsFromState(state, sn), nil
+}
+
+func authEventsFromState(state map[string]*gomatrixserverlib.Event, sn gomatrixserverlib.StateNeeded) (eventIDs []string) {
 	// Guard against returning a nil string slice
 	eventIDs = make([]string, 0)
 
 	appendIfExists := func(evType, stateKey string) {
-		ev := r.CurrentState(evType, stateKey)
+		ev := state[stateTuple(evType, stateKey)]
 		if ev == nil {
 			return
 		}
@@ -71,17 +204,27 @@ func (r *ServerRoom) AuthEvents(sn gomatrixserverlib.StateNeeded) (eventIDs []st
 	return
 }
 
-// replaceCurrentState inserts a new state event for this room or replaces current state depending
+func stateTuple(evType, stateKey string) string {
+	return fmt.Sprintf("%s\x1f%s", evType, stateKey)
+}
+
+// replaceCurrentState inserts new state events for this room or replaces current state depending
 // on the (type, state_key) provided.
-func (r *ServerRoom) replaceCurrentState(ev *gomatrixserverlib.Event) {
-	tuple := fmt.Sprintf("%s\x1f%s", ev.Type(), *ev.StateKey())
-	r.State[tuple] = ev
+func (r *ServerRoom) replaceCurrentState(events ...*gomatrixserverlib.Event) {
+	// copy the map once for all the events, as it may be a snapshot
+	state := make(map[string]*gomatrixserverlib.Event, len(r.State)+len(events))
+	for k, v := range r.State {
+		state[k] = v
+	}
+	for _, ev := range events {
+		state[stateTuple(ev.Type(), *ev.StateKey())] = ev
+	}
+	r.State = state
 }
 
 // CurrentState returns the state event for the given (type, state_key) or nil.
 func (r *ServerRoom) CurrentState(evType, stateKey string) *gomatrixserverlib.Event {
-	tuple := fmt.Sprintf("%s\x1f%s", evType, stateKey)
-	return r.State[tuple]
+	return r.State[stateTuple(evType, stateKey)]
 }
 
 // AllCurrentState returns all the current state events
@@ -92,6 +235,35 @@ func (r *ServerRoom) AllCurrentState() (events []*gomatrixserverlib.Event) {
 	return
 }
 
+// StateAtEvent returns the state of the room before the given event, which is what the /state and
+// /state_ids federation endpoints return. The event itself is not included even if it is a state event.
+// Returns an error if the event is not in the timeline.
+func (r *ServerRoom) StateAtEvent(eventID string) ([]*gomatrixserverlib.Event, error) {
+	state, ok := r.stateBefore[eventID]
+	if !ok {
+		return nil, fmt.Errorf("StateAtEvent: unknown event %s in room %s", eventID, r.RoomID)
+	}
+	return stateEvents(state), nil
+}
+
+// StateAfterEvent returns the state of the room after the given event. If the event is a state event
+// it is included. Returns an error if the event is not in the timeline.
+func (r *ServerRoom) StateAfterEvent(eventID string) ([]*gomatrixserverlib.Event, error) {
+	state, ok := r.stateAfter[eventID]
+	if !ok {
+		return nil, fmt.Errorf("StateAfterEvent: unknown event %s in room %s", eventID, r.RoomID)
+	}
+	return stateEvents(state), nil
+}
+
+func stateEvents(state map[string]*gomatrixserverlib.Event) []*gomatrixserverlib.Event {
+	events := make([]*gomatrixserverlib.Event, 0, len(state))
+	for _, ev := range state {
+		events = append(events, ev)
+	}
+	return events
+}
+
 // AuthChain returns all auth events for all events in the current state TODO: recursively
 func (r *ServerRoom) AuthChain() (chain []*gomatrixserverlib.Event) {
 	return r.AuthChainForEvents(r.AllCurrentState())
@@ -235,6 +407,49 @@ func InitialRoomEvents(roomVer gomatrixserverlib.RoomVersion, creator string) []
 	}
 }
 
+// walkBackwards walks the DAG backwards from the given events breadth first, following prev_events, and
+// returns at most `limit` events in the order they were visited. The starting events themselves are only
+// returned if includeFrom is set. The walk does not go past any event in `earliest`, which are not
+// returned, or any event with a depth lower than minDepth. Events which are not in the room are skipped.
+func (r *ServerRoom) walkBackwards(fromEventIDs, earliest []string, minDepth int64, limit int, includeFrom bool) []*gomatrixserverlib.Event {
+	eventsByID := make(map[string]*gomatrixserverlib.Event, len(r.Timeline))
+	for _, ev := range r.Timeline {
+		eventsByID[ev.EventID()] = ev
+	}
+	visited := make(map[string]bool)
+	for _, eventID := range earliest {
+		visited[eventID] = true
+	}
+	var queue []string
+	if includeFrom {
+		queue = append(queue, fromEventIDs...)
+	} else {
+		for _, eventID := range fromEventIDs {
+			visited[eventID] = true
+			if ev, ok := eventsByID[eventID]; ok {
+				queue = append(queue, ev.PrevEventIDs()...)
+			}
+		}
+	}
+
+	var result []*gomatrixserverlib.Event
+	for len(queue) > 0 && len(result) < limit {
+		eventID := queue[0]
+		queue = queue[1:]
+		if visited[eventID] {
+			continue
+		}
+		visited[eventID] = true
+		ev, ok := eventsByID[eventID]
+		if !ok || ev.Depth() < minDepth {
+			continue
+		}
+		result = append(result, ev)
+		queue = append(queue, ev.PrevEventIDs()...)
+	}
+	return result
+}
+
 // EventIDsOrReferences converts a list of events into a list of EventIDs or EventReferences,
 // depending on the room version
 func (r *ServerRoom) EventIDsOrReferences(events []*gomatrixserverlib.Event) (refs []interface{}) {
@@ -0,0 +1,161 @@
+package federation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestServerRoomTracksDAG(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV9, InitialRoomEvents(gomatrixserverlib.RoomVersionV9, alice))
+	forkPoint := room.ForwardExtremities[0]
+
+	// Create two branches from the same point, each with a different room name:
+	//
+	//          +-- A (name "A") <-- B (topic)
+	//          v                            \
+	// ... <-- fork                            +-- C
+	//          ^                            /
+	//          +---------- D (name "D") <--+
+	nameEvent := func(name string, prevEvents []string) *gomatrixserverlib.Event {
+		ev := srv.MustCreateEvent(t, room, b.Event{
+			Type:       "m.room.name",
+			StateKey:   b.Ptr(""),
+			Sender:     alice,
+			Content:    map[string]interface{}{"name": name},
+			PrevEvents: prevEvents,
+		})
+		room.MustAddEvent(t, ev)
+		return ev
+	}
+	eventA := nameEvent("A", []string{forkPoint})
+	eventB := srv.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.topic",
+		StateKey: b.Ptr(""),
+		Sender:   alice,
+		Content:  map[string]interface{}{"topic": "B"},
+	})
+	room.MustAddEvent(t, eventB)
+	// state resolution orders events with the same power level by origin_server_ts, so make sure D is
+	// created after A and the result doesn't depend on comparing event IDs
+	time.Sleep(2 * time.Millisecond)
+	eventD := nameEvent("D", []string{forkPoint})
+
+	if len(room.ForwardExtremities) != 2 {
+		t.Fatalf("expected 2 forward extremities, got %v", room.ForwardExtremities)
+	}
+	stateBeforeD, err := room.StateAtEvent(eventD.EventID())
+	if err != nil {
+		t.Fatalf("StateAtEvent: %s", err)
+	}
+	for _, ev := range stateBeforeD {
+		if ev.EventID() == eventA.EventID() || ev.EventID() == eventB.EventID() {
+			t.Errorf("state before D includes event %s from the other branch", ev.EventID())
+		}
+	}
+
+	// merge the branches
+	eventC := srv.MustCreateEvent(t, room, b.Event{
+		Type:    "m.room.message",
+		Sender:  alice,
+		Content: map[string]interface{}{"body": "C"},
+	})
+	room.MustAddEvent(t, eventC)
+	if len(room.ForwardExtremities) != 1 || room.ForwardExtremities[0] != eventC.EventID() {
+		t.Fatalf("expected forward extremities to be [%s], got %v", eventC.EventID(), room.ForwardExtremities)
+	}
+	if topic := room.CurrentState("m.room.topic", ""); topic == nil || topic.EventID() != eventB.EventID() {
+		t.Errorf("expected unconflicted topic from B to be in the current state")
+	}
+	// A and D were sent by the same user with the same power levels, so state resolution v2 applies them in
+	// origin_server_ts order and the later one, D, wins
+	if name := room.CurrentState("m.room.name", ""); name == nil || name.EventID() != eventD.EventID() {
+		t.Errorf("expected resolved room name to be from D (%s), got %v", eventD.EventID(), name)
+	}
+	stateAfterC, err := room.StateAfterEvent(eventC.EventID())
+	if err != nil {
+		t.Fatalf("StateAfterEvent: %s", err)
+	}
+	for _, ev := range stateAfterC {
+		if ev.EventID() == eventA.EventID() {
+			t.Errorf("state after C includes the losing room name from A")
+		}
+	}
+}
+
+func TestServerRoomWalkBackwards(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV9, InitialRoomEvents(gomatrixserverlib.RoomVersionV9, alice))
+	earliest := room.ForwardExtremities[0]
+	var messages []string
+	for i := 0; i < 5; i++ {
+		ev := srv.MustCreateEvent(t, room, b.Event{
+			Type:    "m.room.message",
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "message"},
+		})
+		room.MustAddEvent(t, ev)
+		messages = append(messages, ev.EventID())
+	}
+	latest := messages[len(messages)-1]
+
+	testCases := []struct {
+		name        string
+		limit       int
+		minDepth    int64
+		includeFrom bool
+		want        []string
+	}{
+		{
+			name:  "stops at earliest events",
+			limit: 100,
+			want:  []string{messages[3], messages[2], messages[1], messages[0]},
+		},
+		{
+			name:  "stops at limit",
+			limit: 2,
+			want:  []string{messages[3], messages[2]},
+		},
+		{
+			name:        "includes starting events",
+			limit:       2,
+			includeFrom: true,
+			want:        []string{messages[4], messages[3]},
+		},
+		{
+			name:     "stops at min depth",
+			limit:    100,
+			minDepth: room.Depth - 2,
+			want:     []string{messages[3], messages[2]},
+		},
+	}
+	for _, tc := range testCases {
+		got := eventIDs(room.walkBackwards([]string{latest}, []string{earliest}, tc.minDepth, tc.limit, tc.includeFrom))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
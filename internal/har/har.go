@@ -0,0 +1,340 @@
+// Package har records HTTP traffic in a HAR-like JSON format (http://www.softwareishard.com/blog/har-12-spec/),
+// so the requests a test made can be inspected, replayed against another homeserver and the responses diffed.
+//
+// Complement specific information is stored in fields prefixed with an underscore, which HAR viewers ignore.
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of traffic which can be recorded.
+const (
+	// Requests made by CS API clients to a homeserver.
+	KindCSAPI = "csapi"
+	// Federation requests made by Complement to a homeserver.
+	KindFederationOutbound = "federation_outbound"
+	// Federation requests made by a homeserver to Complement.
+	KindFederationInbound = "federation_inbound"
+)
+
+// HAR is the top level object in a HAR file.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+	// The blueprint which was deployed when the traffic was recorded.
+	Blueprint string `json:"_blueprint,omitempty"`
+	// The users in the blueprint, as a map of user ID to HS name. These users already existed
+	// when the traffic was recorded, so need to exist before the traffic can be replayed.
+	Users map[string]string `json:"_users,omitempty"`
+	// The access tokens of the users in the blueprint, as a map of user ID to access token.
+	AccessTokens map[string]string `json:"_accessTokens,omitempty"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// The total time taken in milliseconds.
+	Time     float64  `json:"time"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+	// One of the Kind constants.
+	Kind string `json:"_kind"`
+	// The HS name the request was made to or from.
+	HSName string `json:"_hsName,omitempty"`
+	// Set if the request failed without a response.
+	Error string `json:"_error,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Recorder records HTTP traffic. It is safe to use from many goroutines.
+type Recorder struct {
+	mu  sync.Mutex
+	log Log
+}
+
+// NewRecorder makes a recorder for traffic to a deployment of the given blueprint. `accessTokens` is a map
+// of HS name to the user ID => access token map for the users in the blueprint.
+func NewRecorder(blueprint string, accessTokens map[string]map[string]string) *Recorder {
+	r := &Recorder{
+		log: Log{
+			Version:      "1.2",
+			Creator:      Creator{Name: "complement", Version: "1"},
+			Entries:      []Entry{},
+			Blueprint:    blueprint,
+			Users:        make(map[string]string),
+			AccessTokens: make(map[string]string),
+		},
+	}
+	for hsName, tokens := range accessTokens {
+		for userID, token := range tokens {
+			r.log.Users[userID] = hsName
+			r.log.AccessTokens[userID] = token
+		}
+	}
+	return r
+}
+
+// Entries returns a copy of the entries recorded so far.
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry{}, r.log.Entries...)
+}
+
+// WriteFile writes everything recorded so far to a HAR file.
+func (r *Recorder) WriteFile(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(HAR{Log: r.log}, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("WriteFile: failed to marshal HAR: %w", err)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ReadFile reads a HAR file written by Recorder.WriteFile.
+func ReadFile(path string) (*HAR, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var h HAR
+	if err = json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("ReadFile: %s is not valid HAR JSON: %w", path, err)
+	}
+	return &h, nil
+}
+
+// Wrap returns a round tripper which records every request made through `rt`.
+func (r *Recorder) Wrap(hsName, kind string, rt http.RoundTripper) http.RoundTripper {
+	return &roundTripper{
+		recorder: r,
+		hsName:   hsName,
+		kind:     kind,
+		wrap:     rt,
+	}
+}
+
+// Handler returns a handler which records every request served by `next`. The response is streamed to the
+// client as it is written, so handlers which flush or abort part way through behave as they would without
+// recording. Aborted requests are recorded with what was written before the handler panicked.
+func (r *Recorder) Handler(kind string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		reqBody := readBody(&req.Body)
+		tee := &teeResponseWriter{ResponseWriter: w}
+		defer func() {
+			entry := newEntry(start, kind, req.Host, req, reqBody)
+			entry.Request.URL = "https://" + req.Host + req.URL.RequestURI()
+			err := recover()
+			entry.Response = newResponse(tee.result(req, err != nil), tee.body.Bytes())
+			entry.Time = float64(time.Since(start)) / float64(time.Millisecond)
+			if err != nil {
+				entry.Error = fmt.Sprintf("handler aborted the response: %v", err)
+			}
+			r.add(entry)
+			if err != nil {
+				panic(err)
+			}
+		}()
+		next.ServeHTTP(tee, req)
+	})
+}
+
+// teeResponseWriter writes the response to the wrapped ResponseWriter and keeps a copy of it.
+type teeResponseWriter struct {
+	http.ResponseWriter
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *teeResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *teeResponseWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *teeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// result returns the response written so far, for recording. The status is 0 if the handler aborted before
+// writing anything, as no response was sent.
+func (w *teeResponseWriter) result(req *http.Request, aborted bool) *http.Response {
+	res := &http.Response{
+		StatusCode: w.code,
+		Proto:      req.Proto,
+		Header:     w.header,
+	}
+	if w.code == 0 && aborted {
+		res.Header = http.Header{}
+	} else if w.code == 0 {
+		// nothing was written, so the server responds with 200 and the current headers
+		res.StatusCode = http.StatusOK
+		res.Header = w.ResponseWriter.Header().Clone()
+	}
+	return res
+}
+
+func (r *Recorder) add(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log.Entries = append(r.log.Entries, entry)
+}
+
+type roundTripper struct {
+	recorder *Recorder
+	hsName   string
+	kind     string
+	wrap     http.RoundTripper
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	reqBody := readBody(&req.Body)
+	entry := newEntry(start, t.kind, t.hsName, req, reqBody)
+	res, err := t.wrap.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		t.recorder.add(entry)
+		return res, err
+	}
+	resBody := readBody(&res.Body)
+	entry.Response = newResponse(res, resBody)
+	entry.Time = float64(time.Since(start)) / float64(time.Millisecond)
+	t.recorder.add(entry)
+	return res, err
+}
+
+// readBody reads the whole body and replaces it with a copy so it can be read again.
+func readBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return data
+}
+
+func newEntry(start time.Time, kind, hsName string, req *http.Request, body []byte) Entry {
+	entry := Entry{
+		StartedDateTime: start,
+		Time:            float64(time.Since(start)) / float64(time.Millisecond),
+		Kind:            kind,
+		HSName:          hsName,
+		Request: Request{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Headers:     nameValues(req.Header),
+			QueryString: nameValues(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+	}
+	if body != nil {
+		entry.Request.PostData = &PostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(body),
+		}
+	}
+	return entry
+}
+
+func newResponse(res *http.Response, body []byte) Response {
+	return Response{
+		Status:      res.StatusCode,
+		StatusText:  http.StatusText(res.StatusCode),
+		HTTPVersion: res.Proto,
+		Headers:     nameValues(res.Header),
+		Content: Content{
+			Size:     len(body),
+			MimeType: res.Header.Get("Content-Type"),
+			Text:     string(body),
+		},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func nameValues(m map[string][]string) []NameValue {
+	nvs := []NameValue{}
+	for name, values := range m {
+		for _, v := range values {
+			nvs = append(nvs, NameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nvs, func(i, j int) bool {
+		return nvs[i].Name < nvs[j].Name
+	})
+	return nvs
+}
@@ -0,0 +1,65 @@
+package har
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecorderRoundTripAndHandler(t *testing.T) {
+	rec := NewRecorder("alice", map[string]map[string]string{
+		"hs1": {"@alice:hs1": "token"},
+	})
+	srv := httptest.NewServer(rec.Handler(KindFederationInbound, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"echo":` + string(body) + `}`))
+	})))
+	defer srv.Close()
+
+	cli := &http.Client{Transport: rec.Wrap("hs1", KindCSAPI, http.DefaultTransport)}
+	res, err := cli.Post(srv.URL+"/foo?bar=baz", "application/json", strings.NewReader(`"hello"`))
+	if err != nil {
+		t.Fatalf("failed to POST: %s", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != `{"echo":"hello"}` {
+		t.Fatalf("recording changed the response body: got %s", string(body))
+	}
+
+	path := filepath.Join(t.TempDir(), "test.har")
+	if err = rec.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	h, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if h.Log.Users["@alice:hs1"] != "hs1" || h.Log.AccessTokens["@alice:hs1"] != "token" {
+		t.Errorf("got users %v tokens %v", h.Log.Users, h.Log.AccessTokens)
+	}
+	if len(h.Log.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(h.Log.Entries))
+	}
+	// the handler finishes before the round tripper, so is recorded first
+	inbound, outbound := h.Log.Entries[0], h.Log.Entries[1]
+	if inbound.Kind != KindFederationInbound || outbound.Kind != KindCSAPI || outbound.HSName != "hs1" {
+		t.Errorf("got kinds %s and %s", inbound.Kind, outbound.Kind)
+	}
+	for _, entry := range h.Log.Entries {
+		if entry.Request.Method != "POST" || entry.Request.PostData == nil || entry.Request.PostData.Text != `"hello"` {
+			t.Errorf("%s: got request %+v", entry.Kind, entry.Request)
+		}
+		if entry.Response.Status != 201 || entry.Response.Content.Text != `{"echo":"hello"}` {
+			t.Errorf("%s: got response %+v", entry.Kind, entry.Response)
+		}
+		if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "baz" {
+			t.Errorf("%s: got query string %+v", entry.Kind, entry.Request.QueryString)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package instruction
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
@@ -10,6 +13,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,6 +66,10 @@ type Runner struct {
 	bestEffort bool
 	// set to true if the runner should stop
 	terminate atomic.Value
+	// Optional map of HS name to registration shared secret. If set for a HS, users are registered via the
+	// shared-secret registration admin API and then logged in, so the HS does not need open registration and
+	// users which already exist are reused. This is used when running against homeservers which are not in containers.
+	RegistrationSharedSecrets map[string]string
 }
 
 func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
@@ -115,6 +123,42 @@ func (r *Runner) DeviceIDs(hsDomain string) map[string]string {
 	return res
 }
 
+// AddUser stores the access token and device ID of a user who already exists, such as one in the image of a
+// parent blueprint, so instructions can be run as them.
+func (r *Runner) AddUser(userID, accessToken, deviceID string) {
+	r.lookup.Store("user_"+userID, accessToken)
+	if deviceID != "" {
+		r.lookup.Store("device_"+userID, deviceID)
+	}
+}
+
+// AddRoomRef stores the room ID of a room with a Ref which already exists, such as one in the image of a parent
+// blueprint, along with the HS name of the homeserver which created it, so instructions can join and send events to it.
+func (r *Runner) AddRoomRef(ref, roomID, hsName string) {
+	r.lookup.Store("room_ref_"+ref, roomID)
+	r.lookup.Store("room_ref_"+ref+"_server_name", hsName)
+}
+
+// RoomRefs returns the room IDs of all rooms with a Ref which have been created, keyed by Ref, along with the
+// HS names of the homeservers which created them.
+func (r *Runner) RoomRefs() (roomIDs map[string]string, hsNames map[string]string) {
+	roomIDs = make(map[string]string)
+	hsNames = make(map[string]string)
+	r.lookup.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		if !strings.HasPrefix(key, "room_ref_") || strings.HasSuffix(key, "_server_name") {
+			return true
+		}
+		ref := strings.TrimPrefix(key, "room_ref_")
+		roomIDs[ref] = v.(string)
+		if hsName, ok := r.lookup.Load(key + "_server_name"); ok {
+			hsNames[ref] = hsName.(string)
+		}
+		return true
+	})
+	return roomIDs, hsNames
+}
+
 // Load a previously stored value from RunInstructions
 func (r *Runner) GetStoredValue(opts RunOpts, key string) string {
 	fullKey := opts.StoreNamespace + key
@@ -189,6 +233,27 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 	return resErr
 }
 
+// Describe returns a human readable list of the HTTP requests which Run would make to the homeserver, without
+// making them. Requests are grouped into sets: sets run concurrently, and the requests within a set run in order.
+// All user sets run before any room sets. Values only known at runtime, such as room IDs, are shown as {placeholders}.
+func (r *Runner) Describe(hs b.Homeserver) []string {
+	var lines []string
+	describe := func(kind string, sets [][]instruction) {
+		for i, set := range sets {
+			if len(set) == 0 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s set %d:", kind, i))
+			for _, instr := range set {
+				lines = append(lines, "  "+instr.String())
+			}
+		}
+	}
+	describe("user", calculateUserInstructionSets(r, hs))
+	describe("room", calculateRoomInstructionSets(r, hs))
+	return lines
+}
+
 func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []instruction) error {
 	i := 0
 	cli := http.Client{
@@ -225,6 +290,11 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 					return err
 				}
 			}
+			if instr.ignoreErrcode != "" && gjson.GetBytes(body, "errcode").Str == instr.ignoreErrcode {
+				r.log("%s : ignoring %s from %s", contextStr, instr.ignoreErrcode, req.URL.String())
+				req, instr, i = r.next(instrs, hsURL, i)
+				continue
+			}
 			if res.StatusCode < 200 || res.StatusCode >= 300 {
 				r.log("INSTRUCTION: %+v\n", instr)
 				err = isFatalErr(fmt.Errorf("%s : request %s returned HTTP %s : %s", contextStr, req.URL.String(), res.Status, string(body)))
@@ -368,6 +438,47 @@ type instruction struct {
 	storeResponse map[string]string
 	// Optional: A function to create the request body from the lookup map provided. Only used if `body` is <nil>.
 	bodyFn func(lk *sync.Map) interface{}
+	// Optional: An error code which should not be treated as a failure e.g M_USER_IN_USE. The response is not stored.
+	ignoreErrcode string
+}
+
+// String returns the instruction as e.g `PUT /_matrix/client/v3/rooms/{room_0}/send/m.room.message/0 as @alice:hs1 {"body":"hi"}`
+func (i *instruction) String() string {
+	placeholder := func(v string) string {
+		if v != "" && v[0] == '.' {
+			return "{" + strings.TrimPrefix(v, ".") + "}"
+		}
+		return v
+	}
+	path := i.path
+	for k, v := range i.substitutions {
+		path = strings.Replace(path, k, placeholder(v), -1)
+	}
+	query := make([]string, 0, len(i.queryParams))
+	for k, v := range i.queryParams {
+		query = append(query, k+"="+placeholder(v))
+	}
+	sort.Strings(query)
+	if len(query) > 0 {
+		path += "?" + strings.Join(query, "&")
+	}
+	str := i.method + " " + path
+	if i.accessToken != "" {
+		str += " as " + strings.TrimPrefix(i.accessToken, "user_")
+	}
+	if i.body != nil {
+		body, err := json.Marshal(i.body)
+		if err != nil {
+			body = []byte(err.Error())
+		}
+		if len(body) > 200 {
+			body = append(body[:200], []byte("...")...)
+		}
+		str += " " + string(body)
+	} else if i.bodyFn != nil {
+		str += " {body computed at runtime}"
+	}
+	return str
 }
 
 // url returns the complete path resolved url for this instruction. Query parameters must be
@@ -402,7 +513,16 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		i := indexFor(user.Localpart, r.userConcurrency)
 		instrs := sets[i]
 
-		if createdUsers[user.Localpart] {
+		if secret := r.RegistrationSharedSecrets[hs.Name]; secret != "" {
+			if !createdUsers[user.Localpart] {
+				// the user may already exist from an earlier run, so login regardless
+				instrs = append(instrs, instructionSharedSecretRegister(hs, user, secret)...)
+			}
+			instrs = append(instrs, instructionLogin(hs, user))
+			if !createdUsers[user.Localpart] && user.DisplayName != "" {
+				instrs = append(instrs, instructionDisplayName(hs, user))
+			}
+		} else if createdUsers[user.Localpart] {
 			// login instead as the device ID may be different
 			instrs = append(instrs, instructionLogin(hs, user))
 		} else {
@@ -564,6 +684,42 @@ func instructionRegister(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
+// instructionSharedSecretRegister registers a user via the shared-secret registration admin API, which is
+// supported by Synapse and Dendrite. It needs a nonce from the server before the request can be signed.
+func instructionSharedSecretRegister(hs b.Homeserver, user b.User, secret string) []instruction {
+	nonceKey := "nonce_@" + user.Localpart + ":" + hs.Name
+	password := "complement_meets_min_pasword_req_" + user.Localpart
+	return []instruction{
+		{
+			method: "GET",
+			path:   "/_synapse/admin/v1/register",
+			storeResponse: map[string]string{
+				nonceKey: ".nonce",
+			},
+		},
+		{
+			method: "POST",
+			path:   "/_synapse/admin/v1/register",
+			bodyFn: func(lk *sync.Map) interface{} {
+				var nonce string
+				if v, ok := lk.Load(nonceKey); ok {
+					nonce = v.(string)
+				}
+				mac := hmac.New(sha1.New, []byte(secret))
+				mac.Write([]byte(nonce + "\x00" + user.Localpart + "\x00" + password + "\x00notadmin"))
+				return map[string]interface{}{
+					"nonce":    nonce,
+					"username": user.Localpart,
+					"password": password,
+					"admin":    false,
+					"mac":      hex.EncodeToString(mac.Sum(nil)),
+				}
+			},
+			ignoreErrcode: "M_USER_IN_USE",
+		},
+	}
+}
+
 func instructionDisplayName(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"displayname": user.DisplayName,
@@ -0,0 +1,352 @@
+// Package report writes a machine-readable report of a Complement run, as JUnit XML and JSON. Each test which
+// deploys a blueprint gets an entry with its result, deploy timings, the logs of every homeserver it used and
+// a transcript of the CS API requests it made. The report can then be merged with the output of `go test -json`
+// to add every other test and subtest, along with the output of each test.
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ResultPass = "pass"
+	ResultFail = "fail"
+	ResultSkip = "skip"
+)
+
+// Deploy is one deployment made by a test.
+type Deploy struct {
+	Blueprint string `json:"blueprint"`
+	// The time taken to construct the blueprint, if it did not already exist.
+	BlueprintTime time.Duration `json:"blueprint_time_ns"`
+	// The time taken to start the containers.
+	ContainersTime time.Duration `json:"containers_time_ns"`
+}
+
+// Test is the report entry for a single test.
+type Test struct {
+	Name     string        `json:"name"`
+	Result   string        `json:"result"`
+	Duration time.Duration `json:"duration_ns"`
+	Deploys  []Deploy      `json:"deploys"`
+	// A map of HS name to its container logs. If a test deployed more than once, the HS name is
+	// prefixed with the blueprint name.
+	HomeserverLogs map[string]string `json:"homeserver_logs"`
+	// The CS API requests made by clients in this test, in the order they were logged.
+	Transcript []string `json:"transcript"`
+	// The output of the test, which is only known once the report is merged with `go test -json`.
+	Output string `json:"output,omitempty"`
+
+	mu    sync.Mutex
+	start time.Time
+}
+
+// AddDeploy records that the test deployed a blueprint.
+func (t *Test) AddDeploy(blueprint string, blueprintTime, containersTime time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Deploys = append(t.Deploys, Deploy{
+		Blueprint:      blueprint,
+		BlueprintTime:  blueprintTime,
+		ContainersTime: containersTime,
+	})
+}
+
+// AddHomeserverLogs attaches the container logs for a homeserver.
+func (t *Test) AddHomeserverLogs(blueprint, hsName, logs string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.HomeserverLogs[hsName]; exists {
+		hsName = blueprint + "." + hsName
+	}
+	t.HomeserverLogs[hsName] = logs
+}
+
+// AddTranscript appends a line to the CS API transcript. This is safe to call from many goroutines.
+func (t *Test) AddTranscript(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Transcript = append(t.Transcript, fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339Nano), line))
+}
+
+// Reporter collects report entries for all the tests in a package.
+type Reporter struct {
+	pkg string
+	// the import path of the Go package, to match the tests in `go test -json` output
+	goPkg string
+
+	mu    sync.Mutex
+	tests map[string]*Test
+	order []string
+}
+
+// NewReporter returns a reporter for the tests in the given package namespace, which are in the Go package
+// with the given import path.
+func NewReporter(pkg, goPkg string) *Reporter {
+	return &Reporter{
+		pkg:   pkg,
+		goPkg: goPkg,
+		tests: make(map[string]*Test),
+	}
+}
+
+// ReadReporter loads a JSON report written by WriteFiles, so it can be merged with `go test -json` output.
+func ReadReporter(path string) (*Reporter, error) {
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadReporter: %w", err)
+	}
+	var jsonReport reportJSON
+	if err = json.Unmarshal(jsonBytes, &jsonReport); err != nil {
+		return nil, fmt.Errorf("ReadReporter: failed to unmarshal %s: %w", path, err)
+	}
+	r := NewReporter(jsonReport.Package, jsonReport.GoPackage)
+	for _, t := range jsonReport.Tests {
+		r.tests[t.Name] = t
+		r.order = append(r.order, t.Name)
+	}
+	return r, nil
+}
+
+// Test returns the report entry for this test, making it if it does not exist. The result and duration are
+// filled in when the test finishes. Returns nil if the reporter is nil, so callers don't need to check whether
+// reporting is enabled.
+func (r *Reporter) Test(t *testing.T) *Test {
+	if r == nil {
+		return nil
+	}
+	entry, created := r.entry(t.Name())
+	if !created {
+		return entry
+	}
+	t.Cleanup(func() {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		entry.Duration = time.Since(entry.start)
+		switch {
+		case t.Skipped():
+			entry.Result = ResultSkip
+		case t.Failed():
+			entry.Result = ResultFail
+		default:
+			entry.Result = ResultPass
+		}
+	})
+	return entry
+}
+
+// testEvent is a line of `go test -json` output, see `go doc test2json`.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// AddTestEvents reads the output of `go test -json` and adds the result, duration and output of every test
+// and subtest in this reporter's Go package, making entries for tests which never deployed a blueprint.
+// Lines which are not test events are ignored, so the output can be mixed with stderr.
+func (r *Reporter) AddTestEvents(events io.Reader) error {
+	scanner := bufio.NewScanner(events)
+	// tests can log very long lines e.g response bodies
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Package != r.goPkg || ev.Test == "" {
+			continue
+		}
+		entry, _ := r.entry(ev.Test)
+		entry.mu.Lock()
+		switch ev.Action {
+		case "output":
+			entry.Output += ev.Output
+		case "pass":
+			entry.Result = ResultPass
+		case "fail":
+			entry.Result = ResultFail
+		case "skip":
+			entry.Result = ResultSkip
+		}
+		if ev.Action == "pass" || ev.Action == "fail" || ev.Action == "skip" {
+			entry.Duration = time.Duration(ev.Elapsed * float64(time.Second))
+		}
+		entry.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("AddTestEvents: %w", err)
+	}
+	return nil
+}
+
+// entry returns the report entry for the named test, making it if it does not exist.
+func (r *Reporter) entry(name string) (entry *Test, created bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.tests[name]; ok {
+		return entry, false
+	}
+	entry = &Test{
+		Name:           name,
+		HomeserverLogs: make(map[string]string),
+		start:          time.Now(),
+	}
+	r.tests[name] = entry
+	r.order = append(r.order, name)
+	return entry, true
+}
+
+// Tests returns all report entries in the order the tests started.
+func (r *Reporter) Tests() []*Test {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tests := make([]*Test, len(r.order))
+	for i, name := range r.order {
+		tests[i] = r.tests[name]
+	}
+	return tests
+}
+
+// WriteFiles writes the report as complement-$pkg.json and complement-$pkg.xml in the given directory.
+func (r *Reporter) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("WriteFiles: failed to make directory %s: %w", dir, err)
+	}
+	tests := r.Tests()
+	for _, t := range tests {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+	jsonBytes, err := json.MarshalIndent(reportJSON{r.pkg, r.goPkg, tests}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("WriteFiles: failed to marshal JSON: %w", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "complement-"+r.pkg+".json"), jsonBytes, 0644); err != nil {
+		return fmt.Errorf("WriteFiles: %w", err)
+	}
+	xmlBytes, err := xml.MarshalIndent(junitSuites(r.pkg, tests), "", "  ")
+	if err != nil {
+		return fmt.Errorf("WriteFiles: failed to marshal XML: %w", err)
+	}
+	xmlBytes = append([]byte(xml.Header), xmlBytes...)
+	if err = ioutil.WriteFile(filepath.Join(dir, "complement-"+r.pkg+".xml"), xmlBytes, 0644); err != nil {
+		return fmt.Errorf("WriteFiles: %w", err)
+	}
+	return nil
+}
+
+type reportJSON struct {
+	Package   string  `json:"package"`
+	GoPackage string  `json:"go_package"`
+	Tests     []*Test `json:"tests"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName  string          `xml:"classname,attr"`
+	Name       string          `xml:"name,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Failure    *junitMessage   `xml:"failure,omitempty"`
+	Skipped    *junitMessage   `xml:"skipped,omitempty"`
+	SystemOut  string          `xml:"system-out,omitempty"`
+	SystemErr  string          `xml:"system-err,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+func junitSuites(pkg string, tests []*Test) junitTestSuites {
+	suite := junitTestSuite{
+		Name: pkg,
+	}
+	var total time.Duration
+	for _, t := range tests {
+		tc := junitTestCase{
+			ClassName: pkg,
+			Name:      t.Name,
+			Time:      seconds(t.Duration),
+			SystemOut: strings.Join(t.Transcript, "\n"),
+		}
+		for i, d := range t.Deploys {
+			prefix := fmt.Sprintf("deploy.%d.", i)
+			tc.Properties = append(tc.Properties,
+				junitProperty{Name: prefix + "blueprint", Value: d.Blueprint},
+				junitProperty{Name: prefix + "blueprint_time", Value: seconds(d.BlueprintTime)},
+				junitProperty{Name: prefix + "containers_time", Value: seconds(d.ContainersTime)},
+			)
+		}
+		hsNames := make([]string, 0, len(t.HomeserverLogs))
+		for hsName := range t.HomeserverLogs {
+			hsNames = append(hsNames, hsName)
+		}
+		sort.Strings(hsNames)
+		var logs strings.Builder
+		for _, hsName := range hsNames {
+			fmt.Fprintf(&logs, "============== %s : SERVER LOGS ==============\n%s\n", hsName, t.HomeserverLogs[hsName])
+		}
+		tc.SystemErr = logs.String()
+		switch t.Result {
+		case ResultFail:
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: summarise(t.Output, "test failed"), Output: t.Output}
+		case ResultSkip:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: summarise(t.Output, "test skipped"), Output: t.Output}
+		}
+		suite.Tests++
+		total += t.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = seconds(total)
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+// summarise returns the first message logged by a test e.g "main_test.go:42: Deploy: Failed to construct
+// blueprint", or `fallback` if it logged nothing.
+func summarise(output, fallback string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "=== ") || strings.HasPrefix(line, "--- ") {
+			continue
+		}
+		return line
+	}
+	return fallback
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
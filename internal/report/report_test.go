@@ -0,0 +1,135 @@
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporterWriteFiles(t *testing.T) {
+	r := NewReporter("test", "example.com/tests")
+	t.Run("group", func(t *testing.T) {
+		t.Run("passes", func(t *testing.T) {
+			entry := r.Test(t)
+			entry.AddDeploy("alice", time.Second, 2*time.Second)
+			entry.AddTranscript("[CSAPI] GET hs1/_matrix/client/versions => 200 OK (1ms)")
+			entry.AddHomeserverLogs("alice", "hs1", "server started")
+		})
+		t.Run("skips", func(t *testing.T) {
+			r.Test(t)
+			t.Skip("skipping")
+		})
+	})
+	var nilReporter *Reporter
+	if nilReporter.Test(t) != nil {
+		t.Errorf("nil reporter returned a report entry")
+	}
+
+	dir := t.TempDir()
+	if err := r.WriteFiles(dir); err != nil {
+		t.Fatalf("WriteFiles: %s", err)
+	}
+
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(dir, "complement-test.json"))
+	if err != nil {
+		t.Fatalf("failed to read JSON report: %s", err)
+	}
+	var jsonReport struct {
+		Tests []*Test `json:"tests"`
+	}
+	if err = json.Unmarshal(jsonBytes, &jsonReport); err != nil {
+		t.Fatalf("failed to unmarshal JSON report: %s", err)
+	}
+	if len(jsonReport.Tests) != 2 {
+		t.Fatalf("got %d tests, want 2", len(jsonReport.Tests))
+	}
+	pass := jsonReport.Tests[0]
+	if pass.Name != "TestReporterWriteFiles/group/passes" || pass.Result != ResultPass {
+		t.Errorf("got %s => %s, want passing test", pass.Name, pass.Result)
+	}
+	if len(pass.Deploys) != 1 || pass.Deploys[0].Blueprint != "alice" || pass.Deploys[0].ContainersTime != 2*time.Second {
+		t.Errorf("got deploys %+v", pass.Deploys)
+	}
+	if pass.HomeserverLogs["hs1"] != "server started" || len(pass.Transcript) != 1 {
+		t.Errorf("got logs %v transcript %v", pass.HomeserverLogs, pass.Transcript)
+	}
+	if jsonReport.Tests[1].Result != ResultSkip {
+		t.Errorf("got %s, want skipped test", jsonReport.Tests[1].Result)
+	}
+
+	xmlBytes, err := ioutil.ReadFile(filepath.Join(dir, "complement-test.xml"))
+	if err != nil {
+		t.Fatalf("failed to read XML report: %s", err)
+	}
+	var suites junitTestSuites
+	if err = xml.Unmarshal(xmlBytes, &suites); err != nil {
+		t.Fatalf("failed to unmarshal XML report: %s", err)
+	}
+	if len(suites.Suites) != 1 || suites.Suites[0].Tests != 2 || suites.Suites[0].Skipped != 1 || suites.Suites[0].Failures != 0 {
+		t.Errorf("got suites %+v", suites.Suites)
+	}
+}
+
+func TestReporterAddTestEvents(t *testing.T) {
+	r := NewReporter("test", "example.com/tests")
+	t.Run("TestDeploys", func(t *testing.T) {
+		r.Test(t).AddDeploy("alice", time.Second, 2*time.Second)
+	})
+	dir := t.TempDir()
+	if err := r.WriteFiles(dir); err != nil {
+		t.Fatalf("WriteFiles: %s", err)
+	}
+	r, err := ReadReporter(filepath.Join(dir, "complement-test.json"))
+	if err != nil {
+		t.Fatalf("ReadReporter: %s", err)
+	}
+
+	events := `{"Action":"run","Package":"example.com/tests","Test":"TestReporterAddTestEvents/TestDeploys"}
+{"Action":"pass","Package":"example.com/tests","Test":"TestReporterAddTestEvents/TestDeploys","Elapsed":3}
+{"Action":"run","Package":"example.com/tests","Test":"TestSkipped"}
+{"Action":"output","Package":"example.com/tests","Test":"TestSkipped","Output":"    hs.go:12: skipped on dendrite\n"}
+{"Action":"skip","Package":"example.com/tests","Test":"TestSkipped","Elapsed":0}
+# some output on stderr
+{"Action":"run","Package":"example.com/tests","Test":"TestFails/subtest"}
+{"Action":"output","Package":"example.com/tests","Test":"TestFails/subtest","Output":"=== RUN   TestFails/subtest\n"}
+{"Action":"output","Package":"example.com/tests","Test":"TestFails/subtest","Output":"    fails_test.go:42: wrong event ID\n"}
+{"Action":"fail","Package":"example.com/tests","Test":"TestFails/subtest","Elapsed":1.5}
+{"Action":"fail","Package":"example.com/other","Test":"TestOtherPackage","Elapsed":1}
+`
+	if err = r.AddTestEvents(strings.NewReader(events)); err != nil {
+		t.Fatalf("AddTestEvents: %s", err)
+	}
+	tests := r.Tests()
+	if len(tests) != 3 {
+		t.Fatalf("got %d tests, want 3", len(tests))
+	}
+	if tests[0].Result != ResultPass || len(tests[0].Deploys) != 1 || tests[0].Duration != 3*time.Second {
+		t.Errorf("got deploying test %+v", tests[0])
+	}
+	if tests[1].Name != "TestSkipped" || tests[1].Result != ResultSkip {
+		t.Errorf("got %s => %s, want skipped test", tests[1].Name, tests[1].Result)
+	}
+	if tests[2].Name != "TestFails/subtest" || tests[2].Result != ResultFail || tests[2].Duration != 1500*time.Millisecond {
+		t.Errorf("got %s => %s in %v, want failed subtest", tests[2].Name, tests[2].Result, tests[2].Duration)
+	}
+
+	if err = r.WriteFiles(dir); err != nil {
+		t.Fatalf("WriteFiles: %s", err)
+	}
+	xmlBytes, err := ioutil.ReadFile(filepath.Join(dir, "complement-test.xml"))
+	if err != nil {
+		t.Fatalf("failed to read XML report: %s", err)
+	}
+	var suites junitTestSuites
+	if err = xml.Unmarshal(xmlBytes, &suites); err != nil {
+		t.Fatalf("failed to unmarshal XML report: %s", err)
+	}
+	failure := suites.Suites[0].Cases[2].Failure
+	if failure == nil || failure.Message != "fails_test.go:42: wrong event ID" || !strings.Contains(failure.Output, "wrong event ID") {
+		t.Errorf("got failure %+v", failure)
+	}
+}
@@ -0,0 +1,170 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Result is the outcome of running a scenario or one of its steps.
+type Result struct {
+	Name     string
+	Passed   bool
+	Duration time.Duration
+	// Why the step failed, prefixed with the file and line of the step.
+	Error string
+	// The results of each step which was run, for scenarios.
+	Steps []Result
+}
+
+// Run runs the steps of the scenario in order against the deployment, which must be a deployment of the
+// scenario's blueprint. Stops at the first failing step. If `out` is not nil, a line is written to it as each
+// step starts, in the same format as `go test -v`.
+func (s *Scenario) Run(dep *docker.Deployment, out io.Writer) Result {
+	start := time.Now()
+	res := Result{
+		Name:   testName(s.Name),
+		Passed: true,
+	}
+	if out != nil {
+		fmt.Fprintf(out, "=== RUN   %s\n", res.Name)
+	}
+	cli := &http.Client{Timeout: 30 * time.Second}
+	vars := make(map[string]string)
+	for _, step := range s.Steps {
+		stepStart := time.Now()
+		stepRes := Result{
+			Name:   res.Name + "/" + testName(step.Name),
+			Passed: true,
+		}
+		if out != nil {
+			fmt.Fprintf(out, "=== RUN   %s\n", stepRes.Name)
+		}
+		if err := step.run(cli, dep, vars); err != nil {
+			stepRes.Passed = false
+			stepRes.Error = fmt.Sprintf("%s:%d: %s", s.file, step.line, err)
+		}
+		stepRes.Duration = time.Since(stepStart)
+		res.Steps = append(res.Steps, stepRes)
+		if !stepRes.Passed {
+			res.Passed = false
+			break
+		}
+	}
+	res.Duration = time.Since(start)
+	return res
+}
+
+// Print writes the result in the same format as `go test`. If verbose is false, passing steps are not printed.
+func (r Result) Print(out io.Writer, verbose bool) {
+	r.print(out, "", verbose)
+}
+
+func (r Result) print(out io.Writer, indent string, verbose bool) {
+	status := "PASS"
+	if !r.Passed {
+		status = "FAIL"
+	}
+	if !verbose && r.Passed {
+		return
+	}
+	fmt.Fprintf(out, "%s--- %s: %s (%.2fs)\n", indent, status, r.Name, r.Duration.Seconds())
+	if r.Error != "" {
+		fmt.Fprintf(out, "%s    %s\n", indent, r.Error)
+	}
+	for _, step := range r.Steps {
+		step.print(out, indent+"    ", verbose)
+	}
+}
+
+func (step Step) run(cli *http.Client, dep *docker.Deployment, vars map[string]string) error {
+	hsName := step.HS
+	if hsName == "" && step.User != "" {
+		segments := strings.SplitN(step.User, ":", 2)
+		if len(segments) == 2 {
+			hsName = segments[1]
+		}
+	}
+	hsDep, ok := dep.HS[hsName]
+	if !ok {
+		return fmt.Errorf("unknown HS '%s', set `hs` or `user`", hsName)
+	}
+	var body io.Reader
+	if step.Body != nil {
+		b, err := json.Marshal(substituteAll(step.Body, vars))
+		if err != nil {
+			return fmt.Errorf("failed to marshal body: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	reqURL := hsDep.BaseURL + substitute(step.Path, vars, url.PathEscape)
+	req, err := http.NewRequest(step.Method, reqURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	query := req.URL.Query()
+	for k, v := range step.Query {
+		query.Set(k, substitute(v, vars, func(s string) string { return s }))
+	}
+	req.URL.RawQuery = query.Encode()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if step.User != "" {
+		token, ok := hsDep.AccessTokens[step.User]
+		if !ok {
+			return fmt.Errorf("no access token for user %s in the blueprint", step.User)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", step.Method, req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: failed to read response body: %w", step.Method, req.URL.Path, err)
+	}
+	if step.Expect.Status != 0 && res.StatusCode != step.Expect.Status {
+		return fmt.Errorf("%s %s: got HTTP %d want %d: %s", step.Method, req.URL.Path, res.StatusCode, step.Expect.Status, string(resBody))
+	}
+	if step.Expect.Status == 0 && (res.StatusCode < 200 || res.StatusCode >= 300) {
+		return fmt.Errorf("%s %s: got HTTP %d want 2xx: %s", step.Method, req.URL.Path, res.StatusCode, string(resBody))
+	}
+	if len(step.Expect.JSON) > 0 && !gjson.ValidBytes(resBody) {
+		return fmt.Errorf("%s %s: response body is not JSON: %s", step.Method, req.URL.Path, string(resBody))
+	}
+	for _, exp := range step.Expect.JSON {
+		matcher, err := exp.matcher(vars)
+		if err != nil {
+			return err
+		}
+		if err = matcher(resBody); err != nil {
+			return fmt.Errorf("%s %s: %w", step.Method, req.URL.Path, err)
+		}
+	}
+	for name, path := range step.Store {
+		val := gjson.GetBytes(resBody, path)
+		if !val.Exists() {
+			return fmt.Errorf("%s %s: cannot store %s as '%s' is missing from the response", step.Method, req.URL.Path, name, path)
+		}
+		vars[name] = val.String()
+	}
+	return nil
+}
+
+// testName formats a name like `go test` does for subtests.
+func testName(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
@@ -0,0 +1,267 @@
+// Package scenario loads declarative test scenarios from YAML or JSON files and runs them against a deployment.
+//
+// A scenario is a blueprint plus a list of HTTP steps, each with expectations on the response which map onto
+// matchers in the `match` package. This lets tests be written without writing Go. For example:
+//
+//	name: Alice can set her display name
+//	blueprint: alice
+//	steps:
+//	  - name: set display name
+//	    user: "@alice:hs1"
+//	    method: PUT
+//	    path: /_matrix/client/v3/profile/@alice:hs1/displayname
+//	    body:
+//	      displayname: Alice
+//	  - name: get display name
+//	    method: GET
+//	    path: /_matrix/client/v3/profile/@alice:hs1/displayname
+//	    hs: hs1
+//	    expect:
+//	      status: 200
+//	      json:
+//	        - key_equal: { key: displayname, value: Alice }
+//
+// Values from responses can be stored with `store: { name: gjson.path }` and used in later steps as ${name}.
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// Scenario is a single declarative test.
+type Scenario struct {
+	// The name of the test.
+	Name string `yaml:"name"`
+	// The blueprint to deploy before running the steps.
+	Blueprint BlueprintRef `yaml:"blueprint"`
+	// The steps to run in order. If a step fails, the remaining steps are not run.
+	Steps []Step `yaml:"steps"`
+
+	// the file this scenario was loaded from
+	file string
+}
+
+// BlueprintRef is either the name of one of b.KnownBlueprints, or an inline blueprint.
+type BlueprintRef struct {
+	b.Blueprint
+}
+
+func (r *BlueprintRef) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		bprint, ok := b.KnownBlueprints[value.Value]
+		if !ok {
+			return fmt.Errorf("line %d: unknown blueprint '%s'", value.Line, value.Value)
+		}
+		r.Blueprint = *bprint
+		return nil
+	}
+	var bprint b.Blueprint
+	if err := value.Decode(&bprint); err != nil {
+		return err
+	}
+	bprint, err := b.Validate(bprint)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid blueprint: %w", value.Line, err)
+	}
+	r.Blueprint = bprint
+	return nil
+}
+
+// Step is a single HTTP request, with expectations on the response.
+type Step struct {
+	// The name of this step.
+	Name string `yaml:"name"`
+	// The user ID to make the request as. The access token is taken from the blueprint.
+	// If empty, the request is not authenticated.
+	User string `yaml:"user"`
+	// The HS name to make the request to. Defaults to the domain of User.
+	HS string `yaml:"hs"`
+	// The HTTP method and path e.g GET /_matrix/client/v3/sync
+	Method string `yaml:"method"`
+	Path   string `yaml:"path"`
+	// Query parameters to add to the request.
+	Query map[string]string `yaml:"query"`
+	// The JSON body to send, if any.
+	Body interface{} `yaml:"body"`
+	// Values to store from the response body, as a map of variable name to gjson path.
+	Store map[string]string `yaml:"store"`
+	// What the response should look like. If empty, any 2xx response passes.
+	Expect Expect `yaml:"expect"`
+
+	// the line in the file this step starts on
+	line int
+}
+
+func (s *Step) UnmarshalYAML(value *yaml.Node) error {
+	type plainStep Step
+	if err := value.Decode((*plainStep)(s)); err != nil {
+		return err
+	}
+	s.line = value.Line
+	return nil
+}
+
+// Expect describes the expected response to a step.
+type Expect struct {
+	// The expected HTTP status code.
+	Status int `yaml:"status"`
+	// Matchers to run against the JSON response body.
+	JSON []JSONExpectation `yaml:"json"`
+}
+
+// JSONExpectation is a single JSON matcher. Exactly one field should be set. Keys can be nested,
+// see https://godoc.org/github.com/tidwall/gjson#Get for details.
+type JSONExpectation struct {
+	// See match.JSONKeyEqual
+	KeyEqual *KeyValue `yaml:"key_equal"`
+	// See match.JSONKeyPresent
+	KeyPresent string `yaml:"key_present"`
+	// See match.JSONKeyMissing
+	KeyMissing string `yaml:"key_missing"`
+	// See match.JSONKeyArrayOfSize
+	ArraySize *KeySize `yaml:"array_size"`
+	// See match.JSONCheckOff and match.JSONCheckOffAllowUnwanted
+	CheckOff *CheckOff `yaml:"check_off"`
+}
+
+type KeyValue struct {
+	Key   string      `yaml:"key"`
+	Value interface{} `yaml:"value"`
+}
+
+type KeySize struct {
+	Key  string `yaml:"key"`
+	Size int    `yaml:"size"`
+}
+
+type CheckOff struct {
+	Key string `yaml:"key"`
+	// The items which must each appear exactly once.
+	Items []interface{} `yaml:"items"`
+	// Optional gjson path to apply to each element before checking it off e.g "event_id".
+	// If empty, the whole element is used. For objects, the keys are checked off.
+	Field string `yaml:"field"`
+	// If true, elements which are not in Items are allowed.
+	AllowUnwanted bool `yaml:"allow_unwanted"`
+}
+
+// Load reads a scenario from a YAML or JSON file.
+func Load(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err = yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if s.Blueprint.Name == "" {
+		return nil, fmt.Errorf("%s: scenario has no blueprint", path)
+	}
+	for i, step := range s.Steps {
+		if step.Method == "" || step.Path == "" {
+			return nil, fmt.Errorf("%s:%d: step needs a method and path", path, step.line)
+		}
+		if step.Name == "" {
+			s.Steps[i].Name = step.Method + " " + step.Path
+		}
+		for _, exp := range step.Expect.JSON {
+			if _, err := exp.matcher(nil); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, step.line, err)
+			}
+		}
+	}
+	s.file = filepath.Base(path)
+	return &s, nil
+}
+
+// matcher converts the expectation into a matcher, substituting variables into any strings in wanted values.
+func (e JSONExpectation) matcher(vars map[string]string) (match.JSON, error) {
+	switch {
+	case e.KeyEqual != nil:
+		return match.JSONKeyEqual(e.KeyEqual.Key, jsonValue(substituteAll(e.KeyEqual.Value, vars))), nil
+	case e.KeyPresent != "":
+		return match.JSONKeyPresent(e.KeyPresent), nil
+	case e.KeyMissing != "":
+		return match.JSONKeyMissing(e.KeyMissing), nil
+	case e.ArraySize != nil:
+		return match.JSONKeyArrayOfSize(e.ArraySize.Key, e.ArraySize.Size), nil
+	case e.CheckOff != nil:
+		items := make([]interface{}, len(e.CheckOff.Items))
+		for i, item := range e.CheckOff.Items {
+			items[i] = jsonValue(substituteAll(item, vars))
+		}
+		field := e.CheckOff.Field
+		mapper := func(r gjson.Result) interface{} {
+			if field != "" {
+				r = r.Get(field)
+			}
+			return r.Value()
+		}
+		if e.CheckOff.AllowUnwanted {
+			return match.JSONCheckOffAllowUnwanted(e.CheckOff.Key, items, mapper, nil), nil
+		}
+		return match.JSONCheckOff(e.CheckOff.Key, items, mapper, nil), nil
+	default:
+		return nil, fmt.Errorf("json expectation must have one of key_equal, key_present, key_missing, array_size or check_off")
+	}
+}
+
+// jsonValue converts a value decoded from YAML into the form gjson.Result.Value() returns, so they can be
+// compared with reflect.DeepEqual e.g YAML ints become float64.
+func jsonValue(val interface{}) interface{} {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	return gjson.ParseBytes(data).Value()
+}
+
+var varRegexp = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// substitute replaces ${name} with the stored variable `name`, passing it through `escape`.
+func substitute(input string, vars map[string]string, escape func(string) string) string {
+	return varRegexp.ReplaceAllStringFunc(input, func(v string) string {
+		val, ok := vars[varRegexp.FindStringSubmatch(v)[1]]
+		if !ok {
+			return v
+		}
+		return escape(val)
+	})
+}
+
+// substituteAll replaces variables in every string in a value decoded from YAML.
+func substituteAll(val interface{}, vars map[string]string) interface{} {
+	switch v := val.(type) {
+	case string:
+		return substitute(v, vars, func(s string) string { return s })
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[substitute(k, vars, func(s string) string { return s })] = substituteAll(item, vars)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = substituteAll(item, vars)
+		}
+		return out
+	default:
+		return val
+	}
+}
@@ -0,0 +1,148 @@
+package scenario
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+const testScenario = `
+name: create and read room
+blueprint:
+  name: test_scenario
+  homeservers:
+    - name: hs1
+      users:
+        - localpart: "@alice"
+          displayname: Alice
+steps:
+  - name: create room
+    user: "@alice:hs1"
+    method: POST
+    path: /createRoom
+    body:
+      name: ${missing}
+    store:
+      room_id: room_id
+  - name: read room
+    user: "@alice:hs1"
+    method: GET
+    path: /rooms/${room_id}
+    query:
+      limit: "10"
+    expect:
+      status: 200
+      json:
+        - key_equal: { key: room_id, value: "${room_id}" }
+        - key_equal: { key: limit, value: 10 }
+        - key_present: events
+        - key_missing: unknown
+        - array_size: { key: events, size: 2 }
+        - check_off: { key: events, field: event_id, items: [$a, $b] }
+  - name: wrong status
+    hs: hs1
+    method: GET
+    path: /rooms/${room_id}
+    expect:
+      status: 404
+  - name: never run
+    hs: hs1
+    method: GET
+    path: /
+`
+
+func TestLoadAndRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer alice_token" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_MISSING_TOKEN"}`))
+			return
+		}
+		switch {
+		case req.URL.Path == "/createRoom":
+			body, _ := ioutil.ReadAll(req.Body)
+			if string(body) != `{"name":"${missing}"}` {
+				t.Errorf("createRoom: got body %s", string(body))
+			}
+			w.Write([]byte(`{"room_id":"!room:hs1"}`))
+		case req.URL.Path == "/rooms/!room:hs1":
+			w.Write([]byte(`{"room_id":"!room:hs1","limit":` + req.URL.Query().Get("limit") + `,"events":[{"event_id":"$b"},{"event_id":"$a"}]}`))
+		default:
+			t.Errorf("unexpected request %s", req.URL.String())
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	if err := ioutil.WriteFile(path, []byte(testScenario), 0644); err != nil {
+		t.Fatalf("failed to write scenario: %s", err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if s.Blueprint.Name != "test_scenario" || s.Blueprint.Homeservers[0].Users[0].Localpart != "alice" {
+		t.Fatalf("inline blueprint was not validated: %+v", s.Blueprint)
+	}
+	dep := &docker.Deployment{
+		HS: map[string]*docker.HomeserverDeployment{
+			"hs1": {
+				BaseURL:      srv.URL,
+				AccessTokens: map[string]string{"@alice:hs1": "alice_token"},
+			},
+		},
+	}
+	var out bytes.Buffer
+	res := s.Run(dep, &out)
+	if res.Passed {
+		t.Fatalf("scenario passed, want the 'wrong status' step to fail")
+	}
+	if len(res.Steps) != 3 {
+		t.Fatalf("got %d step results, want 3: %+v", len(res.Steps), res.Steps)
+	}
+	if !res.Steps[0].Passed || !res.Steps[1].Passed {
+		t.Fatalf("got step results %+v", res.Steps)
+	}
+	if !strings.HasPrefix(res.Steps[2].Error, "test.yaml:34: ") || !strings.Contains(res.Steps[2].Error, "got HTTP 401 want 404") {
+		t.Errorf("got error %s", res.Steps[2].Error)
+	}
+	res.Print(&out, false)
+	for _, want := range []string{
+		"=== RUN   create_and_read_room/read_room\n",
+		"--- FAIL: create_and_read_room (",
+		"    --- FAIL: create_and_read_room/wrong_status (",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "--- PASS") {
+		t.Errorf("non-verbose output contains passing steps:\n%s", out.String())
+	}
+}
+
+func TestLoadRejectsBadExpectations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+blueprint: alice
+steps:
+  - method: GET
+    path: /
+    expect:
+      json:
+        - {}
+`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write scenario: %s", err)
+	}
+	if _, err = Load(path); err == nil || !strings.Contains(err.Error(), "bad.yaml:4:") {
+		t.Fatalf("Load: got error %v, want one for line 4", err)
+	}
+}
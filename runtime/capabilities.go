@@ -0,0 +1,360 @@
+package runtime
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Feature is an optional feature, usually an MSC, which a homeserver may or may not implement.
+type Feature string
+
+const (
+	// Incrementally importing history to an existing room
+	MSC2716 Feature = "msc2716"
+	// Threaded /event_relationships
+	MSC2836 Feature = "msc2836"
+	// Jump to date via /timestamp_to_event
+	MSC3030 Feature = "msc3030"
+	// Sliding sync
+	MSC3575 Feature = "msc3575"
+)
+
+// featureProbe describes how to detect a feature: either the server advertises UnstableFeature as enabled in
+// /versions, or it recognises the Method and Path endpoint.
+type featureProbe struct {
+	UnstableFeature string
+	Method          string
+	Path            string
+}
+
+var featureProbes = map[Feature]featureProbe{
+	MSC2716: {
+		UnstableFeature: "org.matrix.msc2716",
+		Method:          "POST",
+		Path:            "/_matrix/client/unstable/org.matrix.msc2716/rooms/!probe:localhost/batch_send",
+	},
+	MSC2836: {
+		UnstableFeature: "org.matrix.msc2836",
+		Method:          "POST",
+		Path:            "/_matrix/client/unstable/event_relationships",
+	},
+	MSC3030: {
+		UnstableFeature: "org.matrix.msc3030",
+		Method:          "GET",
+		Path:            "/_matrix/client/unstable/org.matrix.msc3030/rooms/!probe:localhost/timestamp_to_event",
+	},
+	MSC3575: {
+		UnstableFeature: "org.matrix.msc3575",
+		Method:          "POST",
+		Path:            "/_matrix/client/unstable/org.matrix.msc3575/sync",
+	},
+}
+
+// Capabilities is what a homeserver says it supports, as detected by Probe.
+type Capabilities struct {
+	// The lowercased server implementation name from the federation /version endpoint e.g "synapse", or ""
+	// if unknown.
+	Server string
+	// The server implementation version from the federation /version endpoint.
+	ServerVersion string
+	// The spec versions from /versions
+	Versions []string
+	// The unstable features from /versions
+	UnstableFeatures map[string]bool
+	// The default and available room versions from /capabilities. Only set if an access token was given.
+	DefaultRoomVersion string
+	RoomVersions       map[string]string
+	// The optional features the server supports
+	Features map[Feature]bool
+}
+
+// Probe queries the homeserver at `baseURL` to find out what it supports. The server implementation is detected
+// via the federation API at `fedBaseURL` if it is not "", and room versions via /capabilities if `accessToken` is
+// not "".
+func Probe(baseURL, fedBaseURL, accessToken string) (*Capabilities, error) {
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// homeservers use self-signed certificates for federation
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true, // nolint:gosec
+			},
+		},
+	}
+	caps := &Capabilities{
+		UnstableFeatures: make(map[string]bool),
+		Features:         make(map[Feature]bool),
+	}
+	var versions struct {
+		Versions         []string        `json:"versions"`
+		UnstableFeatures map[string]bool `json:"unstable_features"`
+	}
+	if err := getJSON(httpClient, baseURL+"/_matrix/client/versions", "", &versions); err != nil {
+		return nil, fmt.Errorf("Probe: %w", err)
+	}
+	caps.Versions = versions.Versions
+	for k, v := range versions.UnstableFeatures {
+		caps.UnstableFeatures[k] = v
+	}
+	if fedBaseURL != "" {
+		var version struct {
+			Server struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"server"`
+		}
+		// not all servers implement this, so don't fail if it's missing
+		if err := getJSON(httpClient, fedBaseURL+"/_matrix/federation/v1/version", "", &version); err == nil {
+			caps.Server = strings.ToLower(version.Server.Name)
+			caps.ServerVersion = version.Server.Version
+		}
+	}
+	if accessToken != "" {
+		var capabilities struct {
+			Capabilities struct {
+				RoomVersions struct {
+					Default   string            `json:"default"`
+					Available map[string]string `json:"available"`
+				} `json:"m.room_versions"`
+			} `json:"capabilities"`
+		}
+		if err := getJSON(httpClient, baseURL+"/_matrix/client/v3/capabilities", accessToken, &capabilities); err != nil {
+			return nil, fmt.Errorf("Probe: %w", err)
+		}
+		caps.DefaultRoomVersion = capabilities.Capabilities.RoomVersions.Default
+		caps.RoomVersions = capabilities.Capabilities.RoomVersions.Available
+	}
+	for feature, probe := range featureProbes {
+		if caps.UnstableFeatures[probe.UnstableFeature] {
+			caps.Features[feature] = true
+			continue
+		}
+		recognised, err := recognisesEndpoint(httpClient, probe.Method, baseURL+probe.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Probe: %s: %w", feature, err)
+		}
+		caps.Features[feature] = recognised
+	}
+	return caps, nil
+}
+
+func getJSON(httpClient *http.Client, url, accessToken string, val interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned HTTP %d: %s", url, res.StatusCode, string(body))
+	}
+	if err = json.Unmarshal(body, val); err != nil {
+		return fmt.Errorf("GET %s returned invalid JSON: %w", url, err)
+	}
+	return nil
+}
+
+// recognisesEndpoint returns true if the server has the endpoint. The request is made without an access token,
+// so servers which have it reject the request with a 401 M_MISSING_TOKEN. Any other response, such as a 404 or
+// 400 M_UNRECOGNIZED for unknown endpoints or a 401 from a proxy, means the endpoint isn't there.
+func recognisesEndpoint(httpClient *http.Client, method, url string) (bool, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		return false, nil
+	}
+	var errResponse struct {
+		ErrCode string `json:"errcode"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&errResponse); err != nil {
+		return false, nil
+	}
+	return errResponse.ErrCode == "M_MISSING_TOKEN", nil
+}
+
+// Prober returns the capabilities of each homeserver in a deployment, keyed by HS name.
+type Prober interface {
+	Capabilities() (map[string]*Capabilities, error)
+}
+
+var (
+	// test name -> the deployment used by that test
+	probers   = make(map[string]Prober)
+	probersMu sync.RWMutex
+)
+
+// DetectCapabilities finds out what the homeserver being tested supports without a test deployment, by
+// deploying a homeserver of its own. It is set by TestMain, and called at most once, the first time Require or
+// SkipIf need to know before the test has made a deployment and no other test's deployment has been probed.
+var DetectCapabilities func() (*Capabilities, error)
+
+var (
+	// the capabilities of the homeserver being tested, from the first deployment probed or DetectCapabilities
+	detected     *Capabilities
+	detectCalled bool
+	detectedMu   sync.Mutex
+)
+
+// RegisterDeployment records the deployment being used by the test, so Require and SkipIf can check
+// what the homeservers in it support. It is unregistered when the test finishes.
+func RegisterDeployment(t *testing.T, dep Prober) {
+	name := t.Name()
+	probersMu.Lock()
+	probers[name] = dep
+	probersMu.Unlock()
+	t.Cleanup(func() {
+		probersMu.Lock()
+		delete(probers, name)
+		probersMu.Unlock()
+	})
+}
+
+// capabilities returns the capabilities of the homeservers in the deployment used by the test, or nil if
+// the test hasn't deployed anything.
+func capabilities(t *testing.T) (map[string]*Capabilities, error) {
+	probersMu.RLock()
+	var dep Prober
+	for _, name := range testNames(t) {
+		if p, ok := probers[name]; ok {
+			dep = p
+			break
+		}
+	}
+	probersMu.RUnlock()
+	if dep == nil {
+		return nil, nil
+	}
+	caps, err := dep.Capabilities()
+	if err == nil {
+		rememberCapabilities(caps)
+	}
+	return caps, err
+}
+
+// rememberCapabilities records the capabilities of a probed deployment, so tests which haven't deployed yet
+// can use them, unless the capabilities of the homeserver being tested are already known.
+func rememberCapabilities(caps map[string]*Capabilities) {
+	hsNames := make([]string, 0, len(caps))
+	for hsName := range caps {
+		hsNames = append(hsNames, hsName)
+	}
+	if len(hsNames) == 0 {
+		return
+	}
+	sort.Strings(hsNames)
+	detectedMu.Lock()
+	defer detectedMu.Unlock()
+	if detected == nil {
+		detected = caps[hsNames[0]]
+	}
+}
+
+// detectedCapabilities returns the capabilities of the homeserver being tested for a test which hasn't made a
+// deployment. These come from the first deployment probed by any test, or from DetectCapabilities if no
+// deployment has been probed yet. Returns nil if they can't be detected.
+func detectedCapabilities(t *testing.T) *Capabilities {
+	t.Helper()
+	detectedMu.Lock()
+	defer detectedMu.Unlock()
+	if detected != nil || detectCalled || DetectCapabilities == nil {
+		return detected
+	}
+	detectCalled = true
+	caps, err := DetectCapabilities()
+	if err != nil {
+		t.Logf("WARNING: failed to detect homeserver capabilities: %s", err)
+		return nil
+	}
+	detected = caps
+	return detected
+}
+
+// Require skips the test (via t.Skipf) unless every homeserver in the test's deployment supports all of the
+// features. The deployment is probed the first time this is called.
+//
+// Call this before making a deployment, so servers which don't support the features are skipped without
+// waiting for the deployment:
+//
+//	runtime.Require(t, runtime.MSC2836)
+//	deployment := Deploy(t, b.BlueprintAlice)
+//	defer deployment.Destroy(t)
+//
+// Before a deployment, the capabilities of the first deployment probed by any test are used. If there isn't
+// one yet, DetectCapabilities deploys a homeserver to find out, which only happens once per package.
+func Require(t *testing.T, features ...Feature) {
+	t.Helper()
+	caps, err := capabilities(t)
+	if err != nil {
+		t.Fatalf("runtime.Require: failed to detect homeserver capabilities: %s", err)
+	}
+	if caps == nil {
+		detected := detectedCapabilities(t)
+		if detected == nil {
+			t.Fatalf("runtime.Require: %s has not made a deployment and the homeserver's capabilities could not be detected", t.Name())
+		}
+		caps = map[string]*Capabilities{"the homeserver": detected}
+	}
+	hsNames := make([]string, 0, len(caps))
+	for hsName := range caps {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+	for _, feature := range features {
+		for _, hsName := range hsNames {
+			if !caps[hsName].Features[feature] {
+				t.Skipf("skipped as %s does not support %s", hsName, feature)
+				return
+			}
+		}
+	}
+}
+
+// detectedHomeserver returns the server implementation of the homeservers in the test's deployment, or "" if it
+// is unknown or they run different implementations. If the test hasn't made a deployment, the implementation
+// is taken from detectedCapabilities.
+func detectedHomeserver(t *testing.T) string {
+	caps, err := capabilities(t)
+	if err != nil {
+		t.Logf("WARNING: failed to detect homeserver implementation: %s", err)
+		return ""
+	}
+	if caps == nil {
+		if detected := detectedCapabilities(t); detected != nil {
+			return detected.Server
+		}
+		return ""
+	}
+	var server string
+	for _, c := range caps {
+		if c.Server == "" || (server != "" && c.Server != server) {
+			return ""
+		}
+		server = c.Server
+	}
+	return server
+}
@@ -0,0 +1,149 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type staticProber map[string]*Capabilities
+
+func (p staticProber) Capabilities() (map[string]*Capabilities, error) {
+	return p, nil
+}
+
+func TestProbe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"versions":["v1.1","v1.2"],"unstable_features":{"org.matrix.msc2716":true,"org.matrix.msc3030":false}}`))
+	})
+	mux.HandleFunc("/_matrix/federation/v1/version", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"server":{"name":"Synapse","version":"1.70.0"}}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/capabilities", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"capabilities":{"m.room_versions":{"default":"9","available":{"9":"stable","10":"stable"}}}}`))
+	})
+	mux.HandleFunc("/_matrix/client/unstable/event_relationships", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"errcode":"M_MISSING_TOKEN","error":"Missing access token"}`))
+	})
+	mux.HandleFunc("/_matrix/client/unstable/org.matrix.msc3575/sync", func(w http.ResponseWriter, req *http.Request) {
+		// e.g a proxy in front of the server which requires authentication for everything
+		w.WriteHeader(401)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	caps, err := Probe(srv.URL, srv.URL, "token")
+	if err != nil {
+		t.Fatalf("Probe returned error: %s", err)
+	}
+	if caps.Server != "synapse" || caps.ServerVersion != "1.70.0" {
+		t.Errorf("Probe: got server %s %s want synapse 1.70.0", caps.Server, caps.ServerVersion)
+	}
+	if caps.DefaultRoomVersion != "9" || len(caps.RoomVersions) != 2 {
+		t.Errorf("Probe: got room versions %s %v", caps.DefaultRoomVersion, caps.RoomVersions)
+	}
+	want := map[Feature]bool{
+		MSC2716: true,  // advertised
+		MSC2836: true,  // endpoint is recognised
+		MSC3030: false, // not advertised and 404s
+		MSC3575: false, // 401 without M_MISSING_TOKEN
+	}
+	for feature, supported := range want {
+		if caps.Features[feature] != supported {
+			t.Errorf("Probe: feature %s got %v want %v", feature, caps.Features[feature], supported)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	RegisterDeployment(t, staticProber{
+		"hs1": {Server: "synapse", Features: map[Feature]bool{MSC2716: true, MSC3030: true}},
+		"hs2": {Server: "synapse", Features: map[Feature]bool{MSC2716: true}},
+	})
+	t.Run("supported", func(t *testing.T) {
+		Require(t, MSC2716)
+	})
+	t.Run("unsupported by one server", func(t *testing.T) {
+		defer func() {
+			if !t.Skipped() {
+				t.Errorf("Require did not skip the test")
+			}
+		}()
+		Require(t, MSC2716, MSC3030)
+	})
+	t.Run("SkipIf detects the homeserver", func(t *testing.T) {
+		if Homeserver != "" {
+			t.Skipf("run with a *_blacklist tag")
+		}
+		defer func() {
+			if !t.Skipped() {
+				t.Errorf("SkipIf did not skip the test")
+			}
+		}()
+		SkipIf(t, "synapse")
+	})
+}
+
+func TestRequireBeforeDeployment(t *testing.T) {
+	detectedMu.Lock()
+	oldDetected, oldDetectCalled, oldDetect := detected, detectCalled, DetectCapabilities
+	detected, detectCalled = nil, false
+	detectCalls := 0
+	DetectCapabilities = func() (*Capabilities, error) {
+		detectCalls++
+		return &Capabilities{Server: "dendrite", Features: map[Feature]bool{MSC2716: true}}, nil
+	}
+	detectedMu.Unlock()
+	defer func() {
+		detectedMu.Lock()
+		detected, detectCalled, DetectCapabilities = oldDetected, oldDetectCalled, oldDetect
+		detectedMu.Unlock()
+	}()
+
+	t.Run("supported", func(t *testing.T) {
+		Require(t, MSC2716)
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		defer func() {
+			if !t.Skipped() {
+				t.Errorf("Require did not skip the test")
+			}
+		}()
+		Require(t, MSC3030)
+	})
+	if detectCalls != 1 {
+		t.Errorf("DetectCapabilities was called %d times, want 1", detectCalls)
+	}
+}
+
+func TestRequireBeforeDeploymentUsesProbedDeployment(t *testing.T) {
+	detectedMu.Lock()
+	oldDetected, oldDetectCalled, oldDetect := detected, detectCalled, DetectCapabilities
+	detected, detectCalled = nil, false
+	DetectCapabilities = func() (*Capabilities, error) {
+		t.Errorf("DetectCapabilities was called after a deployment was probed")
+		return nil, nil
+	}
+	detectedMu.Unlock()
+	defer func() {
+		detectedMu.Lock()
+		detected, detectCalled, DetectCapabilities = oldDetected, oldDetectCalled, oldDetect
+		detectedMu.Unlock()
+	}()
+
+	t.Run("deployed", func(t *testing.T) {
+		RegisterDeployment(t, staticProber{
+			"hs1": {Server: "synapse", Features: map[Feature]bool{MSC3030: true}},
+		})
+		Require(t, MSC3030)
+	})
+	t.Run("not deployed", func(t *testing.T) {
+		Require(t, MSC3030)
+	})
+}
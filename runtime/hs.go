@@ -13,22 +13,28 @@ var Homeserver string
 //
 // The homeserver being tested is detected via the presence of a `*_blacklist` tag e.g:
 //   go test -tags="dendrite_blacklist"
-// This means it is important to always specify this tag when running tests. Failure to do
-// so will result in a warning being printed to stdout, and the test will be run. When a new server
-// implementation is added, a respective `hs_$name.go` needs to be created in this directory. This
-// file pairs together the tag name with a string constant declared in this package
-// e.g. dendrite_blacklist == runtime.Dendrite
+// which pairs together the tag name with a string constant declared in this package
+// e.g. dendrite_blacklist == runtime.Dendrite. If no tag is given, the homeserver is asked for the server
+// name it reports over federation, lowercased e.g "synapse", so new server implementations don't need a
+// `hs_$name.go` file. The test's deployment is asked if it has made one, otherwise the homeserver is detected
+// as described in Require. If that fails, a warning is printed to stdout and the test is run.
+//
+// To skip tests for features which servers may not implement, prefer Require.
 func SkipIf(t *testing.T, hses ...string) {
 	t.Helper()
+	homeserver := Homeserver
+	if homeserver == "" {
+		homeserver = detectedHomeserver(t)
+	}
 	for _, hs := range hses {
-		if Homeserver == hs {
+		if homeserver == hs {
 			t.Skipf("skipped on %s", hs)
 			return
 		}
 	}
-	if Homeserver == "" {
-		// they ran Complement without a blacklist so it's impossible to know what HS they are
-		// running, warn them.
+	if homeserver == "" {
+		// they ran Complement without a blacklist and before making a deployment, so it's impossible
+		// to know what HS they are running, warn them.
 		t.Logf(
 			"WARNING: %s called runtime.SkipIf(%v) but Complement doesn't know which HS is running as it was run without a *_blacklist tag: executing test.",
 			t.Name(), hses,
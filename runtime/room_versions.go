@@ -0,0 +1,148 @@
+package runtime
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	// test name -> room version for tests running under RunForEachRoomVersion
+	roomVersions   = make(map[string]gomatrixserverlib.RoomVersion)
+	roomVersionsMu sync.RWMutex
+)
+
+// RunForEachRoomVersion runs `fn` as a subtest once per room version, so room version specific bugs are caught.
+// If `versions` is nil, DefaultRoomVersions() is used. Subtests are named after the room version e.g
+// "TestFoo/v9", so a single version can be run with `-run 'TestFoo/v9'`.
+//
+// Within `fn` and its subtests, RoomVersion(t) returns the room version being tested. This is used by
+// CSAPI.CreateRoom, CSAPI.GetDefaultRoomVersion and federation.Server.MustMakeRoom so rooms are created with
+// that version without the test having to pass it around. Once all versions have run, the versions which
+// failed or were skipped are logged, so a failure on one version isn't lost in the output of the others.
+//
+// If the test has made a deployment, versions which any homeserver in it doesn't advertise in the
+// `m.room_versions` capability are skipped, so call this after Deploy.
+func RunForEachRoomVersion(t *testing.T, versions []gomatrixserverlib.RoomVersion, fn func(t *testing.T, ver gomatrixserverlib.RoomVersion)) {
+	t.Helper()
+	if versions == nil {
+		versions = DefaultRoomVersions()
+	}
+	versions = sortRoomVersions(versions)
+	caps, err := capabilities(t)
+	if err != nil {
+		t.Fatalf("runtime.RunForEachRoomVersion: failed to detect homeserver capabilities: %s", err)
+	}
+	hsNames := make([]string, 0, len(caps))
+	for hsName := range caps {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+
+	var mu sync.Mutex
+	var failed, skipped []string
+	// subtests may be parallel, so only report once they have all finished
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failed) > 0 {
+			t.Logf("%s failed on room versions: %s", t.Name(), strings.Join(failed, ", "))
+		}
+		if len(skipped) > 0 {
+			t.Logf("%s skipped on room versions: %s", t.Name(), strings.Join(skipped, ", "))
+		}
+	})
+	for _, ver := range versions {
+		ver := ver
+		t.Run("v"+string(ver), func(t *testing.T) {
+			roomVersionsMu.Lock()
+			roomVersions[t.Name()] = ver
+			roomVersionsMu.Unlock()
+			t.Cleanup(func() {
+				roomVersionsMu.Lock()
+				delete(roomVersions, t.Name())
+				roomVersionsMu.Unlock()
+				mu.Lock()
+				defer mu.Unlock()
+				if t.Failed() {
+					failed = append(failed, string(ver))
+				} else if t.Skipped() {
+					skipped = append(skipped, string(ver))
+				}
+			})
+			if _, ok := gomatrixserverlib.SupportedRoomVersions()[ver]; !ok {
+				t.Skipf("room version %s is not supported by gomatrixserverlib", ver)
+			}
+			for _, hsName := range hsNames {
+				available := caps[hsName].RoomVersions
+				if _, ok := available[string(ver)]; available != nil && !ok {
+					t.Skipf("room version %s is not supported by %s", ver, hsName)
+				}
+			}
+			fn(t, ver)
+		})
+	}
+}
+
+// DefaultRoomVersions returns the room versions RunForEachRoomVersion uses when none are given: every stable
+// room version supported by gomatrixserverlib, except v1 and v2. Events in those versions refer to other events
+// by reference hashes rather than event IDs, which federation.Server.MustCreateEvent cannot make, so tests
+// which need them must ask for them explicitly and build their own prev_events and auth_events.
+func DefaultRoomVersions() []gomatrixserverlib.RoomVersion {
+	var versions []gomatrixserverlib.RoomVersion
+	for ver := range gomatrixserverlib.StableRoomVersions() {
+		if format, err := ver.EventFormat(); err != nil || format == gomatrixserverlib.EventFormatV1 {
+			continue
+		}
+		versions = append(versions, ver)
+	}
+	return sortRoomVersions(versions)
+}
+
+// RoomVersion returns the room version being tested if `t` is, or is a subtest of, a test run by
+// RunForEachRoomVersion. Otherwise returns "".
+func RoomVersion(t *testing.T) gomatrixserverlib.RoomVersion {
+	roomVersionsMu.RLock()
+	defer roomVersionsMu.RUnlock()
+	for _, name := range testNames(t) {
+		if ver, ok := roomVersions[name]; ok {
+			return ver
+		}
+	}
+	return ""
+}
+
+// testNames returns the name of the test followed by the names of its parent tests, most specific first.
+func testNames(t *testing.T) []string {
+	name := t.Name()
+	names := []string{name}
+	for i := strings.LastIndex(name, "/"); i != -1; i = strings.LastIndex(name, "/") {
+		name = name[:i]
+		names = append(names, name)
+	}
+	return names
+}
+
+// sortRoomVersions sorts numbered room versions numerically, followed by any unstable versions alphabetically.
+func sortRoomVersions(versions []gomatrixserverlib.RoomVersion) []gomatrixserverlib.RoomVersion {
+	sorted := make([]gomatrixserverlib.RoomVersion, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, errA := strconv.Atoi(string(sorted[i]))
+		b, errB := strconv.Atoi(string(sorted[j]))
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil:
+			return true
+		case errB == nil:
+			return false
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
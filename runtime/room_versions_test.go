@@ -0,0 +1,74 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRunForEachRoomVersion(t *testing.T) {
+	if ver := RoomVersion(t); ver != "" {
+		t.Fatalf("RoomVersion outside RunForEachRoomVersion: got %s want ''", ver)
+	}
+	var ran []gomatrixserverlib.RoomVersion
+	RunForEachRoomVersion(t, []gomatrixserverlib.RoomVersion{"10", "org.matrix.msc9999", "2", "9"}, func(t *testing.T, ver gomatrixserverlib.RoomVersion) {
+		ran = append(ran, ver)
+		if got := RoomVersion(t); got != ver {
+			t.Errorf("RoomVersion: got %s want %s", got, ver)
+		}
+		t.Run("nested", func(t *testing.T) {
+			if got := RoomVersion(t); got != ver {
+				t.Errorf("RoomVersion in subtest: got %s want %s", got, ver)
+			}
+		})
+	})
+	// the unknown version is skipped before fn is called
+	want := []gomatrixserverlib.RoomVersion{"2", "9", "10"}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran room versions %v, want %v", ran, want)
+	}
+	if ver := RoomVersion(t); ver != "" {
+		t.Errorf("RoomVersion after RunForEachRoomVersion: got %s want ''", ver)
+	}
+}
+
+func TestDefaultRoomVersions(t *testing.T) {
+	versions := DefaultRoomVersions()
+	if len(versions) == 0 {
+		t.Fatalf("DefaultRoomVersions: got no room versions")
+	}
+	for _, ver := range versions {
+		if ver == gomatrixserverlib.RoomVersionV1 || ver == gomatrixserverlib.RoomVersionV2 {
+			t.Errorf("DefaultRoomVersions: got room version %s, which uses event references", ver)
+		}
+		if _, ok := gomatrixserverlib.StableRoomVersions()[ver]; !ok {
+			t.Errorf("DefaultRoomVersions: got room version %s, which is not stable", ver)
+		}
+	}
+}
+
+func TestRunForEachRoomVersionSkipsUnavailable(t *testing.T) {
+	RegisterDeployment(t, staticProber{
+		"hs1": {RoomVersions: map[string]string{"2": "stable", "9": "stable", "10": "stable"}},
+		"hs2": {RoomVersions: map[string]string{"2": "stable", "9": "stable"}},
+		// the room versions of servers without users are unknown
+		"hs3": {},
+	})
+	var ran []gomatrixserverlib.RoomVersion
+	RunForEachRoomVersion(t, []gomatrixserverlib.RoomVersion{"2", "9", "10"}, func(t *testing.T, ver gomatrixserverlib.RoomVersion) {
+		ran = append(ran, ver)
+	})
+	want := []gomatrixserverlib.RoomVersion{"2", "9"}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran room versions %v, want %v", ran, want)
+	}
+}
+
+func TestSortRoomVersions(t *testing.T) {
+	got := sortRoomVersions([]gomatrixserverlib.RoomVersion{"org.matrix.msc2716v3", "10", "1", "org.matrix.msc2176", "2"})
+	want := []gomatrixserverlib.RoomVersion{"1", "2", "10", "org.matrix.msc2176", "org.matrix.msc2716v3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortRoomVersions: got %v want %v", got, want)
+	}
+}
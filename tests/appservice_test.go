@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/appservice"
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Test that events in a room the application service is interested in are pushed to it in transactions.
+func TestApplicationServiceReceivesTransactions(t *testing.T) {
+	asServer := appservice.NewServer(t, complementConfig, "my_as_id",
+		appservice.HandleTransactions(nil),
+		appservice.HandleUserQueries(nil),
+		appservice.HandleRoomAliasQueries(nil),
+	)
+	cancel := asServer.Listen()
+	defer cancel()
+
+	deployment := DeployWithApplicationServices(t, b.BlueprintHSWithApplicationService, asServer)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello application service",
+		},
+	})
+
+	asServer.MustWaitForEvent(t, 10*time.Second, func(ev gjson.Result) bool {
+		return ev.Get("event_id").Str == eventID && ev.Get("room_id").Str == roomID
+	})
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,37 +15,89 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/matrix-org/complement/internal/appservice"
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/har"
+	"github.com/matrix-org/complement/internal/report"
+	"github.com/matrix-org/complement/runtime"
 )
 
 var namespaceCounter uint64
 
-// persist the complement builder which is set when the tests start via TestMain
+// persist the complement config which is set when the tests start via TestMain
+var complementConfig *config.Complement
+
+// persist the complement builder which is set when the tests start via TestMain, unless
+// COMPLEMENT_EXTERNAL_HOMESERVERS is set
 var complementBuilder *docker.Builder
 
+// the pool of warm deployments, which is only set if COMPLEMENT_DEPLOYMENT_POOL_SIZE is set
+var complementPool *docker.DeploymentPool
+
+// the test report, which is only set if COMPLEMENT_REPORT_DIR is set
+var complementReporter *report.Reporter
+
 // TestMain is the main entry point for Complement.
 //
 // It will clean up any old containers/images/networks from the previous run, then run the tests, then clean up
 // again. No blueprints are made at this point as they are lazily made on demand.
+// When COMPLEMENT_EXTERNAL_HOMESERVERS is set, nothing is built or cleaned up as the homeservers are
+// already running.
 func TestMain(m *testing.M) {
 	cfg := config.NewConfigFromEnvVars("csapi", "")
 	log.Printf("config: %+v", cfg)
-	builder, err := docker.NewBuilder(cfg)
-	if err != nil {
-		fmt.Printf("Error: %s", err)
-		os.Exit(1)
+	complementConfig = cfg
+	// external homeservers are already running, so there are no containers or images to build or clean up
+	external := len(cfg.ExternalHomeservers) > 0
+	var err error
+	if !external {
+		complementBuilder, err = docker.NewBuilder(cfg)
+		if err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.BlueprintDir != "" {
+		if err = b.RegisterBlueprints(cfg.BlueprintDir); err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+	}
+	if complementBuilder != nil {
+		// remove any old images/containers/networks in case we died horribly before
+		complementBuilder.Cleanup()
+	}
+	// only deploy a homeserver to detect what it supports if a test needs to know before it deploys
+	runtime.DetectCapabilities = func() (*runtime.Capabilities, error) {
+		return docker.DetectCapabilities(cfg)
+	}
+	if cfg.DeploymentPoolSize > 0 && !external {
+		complementPool = docker.NewDeploymentPool(cfg, cfg.DeploymentPoolSize)
+	}
+	if cfg.ReportDir != "" {
+		// the import path of this package, to find its tests in `go test -json` output
+		goPkg := reflect.TypeOf(Waiter{}).PkgPath()
+		complementReporter = report.NewReporter(cfg.PackageNamespace, goPkg)
 	}
-	complementBuilder = builder
-	// remove any old images/containers/networks in case we died horribly before
-	builder.Cleanup()
 
 	// we use GMSL which uses logrus by default. We don't want those logs in our test output unless they are Serious.
 	logrus.SetLevel(logrus.ErrorLevel)
 
 	exitCode := m.Run()
-	builder.Cleanup()
+	if complementPool != nil {
+		log.Printf("Deployment pool: %s", complementPool.Stats())
+		complementPool.Close()
+	}
+	if complementReporter != nil {
+		if err := complementReporter.WriteFiles(cfg.ReportDir); err != nil {
+			log.Printf("Failed to write report: %s", err)
+		}
+	}
+	if complementBuilder != nil {
+		complementBuilder.Cleanup()
+	}
 	os.Exit(exitCode)
 }
 
@@ -51,25 +106,96 @@ func TestMain(m *testing.M) {
 // This function is the main setup function for all tests as it provides a deployment with
 // which tests can interact with.
 func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
+	t.Helper()
+	return deploy(t, blueprint, nil)
+}
+
+// DeployWithApplicationServices will deploy the given blueprint or terminate the test, pointing the
+// homeserver at the given application service servers instead of the URLs in the blueprint. The
+// servers must already be listening. Each server has its registration loaded from the deployment.
+func DeployWithApplicationServices(t *testing.T, blueprint b.Blueprint, asServers ...*appservice.Server) *docker.Deployment {
+	t.Helper()
+	asURLs := make(map[string]string)
+	for _, srv := range asServers {
+		asURLs[srv.ID] = srv.URL()
+	}
+	dep := deploy(t, blueprint, asURLs)
+	for _, srv := range asServers {
+		srv.LoadRegistration(t, dep)
+	}
+	return dep
+}
+
+func deploy(t *testing.T, blueprint b.Blueprint, asURLs map[string]string) *docker.Deployment {
 	t.Helper()
 	timeStartBlueprint := time.Now()
-	if complementBuilder == nil {
-		t.Fatalf("complementBuilder not set, did you forget to call TestMain?")
+	if complementConfig == nil {
+		t.Fatalf("complementConfig not set, did you forget to call TestMain?")
+	}
+	if len(complementConfig.ExternalHomeservers) > 0 {
+		dep, err := docker.DeployExternal(complementConfig, blueprint)
+		if err != nil {
+			t.Fatalf("Deploy: DeployExternal returned error %s", err)
+		}
+		t.Logf("Deploy times: %v applying blueprint to external homeservers", time.Since(timeStartBlueprint))
+		return instrument(t, dep, time.Since(timeStartBlueprint), 0)
 	}
 	if err := complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
 		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
 	}
+	// pooled deployments are started before we know which application service URLs to use, so deployments
+	// with application services bypass the pool and are always deployed whilst the test waits
+	if complementPool != nil && len(asURLs) == 0 {
+		timeStartDeploy := time.Now()
+		dep, hit, err := complementPool.Acquire(context.Background(), blueprint.Name)
+		if err != nil {
+			t.Fatalf("Deploy: Acquire returned error %s", err)
+		}
+		t.Logf("Deploy times: %v blueprints, %v containers (pool hit: %v)", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy), hit)
+		return instrument(t, dep, timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	}
 	namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
-	d, err := docker.NewDeployer(namespace, complementBuilder.Config)
+	d, err := docker.NewDeployer(namespace, complementConfig)
 	if err != nil {
 		t.Fatalf("Deploy: NewDeployer returned error %s", err)
 	}
+	d.ApplicationServiceURLs = asURLs
 	timeStartDeploy := time.Now()
 	dep, err := d.Deploy(context.Background(), blueprint.Name)
 	if err != nil {
 		t.Fatalf("Deploy: Deploy returned error %s", err)
 	}
 	t.Logf("Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	return instrument(t, dep, timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+}
+
+// instrument attaches the test's report entry to the deployment, if reporting is enabled, and starts
+// recording the deployment's traffic, if COMPLEMENT_HAR_DIR is set. The deployment is registered with
+// the runtime package so tests can check what the homeservers support.
+func instrument(t *testing.T, dep *docker.Deployment, blueprintTime, containersTime time.Duration) *docker.Deployment {
+	runtime.RegisterDeployment(t, dep)
+	if entry := complementReporter.Test(t); entry != nil {
+		entry.AddDeploy(dep.BlueprintName, blueprintTime, containersTime)
+		dep.Report = entry
+	}
+	if harDir := complementConfig.HARDir; harDir != "" {
+		accessTokens := make(map[string]map[string]string)
+		for hsName, hsDep := range dep.HS {
+			accessTokens[hsName] = hsDep.AccessTokens
+		}
+		dep.HAR = har.NewRecorder(dep.BlueprintName, accessTokens)
+		t.Cleanup(func() {
+			if err := os.MkdirAll(harDir, 0755); err != nil {
+				t.Logf("Failed to make HAR directory: %s", err)
+				return
+			}
+			name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+			path := filepath.Join(harDir, fmt.Sprintf("%s.%s.har", name, dep.BlueprintName))
+			if err := dep.HAR.WriteFile(path); err != nil {
+				t.Logf("Failed to write HAR file: %s", err)
+			}
+		})
+	}
 	return dep
 }
 
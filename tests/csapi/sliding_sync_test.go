@@ -0,0 +1,99 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/runtime"
+)
+
+// Test that the same room changes are seen over /sync and sliding sync.
+func TestSlidingSync(t *testing.T) {
+	runtime.Require(t, runtime.MSC3575)
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	listReq := client.SlidingSyncReq{
+		Lists: []client.SlidingSyncList{{
+			Ranges:        [][2]int64{{0, 20}},
+			Sort:          []string{client.SlidingSyncSortByRecency},
+			RequiredState: [][2]string{{"m.room.member", "*"}},
+			TimelineLimit: 10,
+		}},
+	}
+
+	t.Run("Rooms are sorted by recency", func(t *testing.T) {
+		roomA := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		roomB := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		eventID := alice.SendEventSynced(t, roomA, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "bump",
+			},
+		})
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomA, eventID))
+		alice.MustSlidingSyncUntil(t, listReq, client.SlidingSyncTimelineHasEventID(roomA, eventID))
+
+		// roomA was bumped by the message so comes before roomB
+		topTwo := client.SlidingSyncReq{
+			Lists: []client.SlidingSyncList{{
+				Ranges: [][2]int64{{0, 1}},
+				Sort:   []string{client.SlidingSyncSortByRecency},
+			}},
+		}
+		alice.MustSlidingSyncUntil(t, topTwo, client.SlidingSyncListHasRooms(0, []string{roomA, roomB}))
+
+		// sending to roomB moves it to the top
+		alice.SendEventSynced(t, roomB, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "bump",
+			},
+		})
+		alice.MustSlidingSyncUntil(t, topTwo, client.SlidingSyncListHasRooms(0, []string{roomB, roomA}))
+	})
+
+	t.Run("Invites and joins are seen over both sync APIs", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+		alice.InviteRoom(t, roomID, bob.UserID)
+
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncInvitedTo(bob.UserID, roomID))
+		bob.MustSlidingSyncUntil(t, listReq, client.SlidingSyncInvitedTo(bob.UserID, roomID))
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncInvitedTo(bob.UserID, roomID))
+		alice.MustSlidingSyncUntil(t, listReq, client.SlidingSyncInvitedTo(bob.UserID, roomID))
+
+		bob.JoinRoom(t, roomID, nil)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+		alice.MustSlidingSyncUntil(t, listReq, client.SlidingSyncJoinedTo(bob.UserID, roomID))
+		bob.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			RoomSubscriptions: map[string]client.RoomSubscription{
+				roomID: {
+					RequiredState: [][2]string{{"m.room.member", bob.UserID}},
+				},
+			},
+		}, client.SlidingSyncStateHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("state_key").Str == bob.UserID && ev.Get("content.membership").Str == "join"
+		}))
+	})
+
+	t.Run("Account data is returned by the extension", func(t *testing.T) {
+		alice.SetGlobalAccountData(t, "com.example.sliding_sync", map[string]interface{}{"foo": "bar"})
+		isAccountData := func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "com.example.sliding_sync" && ev.Get("content.foo").Str == "bar"
+		}
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncGlobalAccountDataHas(isAccountData))
+		alice.MustSlidingSyncUntil(t, client.SlidingSyncReq{
+			Extensions: &client.SlidingSyncExtensions{
+				AccountData: &client.SlidingSyncExtension{Enabled: true},
+			},
+		}, client.SlidingSyncGlobalAccountDataHas(isAccountData))
+	})
+}
@@ -306,7 +306,7 @@ func TestSync(t *testing.T) {
 				Content: map[string]interface{}{},
 				Redacts: "$12345",
 			})
-			redactionRoom.AddEvent(redactionEvent)
+			redactionRoom.MustAddEvent(t, redactionEvent)
 			t.Logf("Created redaction event %s", redactionEvent.EventID())
 			srv.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{redactionEvent.JSON()}, nil)
 
@@ -315,7 +315,7 @@ func TestSync(t *testing.T) {
 				Sender:  charlie,
 				Content: map[string]interface{}{"body": "1234"},
 			})
-			sentinelRoom.AddEvent(sentinelEvent)
+			sentinelRoom.MustAddEvent(t, sentinelEvent)
 			t.Logf("Created sentinel event %s", sentinelEvent.EventID())
 			srv.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{redactionEvent.JSON(), sentinelEvent.JSON()}, nil)
 
@@ -332,7 +332,7 @@ func TestSync(t *testing.T) {
 					Sender:  charlie,
 					Content: map[string]interface{}{},
 				})
-				redactionRoom.AddEvent(ev)
+				redactionRoom.MustAddEvent(t, ev)
 				pdus[i] = ev.JSON()
 				lastSentEventId = ev.EventID()
 			}
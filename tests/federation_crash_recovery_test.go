@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Test that federation traffic queued while a homeserver is down, paused or has crashed is delivered once
+// both homeservers are running again.
+func TestFederationCrashRecovery(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+	// catching up can take a while as the sending homeserver has to work out what was missed
+	alice.SyncUntilTimeout = 30 * time.Second
+	bob.SyncUntilTimeout = 30 * time.Second
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	sendMessage := func(t *testing.T, c *client.CSAPI, body string) string {
+		t.Helper()
+		return c.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    body,
+			},
+		})
+	}
+
+	t.Run("Events sent while the destination has crashed are received after it starts", func(t *testing.T) {
+		deployment.Kill(t, "hs2")
+		eventID := sendMessage(t, alice, "sent while hs2 was down")
+		deployment.Start(t, "hs2")
+
+		// hs1 may be backing off from hs2, but an event from hs2 shows hs2 is reachable again
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, sendMessage(t, bob, "hs2 is back")))
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+	})
+
+	t.Run("Events sent while the destination is paused are received after it unpauses", func(t *testing.T) {
+		deployment.Pause(t, "hs2")
+		eventID := sendMessage(t, alice, "sent while hs2 was paused")
+		deployment.Unpause(t, "hs2")
+
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, sendMessage(t, bob, "hs2 is back")))
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+	})
+
+	t.Run("To-device events queued by a homeserver which crashes are sent after it starts", func(t *testing.T) {
+		// stop hs2 so the to-device event can only be queued on hs1, then crash hs1
+		deployment.Stop(t, "hs2")
+		alice.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "sendToDevice", "m.complement.test", "crash_recovery"},
+			client.WithJSONBody(t, map[string]interface{}{
+				"messages": map[string]interface{}{
+					bob.UserID: map[string]interface{}{
+						bob.DeviceID: map[string]interface{}{
+							"body": "queued before hs1 crashed",
+						},
+					},
+				},
+			}),
+		)
+		deployment.Kill(t, "hs1")
+		deployment.Start(t, "hs1")
+		deployment.Start(t, "hs2")
+
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, sendMessage(t, bob, "hs2 is back")))
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncToDeviceHas(func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.complement.test" && ev.Get("sender").Str == alice.UserID &&
+				ev.Get("content.body").Str == "queued before hs1 crashed"
+		}))
+	})
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Test that real Olm and Megolm encrypted events can be decrypted by a device on another homeserver, which
+// checks that device keys, one-time keys, to-device events and encrypted room events are relayed intact.
+func TestFederationEncryptedMessages(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := client.NewE2EEClient(t, deployment.Client(t, "hs1", "@alice:hs1"))
+	bob := client.NewE2EEClient(t, deployment.Client(t, "hs2", "@bob:hs2"))
+	alice.MustUploadKeys(t, 5)
+	bob.MustUploadKeys(t, 5)
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"initial_state": []map[string]interface{}{
+			{
+				"type":      "m.room.encryption",
+				"state_key": "",
+				"content": map[string]interface{}{
+					"algorithm": client.MegolmAlgorithm,
+				},
+			},
+		},
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	// the tests share Olm sessions so must run in order
+	t.Run("Olm encrypted to-device events can be decrypted over federation", func(t *testing.T) {
+		bobDevices := alice.MustQueryKeys(t, bob.UserID)
+		if len(bobDevices) != 1 || bobDevices[0].Curve25519 != bob.Curve25519 {
+			t.Fatalf("alice queried bob's devices and got %+v, want bob's device %s", bobDevices, bob.DeviceID)
+		}
+		alice.MustSendEncryptedToDevice(t, bobDevices[0], "m.complement.test", map[string]interface{}{
+			"body": "hello bob",
+		})
+		bob.MustSyncUntil(t, client.SyncReq{}, bob.SyncToDeviceDecrypted(func(ev client.DecryptedEvent) bool {
+			return ev.Sender == alice.UserID && ev.SenderKey == alice.Curve25519 && ev.Type == "m.complement.test" &&
+				ev.Content.Get("body").Str == "hello bob"
+		}))
+
+		// bob replies on the session alice started, without claiming one of alice's one-time keys
+		aliceDevices := bob.MustQueryKeys(t, alice.UserID)
+		bob.MustSendEncryptedToDevice(t, aliceDevices[0], "m.complement.test", map[string]interface{}{
+			"body": "hello alice",
+		})
+		alice.MustSyncUntil(t, client.SyncReq{}, alice.SyncToDeviceDecrypted(func(ev client.DecryptedEvent) bool {
+			return ev.Sender == bob.UserID && ev.SenderKey == bob.Curve25519 && ev.Type == "m.complement.test" &&
+				ev.Content.Get("body").Str == "hello alice"
+		}))
+	})
+
+	t.Run("Megolm encrypted room events can be decrypted over federation", func(t *testing.T) {
+		alice.MustShareRoomKey(t, roomID, alice.MustQueryKeys(t, bob.UserID))
+		eventID := alice.MustSendMegolm(t, roomID, "m.room.message", map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "this is a secret",
+		})
+		bob.MustSyncUntil(t, client.SyncReq{}, bob.SyncRoomKeyReceived(roomID))
+		bob.MustSyncUntil(t, client.SyncReq{}, bob.SyncTimelineHasDecrypted(roomID, func(ev client.DecryptedEvent) bool {
+			return ev.EventID == eventID && ev.SenderKey == alice.Curve25519 && ev.Type == "m.room.message" &&
+				ev.Content.Get("body").Str == "this is a secret"
+		}))
+	})
+}
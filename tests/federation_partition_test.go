@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Test that events sent while two homeservers are partitioned from each other are delivered once the
+// partition heals, and that federation keeps working over a slow and lossy link.
+func TestFederationPartition(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	t.Run("Events sent during a partition are received after it heals", func(t *testing.T) {
+		_, since := bob.MustSync(t, client.SyncReq{TimeoutMillis: "0"})
+		deployment.Partition(t, "hs1", "hs2")
+		aliceEventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "sent during the partition",
+			},
+		})
+		// the partition must stop the event reaching hs2, otherwise this test proves nothing
+		mustNotReceiveEvent(t, bob, since, roomID, aliceEventID, 5*time.Second)
+		deployment.Heal(t, "hs1", "hs2")
+
+		// hs1 may be backing off from hs2, but an event from hs2 shows hs2 is reachable again
+		bobEventID := bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "sent after the partition healed",
+			},
+		})
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, bobEventID))
+		// catching up can take a while as hs1 has to work out which events hs2 missed
+		bob.SyncUntilTimeout = 30 * time.Second
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, aliceEventID))
+	})
+
+	t.Run("Events are received over a degraded link", func(t *testing.T) {
+		latency := 200 * time.Millisecond
+		deployment.DegradeLink(t, "hs1", "hs2", docker.LinkConditions{
+			Latency:    latency,
+			PacketLoss: 10,
+		})
+		defer deployment.Heal(t, "hs1", "hs2")
+		start := time.Now()
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "sent over a degraded link",
+			},
+		})
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+		// the event has to cross the link at least once, so it can't arrive sooner than the added latency
+		if elapsed := time.Since(start); elapsed < latency {
+			t.Fatalf("event was received after %v, which is less than the added latency of %v", elapsed, latency)
+		} else {
+			t.Logf("event was received after %v over a link with %v of added latency", elapsed, latency)
+		}
+	})
+}
+
+// mustNotReceiveEvent syncs from `since` for the given duration and fails the test if the event appears in
+// the room timeline.
+func mustNotReceiveEvent(t *testing.T, c *client.CSAPI, since, roomID, eventID string, duration time.Duration) {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < duration {
+		res, nextBatch := c.MustSync(t, client.SyncReq{Since: since, TimeoutMillis: "1000"})
+		since = nextBatch
+		for _, ev := range res.Get("rooms.join." + client.GjsonEscape(roomID) + ".timeline.events").Array() {
+			if ev.Get("event_id").Str == eventID {
+				t.Fatalf("%s received event %s after %v, want it not to be received", c.UserID, eventID, time.Since(start))
+			}
+		}
+	}
+}
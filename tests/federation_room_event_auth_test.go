@@ -170,7 +170,7 @@ func TestInboundFederationRejectsEventsWithRejectedAuthEvents(t *testing.T) {
 		Content:    map[string]interface{}{"body": "sentEvent1"},
 		AuthEvents: room.EventIDsOrReferences(sentEventAuthEvents),
 	})
-	room.AddEvent(sentEvent1)
+	room.MustAddEvent(t, sentEvent1)
 	eventAuthMap[sentEvent1.EventID()] = sentEventAuthEvents
 	t.Logf("Created sent event 1 %s", sentEvent1.EventID())
 
@@ -182,7 +182,7 @@ func TestInboundFederationRejectsEventsWithRejectedAuthEvents(t *testing.T) {
 		Content:    map[string]interface{}{"body": "sentEvent1"},
 		AuthEvents: room.EventIDsOrReferences(sentEventAuthEvents),
 	})
-	room.AddEvent(sentEvent2)
+	room.MustAddEvent(t, sentEvent2)
 	// we deliberately add nothing to eventAuthMap for this event, to make /event_auth
 	// return a 404.
 	t.Logf("Created sent event 2 %s", sentEvent2.EventID())
@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
-	"github.com/matrix-org/util"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
@@ -68,7 +68,6 @@ func TestGetMissingEventsGapFilling(t *testing.T) {
 	lastSharedEvent := srvRoom.Timeline[len(srvRoom.Timeline)-1]
 
 	// 2) Inject events into Complement but don't deliver them to the HS.
-	var missingEvents []json.RawMessage
 	var missingEventIDs []string
 	numMissingEvents := 5
 	for i := 0; i < numMissingEvents; i++ {
@@ -79,8 +78,7 @@ func TestGetMissingEventsGapFilling(t *testing.T) {
 				"body": fmt.Sprintf("Missing event %d/%d", i+1, numMissingEvents),
 			},
 		})
-		srvRoom.AddEvent(missingEvent)
-		missingEvents = append(missingEvents, missingEvent.JSON())
+		srvRoom.MustAddEvent(t, missingEvent)
 		missingEventIDs = append(missingEventIDs, missingEvent.EventID())
 	}
 
@@ -92,35 +90,28 @@ func TestGetMissingEventsGapFilling(t *testing.T) {
 			"body": "most recent event",
 		},
 	})
-	srvRoom.AddEvent(mostRecentEvent)
+	srvRoom.MustAddEvent(t, mostRecentEvent)
 
 	// 4) Respond to /get_missing_events with the missing events if the request is well-formed.
-	srv.Mux().HandleFunc(
-		"/_matrix/federation/v1/get_missing_events/{roomID}",
-		srv.ValidFederationRequest(t, func(fr *gomatrixserverlib.FederationRequest, pathParams map[string]string) util.JSONResponse {
-			if pathParams["roomID"] != roomID {
-				t.Errorf("Received /get_missing_events for the wrong room: %s", roomID)
-				return util.JSONResponse{
-					Code: 400,
-					JSON: "wrong room",
-				}
-			}
-			must.MatchFederationRequest(t, fr,
-				match.JSONKeyEqual("earliest_events", []interface{}{lastSharedEvent.EventID()}),
-				match.JSONKeyEqual("latest_events", []interface{}{mostRecentEvent.EventID()}),
-			)
-			t.Logf(
-				"/get_missing_events request well-formed, sending back response, earliest_events=%v latest_events=%v",
-				lastSharedEvent.EventID(), mostRecentEvent.EventID(),
-			)
-			return util.JSONResponse{
-				Code: 200,
-				JSON: map[string]interface{}{
-					"events": missingEvents,
-				},
-			}
-		}),
-	).Methods("POST")
+	federation.HandleGetMissingEventsRequests(func(
+		room *federation.ServerRoom, req gomatrixserverlib.MissingEvents, events []*gomatrixserverlib.Event,
+	) []*gomatrixserverlib.Event {
+		if room.RoomID != roomID {
+			t.Errorf("Received /get_missing_events for the wrong room: %s", room.RoomID)
+			return nil
+		}
+		if !reflect.DeepEqual(req.EarliestEvents, []string{lastSharedEvent.EventID()}) {
+			t.Errorf("/get_missing_events: got earliest_events %v want %v", req.EarliestEvents, []string{lastSharedEvent.EventID()})
+		}
+		if !reflect.DeepEqual(req.LatestEvents, []string{mostRecentEvent.EventID()}) {
+			t.Errorf("/get_missing_events: got latest_events %v want %v", req.LatestEvents, []string{mostRecentEvent.EventID()})
+		}
+		t.Logf(
+			"/get_missing_events request well-formed, sending back response, earliest_events=%v latest_events=%v",
+			lastSharedEvent.EventID(), mostRecentEvent.EventID(),
+		)
+		return events
+	})(srv)
 
 	// 3) ...and send that alone to the HS.
 	srv.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{mostRecentEvent.JSON()}, nil)
@@ -225,7 +216,7 @@ func TestOutboundFederationIgnoresMissingEventWithBadJSONForRoomVersion6(t *test
 	if err != nil {
 		t.Fatalf("failed to sign event: %s", err)
 	}
-	room.AddEvent(signedBadEvent)
+	room.MustAddEvent(t, signedBadEvent)
 
 	// send the first "good" event, referencing the broken event as a prev_event
 	sentEvent := srv.MustCreateEvent(t, room, b.Event{
@@ -235,7 +226,7 @@ func TestOutboundFederationIgnoresMissingEventWithBadJSONForRoomVersion6(t *test
 			"body": "Message 2",
 		},
 	})
-	room.AddEvent(sentEvent)
+	room.MustAddEvent(t, sentEvent)
 
 	waiter := NewWaiter()
 	onGetMissingEvents = func(w http.ResponseWriter, req *http.Request) {
@@ -288,7 +279,7 @@ func TestOutboundFederationIgnoresMissingEventWithBadJSONForRoomVersion6(t *test
 			"body": "Message 3",
 		},
 	})
-	room.AddEvent(message3)
+	room.MustAddEvent(t, message3)
 
 	waiter = NewWaiter()
 	onGetMissingEvents = func(w http.ResponseWriter, req *http.Request) {
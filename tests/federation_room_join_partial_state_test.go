@@ -98,7 +98,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 		// create the room on the complement server, with charlie and derek as members
 		serverRoom := server.MustMakeRoom(t, roomVer, federation.InitialRoomEvents(roomVer, server.UserID("charlie")))
-		serverRoom.AddEvent(createJoinEvent(t, server, serverRoom, server.UserID("derek")))
+		serverRoom.MustAddEvent(t, createJoinEvent(t, server, serverRoom, server.UserID("derek")))
 		return serverRoom
 	}
 
@@ -378,10 +378,6 @@ func TestPartialStateJoin(t *testing.T) {
 		handleGetMissingEventsRequests(t, server, serverRoom,
 			[]string{eventC.EventID()}, []*gomatrixserverlib.Event{eventB})
 
-		// dedicated state_ids and state handlers for event A
-		handleStateIdsRequests(t, server, serverRoom, eventA.EventID(), serverRoom.AllCurrentState(), nil, nil)
-		handleStateRequests(t, server, serverRoom, eventA.EventID(), serverRoom.AllCurrentState(), nil, nil)
-
 		// send event C to hs1
 		testReceiveEventDuringPartialStateJoin(t, deployment, alice, psjResult, eventC, syncToken)
 	})
@@ -789,7 +785,7 @@ func TestPartialStateJoin(t *testing.T) {
 				},
 			})
 			lastEventID = event.EventID()
-			serverRoom.AddEvent(event)
+			serverRoom.MustAddEvent(t, event)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{event.JSON()}, nil)
 		}
 
@@ -874,7 +870,7 @@ func TestPartialStateJoin(t *testing.T) {
 				StateKey: b.Ptr(fmt.Sprintf("state_%d", i)),
 				Content:  map[string]interface{}{"body": body},
 			})
-			serverRoom.AddEvent(outliers[i])
+			serverRoom.MustAddEvent(t, outliers[i])
 			outlierEventIDs[i] = outliers[i].EventID()
 		}
 		t.Logf("Created outliers: %s ... %s", outliers[0].EventID(), outliers[len(outliers)-1].EventID())
@@ -890,12 +886,6 @@ func TestPartialStateJoin(t *testing.T) {
 			[]string{timelineEvent2.EventID()}, []*gomatrixserverlib.Event{timelineEvent1},
 		)
 
-		// dedicated state_ids and state handlers for timelineEvent1's prev event (ie, the last outlier event)
-		handleStateIdsRequests(t, server, serverRoom, outliers[len(outliers)-1].EventID(),
-			serverRoom.AllCurrentState(), nil, nil)
-		handleStateRequests(t, server, serverRoom, outliers[len(outliers)-1].EventID(),
-			serverRoom.AllCurrentState(), nil, nil)
-
 		// now, send over the most recent event, which will make the server get_missing_events
 		// (we will send timelineEvent1), and then request state (we will send all the outliers).
 		server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{timelineEvent2.JSON()}, nil)
@@ -983,7 +973,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 		// we also create a regular event which should be accepted, to act as a sentinel
 		sentinelEvent := psjResult.CreateMessageEvent(t, "charlie", nil)
-		serverRoom.AddEvent(sentinelEvent)
+		serverRoom.MustAddEvent(t, sentinelEvent)
 		t.Logf("charlie created sentinel event %s", sentinelEvent.EventID())
 
 		server.MustSendTransaction(t, deployment, "hs1",
@@ -1046,11 +1036,11 @@ func TestPartialStateJoin(t *testing.T) {
 
 		// derek joins
 		derekJoinEvent := createJoinEvent(t, server, serverRoom, derek)
-		serverRoom.AddEvent(derekJoinEvent)
+		serverRoom.MustAddEvent(t, derekJoinEvent)
 
 		// ... and leaves again
 		derekLeaveEvent := createLeaveEvent(t, server, serverRoom, derek)
-		serverRoom.AddEvent(derekLeaveEvent)
+		serverRoom.MustAddEvent(t, derekLeaveEvent)
 
 		psjResult := beginPartialStateJoin(t, server, serverRoom, alice)
 		defer psjResult.Destroy()
@@ -1125,15 +1115,15 @@ func TestPartialStateJoin(t *testing.T) {
 
 		// derek joins
 		derekJoinEvent := createJoinEvent(t, server, serverRoom, derek)
-		serverRoom.AddEvent(derekJoinEvent)
+		serverRoom.MustAddEvent(t, derekJoinEvent)
 
 		// ... and leaves again
 		derekLeaveEvent := createLeaveEvent(t, server, serverRoom, derek)
-		serverRoom.AddEvent(derekLeaveEvent)
+		serverRoom.MustAddEvent(t, derekLeaveEvent)
 
 		// Elsie joins
 		elsieJoinEvent := createJoinEvent(t, server, serverRoom, elsie)
-		serverRoom.AddEvent(elsieJoinEvent)
+		serverRoom.MustAddEvent(t, elsieJoinEvent)
 
 		psjResult := beginPartialStateJoin(t, server, serverRoom, alice)
 		defer psjResult.Destroy()
@@ -1171,12 +1161,12 @@ func TestPartialStateJoin(t *testing.T) {
 				elsieJoinEvent,
 			}),
 		})
-		serverRoom.AddEvent(rejectedStateEvent)
+		serverRoom.MustAddEvent(t, rejectedStateEvent)
 		t.Logf("elsie created state event %s", rejectedStateEvent.EventID())
 
 		// we also create a regular event which should be accepted, to act as a sentinel
 		sentinelEvent := psjResult.CreateMessageEvent(t, "charlie", nil)
-		serverRoom.AddEvent(sentinelEvent)
+		serverRoom.MustAddEvent(t, sentinelEvent)
 		t.Logf("charlie created sentinel event %s", sentinelEvent.EventID())
 
 		server.MustSendTransaction(t, deployment, "hs1",
@@ -1626,7 +1616,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// The room starts with @charlie:server1 and @derek:server1 in it.
 			// @elsie:server2 joins the room before @t23alice:hs1.
-			room.AddEvent(createJoinEvent(t, server2, room, server2.UserID("elsie")))
+			room.MustAddEvent(t, createJoinEvent(t, server2, room, server2.UserID("elsie")))
 
 			// @t23alice:hs1 joins the room.
 			psjResult := beginPartialStateJoin(t, server1, room, alice)
@@ -1670,7 +1660,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// Make server1 send the event to the homeserver, since server2's rooms list isn't set
 			// up right and it can't answer queries about events in the room.
 			joinEvent := createJoinEvent(t, server2, room, server2.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server1.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), "")
 
@@ -1701,7 +1691,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// The room starts with @charlie:server1 and @derek:server1 in it.
 			// @elsie:server2 joins the room before @t25alice:hs1.
-			room.AddEvent(createJoinEvent(t, server2, room, server2.UserID("elsie")))
+			room.MustAddEvent(t, createJoinEvent(t, server2, room, server2.UserID("elsie")))
 
 			// @t25alice:hs1 joins the room.
 			psjResult := beginPartialStateJoin(t, server1, room, alice)
@@ -1711,7 +1701,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// Make server1 send the event to the homeserver, since server2's rooms list isn't set
 			// up right and it can't answer queries about events in the room.
 			leaveEvent := createLeaveEvent(t, server2, room, server2.UserID("elsie"))
-			room.AddEvent(leaveEvent)
+			room.MustAddEvent(t, leaveEvent)
 			server1.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{leaveEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, leaveEvent.EventID(), "")
 
@@ -1752,7 +1742,7 @@ func TestPartialStateJoin(t *testing.T) {
 			var powerLevelsContent map[string]interface{}
 			json.Unmarshal(room.CurrentState("m.room.power_levels", "").Content(), &powerLevelsContent)
 			powerLevelsContent["users"].(map[string]interface{})[derek] = 100
-			room.AddEvent(server1.MustCreateEvent(t, room, b.Event{
+			room.MustAddEvent(t, server1.MustCreateEvent(t, room, b.Event{
 				Type:     "m.room.power_levels",
 				StateKey: b.Ptr(""),
 				Sender:   server1.UserID("charlie"),
@@ -1762,7 +1752,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// @derek:server1 leaves the room.
 			derekJoinEvent := room.CurrentState("m.room.member", derek)
 			derekLeaveEvent := createLeaveEvent(t, server1, room, derek)
-			room.AddEvent(derekLeaveEvent)
+			room.MustAddEvent(t, derekLeaveEvent)
 
 			// @alice:hs1 joins the room.
 			psjResult = beginPartialStateJoin(t, server1, room, alice)
@@ -1771,7 +1761,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// Make server1 send the event to the homeserver, since server2's rooms list isn't set
 			// up right and it can't answer queries about events in the room.
 			joinEvent := createJoinEvent(t, server2, room, elsie)
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server1.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			syncToken = awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), "")
 
@@ -1829,7 +1819,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// Make server1 send the event to the homeserver, since server2's rooms list isn't set
 			// up right and it can't answer queries about events in the room.
 			leaveEvent := createLeaveEvent(t, server2, partialStateRoom, elsie)
-			partialStateRoom.AddEvent(leaveEvent)
+			partialStateRoom.MustAddEvent(t, leaveEvent)
 			server1.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{leaveEvent.JSON()}, nil)
 			syncToken = awaitEventViaSync(t, alice, partialStateRoom.RoomID, leaveEvent.EventID(), syncToken)
 
@@ -1938,7 +1928,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// The room starts with @charlie:server1 and @derek:server1 in it.
 			// @elsie:server2 joins the room, followed by @t28alice:hs1.
 			// server1 does not tell hs1 that server2 is in the room.
-			room.AddEvent(createJoinEvent(t, server2, room, server2.UserID("elsie")))
+			room.MustAddEvent(t, createJoinEvent(t, server2, room, server2.UserID("elsie")))
 			psjResult := beginPartialStateJoin(t, server1, room, alice)
 			defer psjResult.Destroy()
 
@@ -1962,7 +1952,7 @@ func TestPartialStateJoin(t *testing.T) {
 			// The room starts with @charlie:server1 and @derek:server1 in it.
 			// @elsie:server2 joins the room, followed by @t29alice:hs1.
 			// server1 does not tell hs1 that server2 is in the room.
-			room.AddEvent(createJoinEvent(t, server2, room, server2.UserID("elsie")))
+			room.MustAddEvent(t, createJoinEvent(t, server2, room, server2.UserID("elsie")))
 			psjResult := beginPartialStateJoin(t, server1, room, alice)
 			defer psjResult.Destroy()
 
@@ -2356,7 +2346,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie joins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), syncToken)
 
@@ -2405,7 +2395,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie joins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), syncToken)
 
@@ -2421,7 +2411,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie leaves the room.
 			leaveEvent := createLeaveEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(leaveEvent)
+			room.MustAddEvent(t, leaveEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{leaveEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, leaveEvent.EventID(), syncToken)
 
@@ -2450,7 +2440,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie joins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), syncToken)
 
@@ -2492,7 +2482,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie joins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), "")
 
@@ -2535,7 +2525,7 @@ func TestPartialStateJoin(t *testing.T) {
 			json.Unmarshal(room.CurrentState("m.room.power_levels", "").Content(), &powerLevelsContent)
 			powerLevelsContent["users"].(map[string]interface{})[derek] = 50
 			powerLevelsContent["users"].(map[string]interface{})[fred] = 100
-			room.AddEvent(server.MustCreateEvent(t, room, b.Event{
+			room.MustAddEvent(t, server.MustCreateEvent(t, room, b.Event{
 				Type:     "m.room.power_levels",
 				StateKey: b.Ptr(""),
 				Sender:   charlie,
@@ -2544,16 +2534,16 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @fred joins and leaves the room.
 			fredJoinEvent := createJoinEvent(t, server, room, fred)
-			room.AddEvent(fredJoinEvent)
+			room.MustAddEvent(t, fredJoinEvent)
 			fredLeaveEvent := createLeaveEvent(t, server, room, fred)
-			room.AddEvent(fredLeaveEvent)
+			room.MustAddEvent(t, fredLeaveEvent)
 
 			// @alice:hs1 joins the room.
 			psjResult = beginPartialStateJoin(t, server, room, alice)
 
 			// @elsie joins the room.
 			joinEvent := createJoinEvent(t, server, room, elsie)
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			syncToken = awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), "")
 
@@ -2588,12 +2578,12 @@ func TestPartialStateJoin(t *testing.T) {
 				Sender:   derek,
 				Content:  map[string]interface{}{"membership": "leave"},
 			})
-			room.AddEvent(kickEvent)
+			room.MustAddEvent(t, kickEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{kickEvent.JSON()}, nil)
 
 			// Ensure that the kick event has been persisted.
 			sentinelEvent := psjResult.CreateMessageEvent(t, "charlie", nil)
-			room.AddEvent(sentinelEvent)
+			room.MustAddEvent(t, sentinelEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{sentinelEvent.JSON()}, nil)
 			syncToken = awaitEventViaSync(t, alice, room.RoomID, sentinelEvent.EventID(), syncToken)
 
@@ -2667,7 +2657,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie rejoins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), syncToken)
 
@@ -2716,7 +2706,7 @@ func TestPartialStateJoin(t *testing.T) {
 
 			// @elsie rejoins the room.
 			joinEvent := createJoinEvent(t, server, room, server.UserID("elsie"))
-			room.AddEvent(joinEvent)
+			room.MustAddEvent(t, joinEvent)
 			server.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{joinEvent.JSON()}, nil)
 			awaitEventViaSync(t, alice, room.RoomID, joinEvent.EventID(), syncToken)
 
@@ -2956,23 +2946,23 @@ func beginPartialStateJoin(t *testing.T, server *federation.Server, serverRoom *
 	result.fedStateIdsRequestReceivedWaiter = NewWaiter()
 	result.fedStateIdsSendResponseWaiter = NewWaiter()
 
-	// register a handler for /state_ids requests for the most recent event,
+	// register a hook for /state_ids requests for the most recent event,
 	// which finishes fedStateIdsRequestReceivedWaiter, then
-	// waits for fedStateIdsSendResponseWaiter and sends a reply
-	lastEvent := serverRoom.Timeline[len(serverRoom.Timeline)-1]
-	currentState := serverRoom.AllCurrentState()
-	handleStateIdsRequests(
-		t, server, serverRoom,
-		lastEvent.EventID(), currentState,
-		result.fedStateIdsRequestReceivedWaiter, result.fedStateIdsSendResponseWaiter,
-	)
+	// waits for fedStateIdsSendResponseWaiter before the reply is sent
+	lastEventID := serverRoom.Timeline[len(serverRoom.Timeline)-1].EventID()
+	federation.HandleStateIdsRequests(func(room *federation.ServerRoom, eventID string) bool {
+		if room.RoomID != serverRoom.RoomID || eventID != lastEventID {
+			return true
+		}
+		t.Logf("Incoming state_ids request for event %s in room %s", eventID, room.RoomID)
+		result.fedStateIdsRequestReceivedWaiter.Finish()
+		result.fedStateIdsSendResponseWaiter.Waitf(t, 60*time.Second, "Waiting for /state_ids request")
+		t.Logf("Replying to /state_ids request for event %s", eventID)
+		return true
+	})(server)
 
-	// a handler for /state requests, which sends a sensible response
-	handleStateRequests(
-		t, server, serverRoom,
-		lastEvent.EventID(), currentState,
-		nil, nil,
-	)
+	// /state requests and /state_ids requests for other events get a sensible response straight away
+	federation.HandleStateRequests()(server)
 
 	// have joiningUser join the room by room ID.
 	joiningUser.JoinRoom(t, serverRoom.RoomID, []string{server.ServerName()})
@@ -3012,7 +3002,7 @@ func (psj *partialStateJoinResult) CreateMessageEvent(t *testing.T, senderLocalp
 		},
 		PrevEvents: prevEvents,
 	})
-	psj.ServerRoom.AddEvent(event)
+	psj.ServerRoom.MustAddEvent(t, event)
 	return event
 }
 
@@ -3026,123 +3016,25 @@ func (psj *partialStateJoinResult) FinishStateRequest() {
 	psj.fedStateIdsSendResponseWaiter.Finish()
 }
 
-// handleStateIdsRequests registers a handler for /state_ids requests for 'eventID'
-//
-// the returned state is as passed in 'roomState'
-//
-// if requestReceivedWaiter is not nil, it will be Finish()ed when the request arrives.
-// if sendResponseWaiter is not nil, we will Wait() for it to finish before sending the response.
-func handleStateIdsRequests(
-	t *testing.T, srv *federation.Server, serverRoom *federation.ServerRoom,
-	eventID string, roomState []*gomatrixserverlib.Event,
-	requestReceivedWaiter *Waiter, sendResponseWaiter *Waiter,
-) {
-	srv.Mux().NewRoute().Methods("GET").Path(
-		fmt.Sprintf("/_matrix/federation/v1/state_ids/%s", serverRoom.RoomID),
-	).Queries("event_id", eventID).Handler(
-		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			queryParams := req.URL.Query()
-			t.Logf("Incoming state_ids request for event %s in room %s", queryParams["event_id"], serverRoom.RoomID)
-			if requestReceivedWaiter != nil {
-				requestReceivedWaiter.Finish()
-			}
-			if sendResponseWaiter != nil {
-				sendResponseWaiter.Waitf(t, 60*time.Second, "Waiting for /state_ids request")
-			}
-			t.Logf("Replying to /state_ids request for event %s", queryParams["event_id"])
-
-			res := gomatrixserverlib.RespStateIDs{
-				AuthEventIDs:  eventIDsFromEvents(serverRoom.AuthChainForEvents(roomState)),
-				StateEventIDs: eventIDsFromEvents(roomState),
-			}
-			w.WriteHeader(200)
-			jsonb, _ := json.Marshal(res)
-
-			if _, err := w.Write(jsonb); err != nil {
-				t.Errorf("Error writing to request: %v", err)
-			}
-		}),
-	)
-	t.Logf("Registered state_ids handler for event %s", eventID)
-}
-
-// makeStateHandler returns a handler for /state requests for 'eventID'
-//
-// the returned state is as passed in 'roomState'
-//
-// if requestReceivedWaiter is not nil, it will be Finish()ed when the request arrives.
-// if sendResponseWaiter is not nil, we will Wait() for it to finish before sending the response.
-func handleStateRequests(
-	t *testing.T, srv *federation.Server, serverRoom *federation.ServerRoom,
-	eventID string, roomState []*gomatrixserverlib.Event,
-	requestReceivedWaiter *Waiter, sendResponseWaiter *Waiter,
-) {
-	srv.Mux().NewRoute().Methods("GET").Path(
-		fmt.Sprintf("/_matrix/federation/v1/state/%s", serverRoom.RoomID),
-	).Queries("event_id", eventID).Handler(
-		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			queryParams := req.URL.Query()
-			t.Logf("Incoming state request for event %s in room %s", queryParams["event_id"], serverRoom.RoomID)
-			if requestReceivedWaiter != nil {
-				requestReceivedWaiter.Finish()
-			}
-			if sendResponseWaiter != nil {
-				sendResponseWaiter.Waitf(t, 60*time.Second, "Waiting for /state request")
-			}
-
-			t.Logf("Replying to /state request for event %s", queryParams["event_id"])
-
-			res := gomatrixserverlib.RespState{
-				AuthEvents:  gomatrixserverlib.NewEventJSONsFromEvents(serverRoom.AuthChainForEvents(roomState)),
-				StateEvents: gomatrixserverlib.NewEventJSONsFromEvents(roomState),
-			}
-			w.WriteHeader(200)
-			jsonb, _ := json.Marshal(res)
-
-			if _, err := w.Write(jsonb); err != nil {
-				t.Errorf("Error writing to request: %v", err)
-			}
-		}),
-	)
-	t.Logf("Registered /state handler for event %s", eventID)
-}
-
 // register a handler for `/get_missing_events` requests
 //
 // This can (currently) only handle a single `/get_missing_events` request, and the "latest_events" in the request
-// must match those listed in "expectedLatestEvents" (otherwise the test is failed).
+// must match those listed in "expectedLatestEvents" (otherwise the test is failed). Only "eventsToReturn" are
+// returned, regardless of what is in the room.
 func handleGetMissingEventsRequests(
 	t *testing.T, srv *federation.Server, serverRoom *federation.ServerRoom,
 	expectedLatestEvents []string, eventsToReturn []*gomatrixserverlib.Event,
 ) {
-	srv.Mux().HandleFunc(fmt.Sprintf("/_matrix/federation/v1/get_missing_events/%s", serverRoom.RoomID), func(w http.ResponseWriter, req *http.Request) {
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			t.Fatalf("unable to read /get_missing_events request body: %s", err)
+	federation.HandleGetMissingEventsRequests(func(
+		room *federation.ServerRoom, getMissingEventsRequest gomatrixserverlib.MissingEvents, events []*gomatrixserverlib.Event,
+	) []*gomatrixserverlib.Event {
+		if room.RoomID != serverRoom.RoomID {
+			return events
 		}
-		var getMissingEventsRequest gomatrixserverlib.MissingEvents
-		err = json.Unmarshal(body, &getMissingEventsRequest)
-		if err != nil {
-			t.Fatalf("unable to unmarshall /get_missing_events request body: %s", err)
-		}
-
 		t.Logf("Incoming get_missing_events request for prev events of %s in room %s", getMissingEventsRequest.LatestEvents, serverRoom.RoomID)
 		if !reflect.DeepEqual(expectedLatestEvents, getMissingEventsRequest.LatestEvents) {
 			t.Fatalf("getMissingEventsRequest.LatestEvents: got %v, wanted %v", getMissingEventsRequest, expectedLatestEvents)
 		}
-
-		responseBytes, _ := json.Marshal(gomatrixserverlib.RespMissingEvents{
-			Events: gomatrixserverlib.NewEventJSONsFromEvents(eventsToReturn),
-		})
-		w.WriteHeader(200)
-		w.Write(responseBytes)
-	}).Methods("POST")
-}
-
-func eventIDsFromEvents(he []*gomatrixserverlib.Event) []string {
-	eventIDs := make([]string, len(he))
-	for i := range he {
-		eventIDs[i] = he[i].EventID()
-	}
-	return eventIDs
+		return eventsToReturn
+	})(srv)
 }
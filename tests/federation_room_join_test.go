@@ -64,27 +64,29 @@ func TestJoinViaRoomIDAndServerName(t *testing.T) {
 		federation.SendJoinRequestsHandler(srv, w, req, false, false)
 	})).Methods("PUT")
 
-	ver := alice.GetDefaultRoomVersion(t)
 	charlie := srv.UserID("charlie")
-	serverRoom := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
 
-	// join the room by room ID, providing the serverName to join via
-	alice.JoinRoom(t, serverRoom.RoomID, []string{srv.ServerName()})
+	runtime.RunForEachRoomVersion(t, nil, func(t *testing.T, ver gomatrixserverlib.RoomVersion) {
+		acceptMakeSendJoinRequests = true
+		serverRoom := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
 
-	// remove the make/send join paths from the Complement server to force HS2 to join via HS1
-	acceptMakeSendJoinRequests = false
+		// join the room by room ID, providing the serverName to join via
+		alice.JoinRoom(t, serverRoom.RoomID, []string{srv.ServerName()})
 
-	// join the room using ?server_name on HS2
-	bob := deployment.Client(t, "hs2", "@bob:hs2")
+		// remove the make/send join paths from the Complement server to force HS2 to join via HS1
+		acceptMakeSendJoinRequests = false
 
-	queryParams := url.Values{}
-	queryParams.Set("server_name", "hs1")
-	res := bob.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "join", serverRoom.RoomID}, client.WithQueries(queryParams))
-	must.MatchResponse(t, res, match.HTTPResponse{
-		StatusCode: 200,
-		JSON: []match.JSON{
-			match.JSONKeyEqual("room_id", serverRoom.RoomID),
-		},
+		// join the room using ?server_name on HS2
+		queryParams := url.Values{}
+		queryParams.Set("server_name", "hs1")
+		res := bob.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "join", serverRoom.RoomID}, client.WithQueries(queryParams))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 200,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("room_id", serverRoom.RoomID),
+			},
+		})
 	})
 }
 
@@ -115,142 +117,143 @@ func TestJoinFederatedRoomWithUnverifiableEvents(t *testing.T) {
 	cancel := srv.Listen()
 	defer cancel()
 
-	ver := alice.GetDefaultRoomVersion(t)
 	charlie := srv.UserID("charlie")
 
 	// We explicitly do not run these in parallel in order to help debugging when these
 	// tests fail. It doesn't appear to save us much time either!
 
-	t.Run("/send_join response missing signatures shouldn't block room join", func(t *testing.T) {
-		//t.Parallel()
-		room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
-		roomAlias := srv.MakeAliasMapping("MissingSignatures", room.RoomID)
-		// create a normal event then remove the signatures key
-		signedEvent := srv.MustCreateEvent(t, room, b.Event{
-			Sender:   charlie,
-			StateKey: b.Ptr(""),
-			Type:     "m.room.name",
-			Content: map[string]interface{}{
-				"name": "This event has no signature",
-			},
-		})
-		raw := signedEvent.JSON()
-		raw, err := sjson.SetRawBytes(raw, "signatures", []byte(`{}`))
-		must.NotError(t, "failed to strip signatures key from event", err)
-		unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
-		must.NotError(t, "failed to make Event from unsigned event JSON", err)
-		room.AddEvent(unsignedEvent)
-		alice.JoinRoom(t, roomAlias, nil)
-	})
-	t.Run("/send_join response with bad signatures shouldn't block room join", func(t *testing.T) {
-		//t.Parallel()
-		room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
-		roomAlias := srv.MakeAliasMapping("BadSignatures", room.RoomID)
-		// create a normal event then modify the signatures
-		signedEvent := srv.MustCreateEvent(t, room, b.Event{
-			Sender:   charlie,
-			StateKey: b.Ptr(""),
-			Type:     "m.room.name",
-			Content: map[string]interface{}{
-				"name": "This event has a bad signature",
-			},
-		})
-		newSignaturesBlock := map[string]interface{}{
-			deployment.Config.HostnameRunningComplement: map[string]string{
-				string(srv.KeyID): "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
-			},
-		}
-		rawSig, err := json.Marshal(newSignaturesBlock)
-		must.NotError(t, "failed to marshal bad signature block", err)
-		raw := signedEvent.JSON()
-		raw, err = sjson.SetRawBytes(raw, "signatures", rawSig)
-		must.NotError(t, "failed to modify signatures key from event", err)
-		unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
-		must.NotError(t, "failed to make Event from unsigned event JSON", err)
-		room.AddEvent(unsignedEvent)
-		alice.JoinRoom(t, roomAlias, nil)
-	})
-	t.Run("/send_join response with unobtainable keys shouldn't block room join", func(t *testing.T) {
-		//t.Parallel()
-		room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
-		roomAlias := srv.MakeAliasMapping("UnobtainableKeys", room.RoomID)
-		// create a normal event then modify the signatures to have a bogus key ID which Complement does
-		// not have the keys for
-		signedEvent := srv.MustCreateEvent(t, room, b.Event{
-			Sender:   charlie,
-			StateKey: b.Ptr(""),
-			Type:     "m.room.name",
-			Content: map[string]interface{}{
-				"name": "This event has an unobtainable key ID",
-			},
+	runtime.RunForEachRoomVersion(t, nil, func(t *testing.T, ver gomatrixserverlib.RoomVersion) {
+		t.Run("/send_join response missing signatures shouldn't block room join", func(t *testing.T) {
+			//t.Parallel()
+			room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+			roomAlias := srv.MakeAliasMapping("MissingSignatures"+string(ver), room.RoomID)
+			// create a normal event then remove the signatures key
+			signedEvent := srv.MustCreateEvent(t, room, b.Event{
+				Sender:   charlie,
+				StateKey: b.Ptr(""),
+				Type:     "m.room.name",
+				Content: map[string]interface{}{
+					"name": "This event has no signature",
+				},
+			})
+			raw := signedEvent.JSON()
+			raw, err := sjson.SetRawBytes(raw, "signatures", []byte(`{}`))
+			must.NotError(t, "failed to strip signatures key from event", err)
+			unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
+			must.NotError(t, "failed to make Event from unsigned event JSON", err)
+			room.MustAddEvent(t, unsignedEvent)
+			alice.JoinRoom(t, roomAlias, nil)
 		})
-		newSignaturesBlock := map[string]interface{}{
-			deployment.Config.HostnameRunningComplement: map[string]string{
-				string(srv.KeyID) + "bogus": "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
-			},
-		}
-		rawSig, err := json.Marshal(newSignaturesBlock)
-		must.NotError(t, "failed to marshal bad signature block", err)
-		raw := signedEvent.JSON()
-		raw, err = sjson.SetRawBytes(raw, "signatures", rawSig)
-		must.NotError(t, "failed to modify signatures key from event", err)
-		unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
-		must.NotError(t, "failed to make Event from unsigned event JSON", err)
-		room.AddEvent(unsignedEvent)
-		alice.JoinRoom(t, roomAlias, nil)
-	})
-	t.Run("/send_join response with state with unverifiable auth events shouldn't block room join", func(t *testing.T) {
-		runtime.SkipIf(t, runtime.Dendrite) // https://github.com/matrix-org/dendrite/issues/2028
-		room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
-		roomAlias := srv.MakeAliasMapping("UnverifiableAuthEvents", room.RoomID)
-
-		// create a normal event then modify the signatures
-		rawEvent := srv.MustCreateEvent(t, room, b.Event{
-			Sender:   charlie,
-			StateKey: &charlie,
-			Type:     "m.room.member",
-			Content: map[string]interface{}{
-				"membership": "join",
-				"name":       "This event has a bad signature",
-			},
-		}).JSON()
-		rawSig, err := json.Marshal(map[string]interface{}{
-			deployment.Config.HostnameRunningComplement: map[string]string{
-				string(srv.KeyID): "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
-			},
+		t.Run("/send_join response with bad signatures shouldn't block room join", func(t *testing.T) {
+			//t.Parallel()
+			room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+			roomAlias := srv.MakeAliasMapping("BadSignatures"+string(ver), room.RoomID)
+			// create a normal event then modify the signatures
+			signedEvent := srv.MustCreateEvent(t, room, b.Event{
+				Sender:   charlie,
+				StateKey: b.Ptr(""),
+				Type:     "m.room.name",
+				Content: map[string]interface{}{
+					"name": "This event has a bad signature",
+				},
+			})
+			newSignaturesBlock := map[string]interface{}{
+				deployment.Config.HostnameRunningComplement: map[string]string{
+					string(srv.KeyID): "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
+				},
+			}
+			rawSig, err := json.Marshal(newSignaturesBlock)
+			must.NotError(t, "failed to marshal bad signature block", err)
+			raw := signedEvent.JSON()
+			raw, err = sjson.SetRawBytes(raw, "signatures", rawSig)
+			must.NotError(t, "failed to modify signatures key from event", err)
+			unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
+			must.NotError(t, "failed to make Event from unsigned event JSON", err)
+			room.MustAddEvent(t, unsignedEvent)
+			alice.JoinRoom(t, roomAlias, nil)
 		})
-		must.NotError(t, "failed to marshal bad signature block", err)
-		rawEvent, err = sjson.SetRawBytes(rawEvent, "signatures", rawSig)
-		must.NotError(t, "failed to modify signatures key from event", err)
-		badlySignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(rawEvent, false, ver)
-		must.NotError(t, "failed to make Event from badly signed event JSON", err)
-		room.AddEvent(badlySignedEvent)
-		t.Logf("Created badly signed auth event %s", badlySignedEvent.EventID())
-
-		// and now add another event which will use it as an auth event.
-		goodEvent := srv.MustCreateEvent(t, room, b.Event{
-			Sender:   charlie,
-			StateKey: &charlie,
-			Type:     "m.room.member",
-			Content: map[string]interface{}{
-				"membership": "leave",
-			},
+		t.Run("/send_join response with unobtainable keys shouldn't block room join", func(t *testing.T) {
+			//t.Parallel()
+			room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+			roomAlias := srv.MakeAliasMapping("UnobtainableKeys"+string(ver), room.RoomID)
+			// create a normal event then modify the signatures to have a bogus key ID which Complement does
+			// not have the keys for
+			signedEvent := srv.MustCreateEvent(t, room, b.Event{
+				Sender:   charlie,
+				StateKey: b.Ptr(""),
+				Type:     "m.room.name",
+				Content: map[string]interface{}{
+					"name": "This event has an unobtainable key ID",
+				},
+			})
+			newSignaturesBlock := map[string]interface{}{
+				deployment.Config.HostnameRunningComplement: map[string]string{
+					string(srv.KeyID) + "bogus": "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
+				},
+			}
+			rawSig, err := json.Marshal(newSignaturesBlock)
+			must.NotError(t, "failed to marshal bad signature block", err)
+			raw := signedEvent.JSON()
+			raw, err = sjson.SetRawBytes(raw, "signatures", rawSig)
+			must.NotError(t, "failed to modify signatures key from event", err)
+			unsignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(raw, false, ver)
+			must.NotError(t, "failed to make Event from unsigned event JSON", err)
+			room.MustAddEvent(t, unsignedEvent)
+			alice.JoinRoom(t, roomAlias, nil)
 		})
-		// double-check that the bad event is in its auth events
-		containsEvent := false
-		for _, authEventID := range goodEvent.AuthEventIDs() {
-			if authEventID == badlySignedEvent.EventID() {
-				containsEvent = true
-				break
+		t.Run("/send_join response with state with unverifiable auth events shouldn't block room join", func(t *testing.T) {
+			runtime.SkipIf(t, runtime.Dendrite) // https://github.com/matrix-org/dendrite/issues/2028
+			room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+			roomAlias := srv.MakeAliasMapping("UnverifiableAuthEvents"+string(ver), room.RoomID)
+
+			// create a normal event then modify the signatures
+			rawEvent := srv.MustCreateEvent(t, room, b.Event{
+				Sender:   charlie,
+				StateKey: &charlie,
+				Type:     "m.room.member",
+				Content: map[string]interface{}{
+					"membership": "join",
+					"name":       "This event has a bad signature",
+				},
+			}).JSON()
+			rawSig, err := json.Marshal(map[string]interface{}{
+				deployment.Config.HostnameRunningComplement: map[string]string{
+					string(srv.KeyID): "/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg",
+				},
+			})
+			must.NotError(t, "failed to marshal bad signature block", err)
+			rawEvent, err = sjson.SetRawBytes(rawEvent, "signatures", rawSig)
+			must.NotError(t, "failed to modify signatures key from event", err)
+			badlySignedEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(rawEvent, false, ver)
+			must.NotError(t, "failed to make Event from badly signed event JSON", err)
+			room.MustAddEvent(t, badlySignedEvent)
+			t.Logf("Created badly signed auth event %s", badlySignedEvent.EventID())
+
+			// and now add another event which will use it as an auth event.
+			goodEvent := srv.MustCreateEvent(t, room, b.Event{
+				Sender:   charlie,
+				StateKey: &charlie,
+				Type:     "m.room.member",
+				Content: map[string]interface{}{
+					"membership": "leave",
+				},
+			})
+			// double-check that the bad event is in its auth events
+			containsEvent := false
+			for _, authEventID := range goodEvent.AuthEventIDs() {
+				if authEventID == badlySignedEvent.EventID() {
+					containsEvent = true
+					break
+				}
 			}
-		}
-		if !containsEvent {
-			t.Fatalf("Bad event didn't appear in auth events of state event")
-		}
-		room.AddEvent(goodEvent)
-		t.Logf("Created state event %s", goodEvent.EventID())
+			if !containsEvent {
+				t.Fatalf("Bad event didn't appear in auth events of state event")
+			}
+			room.MustAddEvent(t, goodEvent)
+			t.Logf("Created state event %s", goodEvent.EventID())
 
-		alice.JoinRoom(t, roomAlias, nil)
+			alice.JoinRoom(t, roomAlias, nil)
+		})
 	})
 }
 
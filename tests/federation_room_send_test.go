@@ -4,7 +4,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/federation"
@@ -23,24 +23,13 @@ func TestOutboundFederationSend(t *testing.T) {
 
 	alice := deployment.Client(t, "hs1", "@alice:hs1")
 
-	waiter := NewWaiter()
 	wantEventType := "m.room.message"
 
 	// create a remote homeserver
 	srv := federation.NewServer(t, deployment,
 		federation.HandleKeyRequests(),
 		federation.HandleMakeSendJoinRequests(),
-		federation.HandleTransactionRequests(
-			// listen for PDU events in transactions
-			func(ev *gomatrixserverlib.Event) {
-				defer waiter.Finish()
-
-				if ev.Type() != wantEventType {
-					t.Errorf("Wrong event type, got %s want %s", ev.Type(), wantEventType)
-				}
-			},
-			nil,
-		),
+		federation.HandleTransactionRequests(nil, nil),
 	)
 	cancel := srv.Listen()
 	defer cancel()
@@ -63,6 +52,22 @@ func TestOutboundFederationSend(t *testing.T) {
 		},
 	})
 
-	// the remote homeserver then waits for the desired event to appear in a transaction
-	waiter.Wait(t, 5*time.Second)
+	// the remote homeserver then waits for the desired event to appear in a signed transaction
+	matchers := []federation.RequestMatcher{
+		federation.MatchMethod("PUT"),
+		federation.MatchPathPrefix("/_matrix/federation/v1/send/"),
+		federation.MatchOrigin("hs1"),
+		federation.MatchVerified(),
+		func(req federation.RecordedRequest) bool {
+			for _, pdu := range gjson.GetBytes(req.Body, "pdus").Array() {
+				if pdu.Get("room_id").Str == serverRoom.RoomID && pdu.Get("type").Str == wantEventType {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	srv.Recorder().MustWaitForRequests(t, 5*time.Second, 1, matchers...)
+	// the transaction was accepted, so it shouldn't be sent again
+	srv.Recorder().MustReceiveExactly(t, time.Second, 1, matchers...)
 }
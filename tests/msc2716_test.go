@@ -1,6 +1,3 @@
-//go:build msc2716
-// +build msc2716
-
 // This file contains tests for incrementally importing history to an existing room,
 // a currently experimental feature defined by MSC2716, which you can read here:
 // https://github.com/matrix-org/matrix-doc/pull/2716
@@ -23,6 +20,7 @@ import (
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/runtime"
 )
 
 type event struct {
@@ -61,6 +59,7 @@ var createPrivateRoomOpts = map[string]interface{}{
 }
 
 func TestImportHistoricalMessages(t *testing.T) {
+	runtime.Require(t, runtime.MSC2716)
 	deployment := Deploy(t, b.BlueprintHSWithApplicationService)
 	defer deployment.Destroy(t)
 
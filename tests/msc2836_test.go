@@ -1,6 +1,3 @@
-//go:build msc2836
-// +build msc2836
-
 package tests
 
 import (
@@ -23,6 +20,7 @@ import (
 	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/runtime"
 )
 
 // This test checks that federated threading works when the remote server joins after the messages
@@ -38,6 +36,7 @@ import (
 // an event which the server does have, event B, to ensure that this request also works and also does
 // federated hits to return missing events (A,C).
 func TestEventRelationships(t *testing.T) {
+	runtime.Require(t, runtime.MSC2836)
 	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
 	defer deployment.Destroy(t)
 
@@ -188,6 +187,7 @@ func TestEventRelationships(t *testing.T) {
 // We then check that B, which wasn't on the return path on the previous request, was persisted by calling
 // /event_relationships again with event ID 'A' and direction 'down'.
 func TestFederatedEventRelationships(t *testing.T) {
+	runtime.Require(t, runtime.MSC2836)
 	deployment := Deploy(t, b.BlueprintAlice)
 	defer deployment.Destroy(t)
 
@@ -213,7 +213,7 @@ func TestFederatedEventRelationships(t *testing.T) {
 			"msgtype": "m.text",
 		},
 	})
-	room.AddEvent(eventA)
+	room.MustAddEvent(t, eventA)
 	eventB := srv.MustCreateEvent(t, room, b.Event{
 		Type:   "m.room.message",
 		Sender: charlie,
@@ -226,7 +226,7 @@ func TestFederatedEventRelationships(t *testing.T) {
 			},
 		},
 	})
-	room.AddEvent(eventB)
+	room.MustAddEvent(t, eventB)
 	// wait 1ms to ensure that the timestamp changes, which is important when using the recent_first flag
 	time.Sleep(1 * time.Millisecond)
 	eventC := srv.MustCreateEvent(t, room, b.Event{
@@ -241,7 +241,7 @@ func TestFederatedEventRelationships(t *testing.T) {
 			},
 		},
 	})
-	room.AddEvent(eventC)
+	room.MustAddEvent(t, eventC)
 	eventD := srv.MustCreateEvent(t, room, b.Event{
 		Type:   "m.room.message",
 		Sender: charlie,
@@ -254,7 +254,7 @@ func TestFederatedEventRelationships(t *testing.T) {
 			},
 		},
 	})
-	room.AddEvent(eventD)
+	room.MustAddEvent(t, eventD)
 	t.Logf("A: %s", eventA.EventID())
 	t.Logf("B: %s", eventB.EventID())
 	t.Logf("C: %s", eventC.EventID())
@@ -315,7 +315,7 @@ func TestFederatedEventRelationships(t *testing.T) {
 			},
 		},
 	})
-	room.AddEvent(eventE)
+	room.MustAddEvent(t, eventE)
 	fedClient := srv.FederationClient(deployment)
 	_, err := fedClient.SendTransaction(context.Background(), gomatrixserverlib.Transaction{
 		TransactionID:  "complement",
@@ -1,6 +1,3 @@
-//go:build msc3030
-// +build msc3030
-
 // This file contains tests for a jump to date API endpoint,
 // currently experimental feature defined by MSC3030, which you can read here:
 // https://github.com/matrix-org/matrix-doc/pull/3030
@@ -18,10 +15,12 @@ import (
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/runtime"
 	"github.com/tidwall/gjson"
 )
 
 func TestJumpToDateEndpoint(t *testing.T) {
+	runtime.Require(t, runtime.MSC3030)
 	deployment := Deploy(t, b.BlueprintHSWithApplicationService)
 	defer deployment.Destroy(t)
 